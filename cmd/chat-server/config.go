@@ -1,22 +1,45 @@
 package main
 
-import "net/url"
+import (
+	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/gelf"
+	"net/url"
+	"time"
+)
 
 var (
-	LogToStdout             = true
-	LogDevelopment          = false
-	LogToGraylog            = false
-	LogLevelStdout          = "debug"
-	LogLevelGraylog         = "info"
-	LogToGraylogAddress     = &url.URL{}
-	ServerListenAddress     = &url.URL{}
-	UserImageSaveDir        = "/Users/apple/chat/user/image"
-	MysqlChatDataSourceName = ""
-	RedisServerAddress      = &url.URL{}
-	RedisServerPwd          = ""
-	RedisSelectDB           = 0
+	LogToStdout               = true
+	LogDevelopment            = false
+	LogToGraylog              = false
+	LogLevelStdout            = "debug"
+	LogLevelGraylog           = "info"
+	LogToGraylogAddress       = &url.URL{}
+	LogGraylogTLSCA           = ""
+	LogGraylogTLSInsecure     = false
+	LogGraylogCompression     = gelf.CompressionZlib
+	LogGraylogBatchSize       = 1
+	LogGraylogQueueSize       = 4096
+	LogGraylogDropPolicy      = gelf.DropOldest
+	LogGraylogResolveInterval = 5 * time.Minute
+	LogRedactFields           []string
+	LogRedactPatterns         []string
+	ServerListenAddress       = &url.URL{Host: "127.0.0.1:9092"}
+	UserImageSaveDir          = "/Users/apple/chat/user/image"
+	MysqlChatDataSourceName   = ""
+	RedisServerAddress        = &url.URL{Host: "localhost:6379"}
+	RedisServerPwd            = ""
+	RedisSelectDB             = 0
+	TokenKeys                 []config.TokenKeyConfig
+	TokenSigningKid           = ""
+	ShutdownTimeout           = 15 * time.Second
+	TracingOtlpEndpoint       = &url.URL{}
+	TracingOtlpInsecure       = true
+	TracingSampleRatio        = 1.0
 )
 
 const (
 	TestUid = -2000
 )
+
+// 编译时通过-ldflags "-X main.BuildVersion=..."注入
+var BuildVersion = "unknown"
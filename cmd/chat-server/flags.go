@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/gelf"
+	"github.com/liqifyl/chat-go/internal/log/redact"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	settingEnvarPrefix = "CHAT_"
+	settingConfigFile  = "config.file"
+)
+
+//给配置项的错误加上配置项名称，命令行、环境变量和配置文件中的错误都能定位到具体配置项
+type namedValue struct {
+	name string
+	kingpin.Value
+}
+
+func (v *namedValue) Set(s string) error {
+	err := v.Value.Set(s)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for setting %s: %v", s, v.name, err)
+	}
+	return nil
+}
+
+func (v *namedValue) IsBoolFlag() bool {
+	b, isBool := v.Value.(interface{ IsBoolFlag() bool })
+	return isBool && b.IsBoolFlag()
+}
+
+func (v *namedValue) IsCumulative() bool {
+	r, isRepeatable := v.Value.(interface{ IsCumulative() bool })
+	return isRepeatable && r.IsCumulative()
+}
+
+type boolValue struct{ v *bool }
+
+func (b *boolValue) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*b.v = v
+	return nil
+}
+
+func (b *boolValue) String() string   { return strconv.FormatBool(*b.v) }
+func (b *boolValue) IsBoolFlag() bool { return true }
+
+type stringValue struct{ v *string }
+
+func (s *stringValue) Set(value string) error {
+	*s.v = value
+	return nil
+}
+
+func (s *stringValue) String() string { return *s.v }
+
+type intValue struct{ v *int }
+
+func (i *intValue) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*i.v = v
+	return nil
+}
+
+func (i *intValue) String() string { return strconv.Itoa(*i.v) }
+
+type floatValue struct{ v *float64 }
+
+func (f *floatValue) Set(s string) error {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*f.v = v
+	return nil
+}
+
+func (f *floatValue) String() string { return strconv.FormatFloat(*f.v, 'g', -1, 64) }
+
+//可以重复配置的字符串，命令行或者环境变量中配置时替换配置文件中的值
+type stringsValue struct {
+	v        *[]string
+	fromFile bool
+}
+
+func (s *stringsValue) Set(value string) error {
+	if s.fromFile {
+		*s.v = nil
+		s.fromFile = false
+	}
+	*s.v = append(*s.v, value)
+	return nil
+}
+
+func (s *stringsValue) String() string { return strings.Join(*s.v, ",") }
+
+func (s *stringsValue) IsCumulative() bool { return true }
+
+type durationValue struct{ v *time.Duration }
+
+func (d *durationValue) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d.v = v
+	return nil
+}
+
+func (d *durationValue) String() string { return d.v.String() }
+
+//zap日志级别，debug、info、warn、error等
+type levelValue struct{ v *string }
+
+func (l *levelValue) Set(s string) error {
+	lv := zapcore.InfoLevel
+	err := lv.UnmarshalText([]byte(s))
+	if err != nil {
+		return err
+	}
+	*l.v = s
+	return nil
+}
+
+func (l *levelValue) String() string { return *l.v }
+
+//host:port形式的地址，为空时清空地址
+type hostPortValue struct{ v *url.URL }
+
+func (h *hostPortValue) Set(s string) error {
+	if s == "" {
+		h.v.Host = ""
+		return nil
+	}
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("port %s is invalid", port)
+	}
+	h.v.Host = s
+	return nil
+}
+
+func (h *hostPortValue) String() string { return h.v.Host }
+
+//graylog地址，udp://、tcp://、tls://、http://或者https://加上host:port，没有协议时使用udp
+type graylogAddressValue struct{ v *url.URL }
+
+func (g *graylogAddressValue) Set(s string) error {
+	scheme := ""
+	if index := strings.Index(s, "://"); index >= 0 {
+		scheme, s = s[:index], s[index+3:]
+		switch scheme {
+		case gelf.TransportUDP, gelf.TransportTCP, gelf.TransportTLS, gelf.TransportHTTP, gelf.TransportHTTPS:
+		default:
+			return fmt.Errorf("scheme %s is not supported, must be one of udp, tcp, tls, http, https", scheme)
+		}
+	}
+	err := (&hostPortValue{g.v}).Set(s)
+	if err != nil {
+		return err
+	}
+	g.v.Scheme = scheme
+	return nil
+}
+
+func (g *graylogAddressValue) String() string {
+	if g.v.Scheme == "" {
+		return g.v.Host
+	}
+	return g.v.Scheme + "://" + g.v.Host
+}
+
+//可以重复配置的token密钥，命令行和环境变量的格式为kid=k1,alg=HS256,secret=...；
+//命令行或者环境变量中配置了密钥时替换配置文件中的所有密钥
+type tokenKeysValue struct {
+	v        *[]config.TokenKeyConfig
+	fromFile bool
+}
+
+func (t *tokenKeysValue) add(key config.TokenKeyConfig) {
+	if t.fromFile {
+		*t.v = nil
+		t.fromFile = false
+	}
+	*t.v = append(*t.v, key)
+}
+
+func (t *tokenKeysValue) Set(s string) error {
+	key := config.TokenKeyConfig{}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s is not key=value", field)
+		}
+		switch kv[0] {
+		case "kid":
+			key.Kid = kv[1]
+		case "alg":
+			key.Alg = kv[1]
+		case "secret":
+			key.Secret = kv[1]
+		case "private_key_file":
+			key.PrivateKeyFile = kv[1]
+		case "public_key_file":
+			key.PublicKeyFile = kv[1]
+		default:
+			return fmt.Errorf("unknown field %s", kv[0])
+		}
+	}
+	t.add(key)
+	return nil
+}
+
+func (t *tokenKeysValue) String() string {
+	kids := make([]string, 0, len(*t.v))
+	for _, key := range *t.v {
+		kids = append(kids, key.Kid)
+	}
+	return strings.Join(kids, ",")
+}
+
+func (t *tokenKeysValue) IsCumulative() bool { return true }
+
+//一个配置项，name同时是命令行参数名和配置文件中的key，环境变量名为CHAT_加上大写的name，.和-替换为_
+type setting struct {
+	name  string
+	help  string
+	value kingpin.Value
+}
+
+func settingEnvar(name string) string {
+	return settingEnvarPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+var (
+	tokenKeysSetting = &tokenKeysValue{v: &TokenKeys}
+	settings         = []*setting{
+		{"log.stdout", "输出日志到标准输出", &boolValue{&LogToStdout}},
+		{"log.development", "开发模式日志", &boolValue{&LogDevelopment}},
+		{"log.graylog", "输出日志到graylog", &boolValue{&LogToGraylog}},
+		{"log.stdout-level", "标准输出的日志级别", &levelValue{&LogLevelStdout}},
+		{"log.graylog-level", "graylog的日志级别", &levelValue{&LogLevelGraylog}},
+		{"log.graylog-address", "graylog gelf地址，udp://host:port、tcp://host:port、tls://host:port、http://host:port或者https://host:port，没有协议时使用udp", &graylogAddressValue{LogToGraylogAddress}},
+		{"log.graylog-tls-ca", "tls、https协议时校验graylog证书的ca文件，为空时使用系统根证书", &stringValue{&LogGraylogTLSCA}},
+		{"log.graylog-tls-insecure", "tls、https协议时不校验graylog证书", &boolValue{&LogGraylogTLSInsecure}},
+		{"log.graylog-compression", "udp协议时日志的压缩方式，zlib、gzip或者none", &stringValue{&LogGraylogCompression}},
+		{"log.graylog-batch-size", "http、https协议时一次请求最多发送的日志数，默认1，大于1时graylog input需要开启bulk receiving", &intValue{&LogGraylogBatchSize}},
+		{"log.graylog-queue-size", "等待发送到graylog的日志队列长度", &intValue{&LogGraylogQueueSize}},
+		{"log.graylog-drop-policy", "graylog日志队列满时的处理方式，oldest丢弃最早的日志，newest丢弃新的日志，block等待", &stringValue{&LogGraylogDropPolicy}},
+		{"log.graylog-resolve-interval", "重新解析graylog地址的间隔，例如5m", &durationValue{&LogGraylogResolveInterval}},
+		{"log.redact-field", "日志中需要屏蔽的字段名，可以重复，追加在默认的pwd、token、authorization、pnumber等字段之后", &stringsValue{v: &LogRedactFields}},
+		{"log.redact-pattern", "日志消息和字段值中需要屏蔽的正则表达式，可以重复，追加在默认的Bearer token、jwt和手机号之后", &stringsValue{v: &LogRedactPatterns}},
+		{"server.listen-address", "http服务监听地址，host:port", &hostPortValue{ServerListenAddress}},
+		{"server.shutdown-timeout", "收到SIGTERM/SIGINT后等待请求和websocket连接结束的最长时间，例如15s", &durationValue{&ShutdownTimeout}},
+		{"user.image-dir", "用户图像以及朋友圈图片视频的保存目录", &stringValue{&UserImageSaveDir}},
+		{"mysql.dsn", "mysql数据源，例如user:password@tcp(127.0.0.1:3306)/im", &stringValue{&MysqlChatDataSourceName}},
+		{"redis.address", "redis地址，host:port", &hostPortValue{RedisServerAddress}},
+		{"redis.password", "redis密码", &stringValue{&RedisServerPwd}},
+		{"redis.db", "redis db", &intValue{&RedisSelectDB}},
+		{"token.key", "token签名密钥，可以重复，格式kid=k1,alg=HS256,secret=...或者kid=k2,alg=RS256,private_key_file=...", tokenKeysSetting},
+		{"token.signing-kid", "签发新token使用的密钥kid", &stringValue{&TokenSigningKid}},
+		{"tracing.otlp-endpoint", "otlp http collector地址，host:port，例如127.0.0.1:4318；为空时不导出span", &hostPortValue{TracingOtlpEndpoint}},
+		{"tracing.otlp-insecure", "使用http而不是https连接collector", &boolValue{&TracingOtlpInsecure}},
+		{"tracing.sample-ratio", "请求没有携带traceparent时的采样比例，0到1", &floatValue{&TracingSampleRatio}},
+	}
+)
+
+func findSetting(name string) *setting {
+	for _, s := range settings {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+//在kingpin解析之前找到配置文件路径，配置文件中的值作为命令行和环境变量之外的默认值
+func scanConfigFile(args []string) string {
+	flag := "--" + settingConfigFile
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, flag+"=") {
+			return arg[len(flag)+1:]
+		}
+	}
+	return os.Getenv(settingEnvar(settingConfigFile))
+}
+
+//加载yaml配置文件，key为命令行参数名，例如server.listen-address: 127.0.0.1:9092
+func loadConfigFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file %s error %v", path, err)
+	}
+	values := map[string]interface{}{}
+	err = yaml.Unmarshal(content, &values)
+	if err != nil {
+		return fmt.Errorf("parse config file %s error %v", path, err)
+	}
+	for name, value := range values {
+		s := findSetting(name)
+		if s == nil {
+			return fmt.Errorf("config file %s: unknown setting %s", path, name)
+		}
+		if name == "token.key" {
+			err = loadTokenKeys(value)
+		} else if values, isList := value.([]interface{}); isList {
+			err = loadList(s, values)
+		} else if value == nil {
+			err = (&namedValue{name, s.value}).Set("")
+		} else {
+			err = (&namedValue{name, s.value}).Set(fmt.Sprint(value))
+		}
+		if err != nil {
+			return fmt.Errorf("config file %s: %v", path, err)
+		}
+	}
+	tokenKeysSetting.fromFile = len(TokenKeys) > 0
+	return nil
+}
+
+//配置文件中可以重复的配置项是一个列表，命令行或者环境变量中配置时替换整个列表
+func loadList(s *setting, values []interface{}) error {
+	list, isList := s.value.(*stringsValue)
+	if !isList {
+		return fmt.Errorf("invalid value for setting %s: must not be a list", s.name)
+	}
+	for _, value := range values {
+		err := (&namedValue{s.name, list}).Set(fmt.Sprint(value))
+		if err != nil {
+			return err
+		}
+	}
+	list.fromFile = true
+	return nil
+}
+
+//配置文件中的token.key是一个列表，每一项是kid、alg、secret、private_key_file、public_key_file组成的map
+func loadTokenKeys(value interface{}) error {
+	content, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var keys []config.TokenKeyConfig
+	err = yaml.UnmarshalStrict(content, &keys)
+	if err != nil {
+		return fmt.Errorf("invalid value for setting token.key: %v", err)
+	}
+	for _, key := range keys {
+		tokenKeysSetting.add(key)
+	}
+	return nil
+}
+
+//解析配置，优先级为命令行 > 环境变量 > 配置文件 > 默认值
+func ParseSettings(app *kingpin.Application, args []string) error {
+	app.Flag(settingConfigFile, "yaml配置文件").Envar(settingEnvar(settingConfigFile)).String()
+	for _, s := range settings {
+		app.Flag(s.name, s.help).Envar(settingEnvar(s.name)).SetValue(&namedValue{s.name, s.value})
+	}
+	if path := scanConfigFile(args); path != "" {
+		err := loadConfigFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := app.Parse(args)
+	if err != nil {
+		return err
+	}
+	return validateSettings()
+}
+
+//校验必须的配置项以及配置项之间的依赖
+func validateSettings() error {
+	if ServerListenAddress.Host == "" {
+		return fmt.Errorf("setting server.listen-address is required")
+	}
+	if ShutdownTimeout <= 0 {
+		return fmt.Errorf("invalid value %v for setting server.shutdown-timeout: must be gt 0", ShutdownTimeout)
+	}
+	if UserImageSaveDir == "" {
+		return fmt.Errorf("setting user.image-dir is required")
+	}
+	if MysqlChatDataSourceName == "" {
+		return fmt.Errorf("setting mysql.dsn is required")
+	}
+	_, err := mysql.ParseDSN(MysqlChatDataSourceName)
+	if err != nil {
+		return fmt.Errorf("invalid value for setting mysql.dsn: %v", err)
+	}
+	if RedisServerAddress.Host == "" {
+		return fmt.Errorf("setting redis.address is required")
+	}
+	if RedisSelectDB < 0 {
+		return fmt.Errorf("invalid value %d for setting redis.db: must be ge 0", RedisSelectDB)
+	}
+	if TracingSampleRatio < 0 || TracingSampleRatio > 1 {
+		return fmt.Errorf("invalid value %v for setting tracing.sample-ratio: must be between 0 and 1", TracingSampleRatio)
+	}
+	_, err = redact.New(LogRedactFields, LogRedactPatterns)
+	if err != nil {
+		return fmt.Errorf("invalid value for setting log.redact-pattern: %v", err)
+	}
+	if LogGraylogQueueSize <= 0 {
+		return fmt.Errorf("invalid value %d for setting log.graylog-queue-size: must be gt 0", LogGraylogQueueSize)
+	}
+	switch LogGraylogDropPolicy {
+	case gelf.DropOldest, gelf.DropNewest, gelf.Block:
+	default:
+		return fmt.Errorf("invalid value %s for setting log.graylog-drop-policy: must be one of oldest, newest, block", LogGraylogDropPolicy)
+	}
+	switch LogGraylogCompression {
+	case gelf.CompressionZlib, gelf.CompressionGzip, gelf.CompressionNone:
+	default:
+		return fmt.Errorf("invalid value %s for setting log.graylog-compression: must be one of zlib, gzip, none", LogGraylogCompression)
+	}
+	if LogGraylogBatchSize <= 0 {
+		return fmt.Errorf("invalid value %d for setting log.graylog-batch-size: must be gt 0", LogGraylogBatchSize)
+	}
+	if LogGraylogResolveInterval <= 0 {
+		return fmt.Errorf("invalid value %v for setting log.graylog-resolve-interval: must be gt 0", LogGraylogResolveInterval)
+	}
+	if LogToGraylog && LogToGraylogAddress.Host == "" {
+		return fmt.Errorf("setting log.graylog-address is required when log.graylog is enabled")
+	}
+	_, err = graylogTLSConfig()
+	if err != nil {
+		return fmt.Errorf("invalid value for setting log.graylog-tls-ca: %v", err)
+	}
+	return nil
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"github.com/liqifyl/chat-go/internal/log/gelf"
+	"github.com/liqifyl/chat-go/internal/log/redact"
 	"github.com/liqifyl/chat-go/internal/log/zapgray"
+	"github.com/liqifyl/chat-go/internal/metrics"
+	"io/ioutil"
 	"os"
 	"strconv"
 
@@ -11,6 +17,9 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+//graylog后台发送，退出前最多等待FlushTimeout发送完队列中的日志
+var graylogSender *gelf.Gelf
+
 func ZapConsoleCore() (core zapcore.Core) {
 
 	core = zapcore.NewNopCore()
@@ -52,13 +61,59 @@ func ZapGraylogCore() (core zapcore.Core) {
 		return
 	}
 
-	core = zapgray.ZapGrayCore(fmt.Sprintf("%s:%d", host, port), zap.NewAtomicLevelAt(lv))
+	tlsConfig, err := graylogTLSConfig()
+	if err != nil {
+		return
+	}
+	core, graylogSender = zapgray.ZapGrayCore(gelf.Config{
+		GraylogAddr:     fmt.Sprintf("%s:%d", host, port),
+		Transport:       graylogTransport(),
+		TLSConfig:       tlsConfig,
+		Compression:     LogGraylogCompression,
+		BatchSize:       LogGraylogBatchSize,
+		QueueSize:       LogGraylogQueueSize,
+		DropPolicy:      LogGraylogDropPolicy,
+		ResolveInterval: LogGraylogResolveInterval,
+	}, zap.NewAtomicLevelAt(lv))
+	metrics.RegisterGelf(graylogSender)
 	return
 }
 
+//log.graylog-address中的协议，没有协议时使用udp
+func graylogTransport() string {
+	if LogToGraylogAddress.Scheme == "" {
+		return gelf.TransportUDP
+	}
+	return LogToGraylogAddress.Scheme
+}
+
+//tls、https协议时校验graylog证书的配置，没有配置ca时使用系统根证书
+func graylogTLSConfig() (*tls.Config, error) {
+	switch graylogTransport() {
+	case gelf.TransportTLS, gelf.TransportHTTPS:
+	default:
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: LogGraylogTLSInsecure}
+	if LogGraylogTLSCA == "" {
+		return config, nil
+	}
+	content, err := ioutil.ReadFile(LogGraylogTLSCA)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificate found in %s", LogGraylogTLSCA)
+	}
+	return config, nil
+}
+
 func InitLog() {
-	cc := ZapConsoleCore()
-	gc := ZapGraylogCore()
+	//配置已经在validateSettings中校验过
+	r, _ := redact.New(LogRedactFields, LogRedactPatterns)
+	cc := redact.NewCore(ZapConsoleCore(), r)
+	gc := redact.NewCore(ZapGraylogCore(), r)
 	opts := []zap.Option{zap.AddCaller(), zap.AddStacktrace(zapcore.DPanicLevel)}
 	if LogDevelopment {
 		opts = append(opts, zap.Development())
@@ -68,5 +123,9 @@ func InitLog() {
 }
 
 func TermLog() {
+	//先关闭graylog发送，Close最多等待FlushTimeout，graylog不可用时不会阻塞退出
+	if graylogSender != nil {
+		_ = graylogSender.Close()
+	}
 	_ = zap.L().Sync()
 }
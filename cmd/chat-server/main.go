@@ -1,29 +1,75 @@
 package main
 
 import (
+	"context"
 	"github.com/liqifyl/chat-go/internal/config"
 	"github.com/liqifyl/chat-go/internal/gin"
+	"github.com/liqifyl/chat-go/internal/token"
+	"github.com/liqifyl/chat-go/internal/tracing"
 	"go.uber.org/zap"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	ServerListenAddress.Host = "127.0.0.1:9092"
-	LogToGraylogAddress.Host = "47.107.231.119:22000"
-	RedisServerAddress.Host = "localhost:6379"
-	MysqlChatDataSourceName = "root:liqifyl10051113@tcp(127.0.0.1:3306)/im"
+	kingpin.CommandLine.Version(BuildVersion)
+	err := ParseSettings(kingpin.CommandLine, os.Args[1:])
+	kingpin.FatalIfError(err, "")
 	ginConfig := config.GinServerConfig{}
 	ginConfig.TestUid = TestUid
 	ginConfig.UserImageSaveDir = UserImageSaveDir
 	ginConfig.HostName = ServerListenAddress.Hostname()
 	ginConfig.Port = ServerListenAddress.Port()
+	ginConfig.MysqlChatDataSourceName = MysqlChatDataSourceName
+	ginConfig.RedisServerAddress = RedisServerAddress.Host
+	ginConfig.RedisServerPwd = RedisServerPwd
+	ginConfig.RedisSelectDB = RedisSelectDB
+	ginConfig.TokenKeys = TokenKeys
+	ginConfig.TokenSigningKid = TokenSigningKid
+	ginConfig.ShutdownTimeout = ShutdownTimeout
+	ginConfig.BuildVersion = BuildVersion
 	InitLog()
-	if ginConfig.HostName == "" || ginConfig.Port == "" {
-		zap.L().Error("hostName or port is empty")
+	err = token.InitKeys(ginConfig.TokenKeys, ginConfig.TokenSigningKid)
+	if err != nil {
+		zap.L().Error("init token keys fail", zap.Error(err))
+		TermLog()
+		os.Exit(-1)
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		ServiceVersion: BuildVersion,
+		OtlpEndpoint:   TracingOtlpEndpoint.Host,
+		OtlpInsecure:   TracingOtlpInsecure,
+		SampleRatio:    TracingSampleRatio,
+	})
+	if err != nil {
+		zap.L().Error("init tracing fail", zap.Error(err))
+		TermLog()
+		os.Exit(-1)
+	}
+	//收到SIGTERM或者SIGINT后优雅退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	zap.L().Info("starting", zap.String("version", BuildVersion))
+	err = gin.StartGinServer(ctx, ginConfig)
+	termTracing(shutdownTracing)
+	if err != nil && err != http.ErrServerClosed {
+		zap.L().Error("gin server exited", zap.Error(err))
+		TermLog()
 		os.Exit(-1)
 	}
-	zap.L().Debug("starting")
-	gin.StartGinServer(ginConfig)
 	zap.L().Debug("exited")
 	TermLog()
 }
+
+//导出还没有发送的span
+func termTracing(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	err := shutdown(ctx)
+	if err != nil {
+		zap.L().Warn("shutdown tracing fail", zap.Error(err))
+	}
+}
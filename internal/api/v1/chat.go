@@ -0,0 +1,130 @@
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/liqifyl/chat-go/internal/cache"
+	"github.com/liqifyl/chat-go/internal/chat"
+	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+)
+
+const (
+	chatV1PeerInvalid = iota + 500
+	chatV1SeqInvalid
+	chatV1LimitInvalid
+	chatV1QueryMessagesFail
+	chatV1GidInvalid
+	chatV1QueryGroupFail
+	chatV1NotGroupMember
+)
+
+const (
+	chatQueryPeerKey  = "peer"
+	chatQueryGidKey   = "gid"
+	chatQuerySeqKey   = "seq"
+	chatQueryLimitKey = "limit"
+)
+
+var (
+	chatWsUpgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		//客户端通过Authorization头鉴权而不是cookie，不需要校验Origin
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+)
+
+type getMessagesResponse struct {
+	Conversation string         `json:"conversation"`
+	Messages     []*sql.Message `json:"messages"`
+}
+
+type ChatV1API struct {
+	Config config.GinServerConfig
+	hub    *chat.Hub
+}
+
+func NewChatV1API(config config.GinServerConfig) *ChatV1API {
+	return &ChatV1API{Config: config, hub: chat.DefaultHub}
+}
+
+//注册对外输出api，所有接口都需要认证
+func (self *ChatV1API) RegisterChatApi(auth *gin.RouterGroup) {
+	auth.GET("/v1/chat/ws", self.serveWs)
+	auth.GET("/v1/chat/query/messages", self.getMessagesAfterSeq)
+}
+
+//建立聊天websocket连接
+func (self *ChatV1API) serveWs(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("chat.ws")
+	claims := authClaims(c)
+	conn, err := chatWsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		//Upgrade失败时已经写入http错误响应
+		logger.Error("upgrade error", zap.Error(err))
+		return
+	}
+	logger.Info("connected", zap.String("device_id", claims.DeviceId))
+	self.hub.Serve(c.Request.Context(), claims.Uid, claims.DeviceId, conn)
+	logger.Info("disconnected", zap.String("device_id", claims.DeviceId))
+}
+
+//获取会话中seq之后的消息，客户端重连或新设备登录后用于同步；单聊会话使用peer参数，群聊会话使用gid参数
+func (self *ChatV1API) getMessagesAfterSeq(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("chat.get.messages")
+	claims := authClaims(c)
+	conversation := ""
+	if gidStr := c.Query(chatQueryGidKey); gidStr != "" {
+		gid, err := strconv.ParseInt(gidStr, 10, 64)
+		if err != nil || gid < 1 {
+			logger.Info("gid invalid")
+			c.JSON(http.StatusOK, fail(chatV1GidInvalid, "gid invalid"))
+			return
+		}
+		member, err := cache.GetGroupMember(c.Request.Context(), gid, claims.Uid)
+		if err != nil {
+			logger.Error("query member error", zap.Int64("gid", gid), zap.Error(err))
+			c.JSON(http.StatusOK, fail(chatV1QueryGroupFail, err.Error()))
+			return
+		}
+		if member == nil {
+			c.JSON(http.StatusOK, fail(chatV1NotGroupMember, "not group member"))
+			return
+		}
+		conversation = sql.GenerateGroupConversation(gid)
+	} else {
+		peer, err := strconv.ParseInt(c.Query(chatQueryPeerKey), 10, 64)
+		if err != nil || peer < 1 {
+			logger.Info("peer invalid")
+			c.JSON(http.StatusOK, fail(chatV1PeerInvalid, "peer invalid"))
+			return
+		}
+		conversation = sql.GenerateP2PConversation(claims.Uid, peer)
+	}
+	seq, err := strconv.ParseInt(c.DefaultQuery(chatQuerySeqKey, "0"), 10, 64)
+	if err != nil || seq < 0 {
+		logger.Info("seq invalid")
+		c.JSON(http.StatusOK, fail(chatV1SeqInvalid, "seq invalid"))
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery(chatQueryLimitKey, "0"))
+	if err != nil || limit < 0 {
+		logger.Info("limit invalid")
+		c.JSON(http.StatusOK, fail(chatV1LimitInvalid, "limit invalid"))
+		return
+	}
+	messages, err := cache.GetMessagesAfterSeq(c.Request.Context(), conversation, seq, limit)
+	if err != nil {
+		logger.Error("get messages error", zap.String("conversation", conversation), zap.Error(err))
+		c.JSON(http.StatusOK, fail(chatV1QueryMessagesFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, getMessagesResponse{Conversation: conversation, Messages: messages})
+}
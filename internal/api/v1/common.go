@@ -1,14 +1,21 @@
 package v1
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/liqifyl/chat-go/internal/cache"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
 	token2 "github.com/liqifyl/chat-go/internal/token"
-	"log"
+	"go.uber.org/zap"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type errResponse struct {
@@ -26,44 +33,183 @@ func ok() gin.H {
 	return gin.H{"err": response}
 }
 
-func exeVerifyToken(token string, testUid int64) error {
+func exeVerifyToken(ctx context.Context, token string, ip string, testUid int64) (*token2.Claims, error) {
 	if token == "" {
-		return errors.New("token is empty")
+		return nil, errors.New("token is empty")
 	}
 	if !strings.HasPrefix(token, HttpTokenPrefix) {
 		msg := fmt.Sprintf("token prefix must be %s", HttpTokenPrefix)
-		return errors.New(msg)
+		return nil, errors.New(msg)
 	}
 	realToken := token[len(HttpTokenPrefix):]
 	claims, err := token2.ParseToken(realToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if claims.Issuer != token2.TokenIssuer {
-		return errors.New("issuer invalid")
+		return nil, errors.New("issuer invalid")
+	}
+	revoked, err := cache.IsTokenRevoked(ctx, claims, ip)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("token is revoked")
 	}
 	//测试token直接返回
 	if claims.Uid == testUid {
-		return nil
+		return claims, nil
 	}
-	_, err = cache.IsExistOfUser(claims.Uid)
+	_, err = cache.IsExistOfUser(ctx, claims.Uid)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return claims, nil
 }
 
-func verifyToken(c *gin.Context, logTag string, testUid int64) bool {
+//校验token并返回token中的claims，校验失败时已经写入响应
+func verifyTokenClaims(c *gin.Context, logger *zap.Logger, testUid int64) (*token2.Claims, bool) {
 	token := c.GetHeader(HttpTokenKey)
 	if token == "" {
-		log.Printf("%stoken is empty", logTag)
+		logger.Info("token is empty")
 		c.JSON(http.StatusOK, fail(HttpTokenEmpty, "token is empty"))
-		return false
+		return nil, false
 	}
-	err := exeVerifyToken(token, testUid)
+	claims, err := exeVerifyToken(c.Request.Context(), token, c.ClientIP(), testUid)
 	if err != nil {
-		log.Printf("%scheck token err %v", logTag, err)
+		logger.Info("check token fail", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpTokenEmpty, err.Error()))
+		return nil, false
+	}
+	return claims, true
+}
+
+//认证中间件，每个请求只解析一次token，并把claims保存到gin.Context中；校验失败时不再执行后续handler
+func AuthMiddleware(testUid int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := ctxlog.From(c.Request.Context()).Named("auth")
+		claims, verified := verifyTokenClaims(c, logger, testUid)
+		if !verified {
+			c.Abort()
+			return
+		}
+		c.Set(ContextClaimsKey, claims)
+		//后续handler、cache和sql的日志都带上认证的uid
+		c.Request = c.Request.WithContext(ctxlog.With(c.Request.Context(), zap.Int64("uid", claims.Uid)))
+		c.Next()
+	}
+}
+
+//生成请求id，请求头中带有X-Request-Id时使用请求头中的id
+func requestId(c *gin.Context) string {
+	id := c.GetHeader(HttpRequestIdKey)
+	if id != "" && len(id) <= requestIdMaxLen {
+		return id
+	}
+	b := make([]byte, requestIdBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+//请求日志中间件，把带有request_id、route的logger保存到请求的ctx中，请求结束后输出状态码和耗时；
+//需要在tracing中间件之后注册，日志中才会带有trace_id
+func RequestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := requestId(c)
+		c.Header(HttpRequestIdKey, id)
+		ctx := ctxlog.With(c.Request.Context(), zap.String("request_id", id), zap.String("route", c.FullPath()))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		//认证中间件会替换c.Request，从这里取到的logger带有uid
+		logger := ctxlog.From(c.Request.Context()).Named("http")
+		fields := []zap.Field{
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.Int("status", c.Writer.Status()),
+			zap.Duration("latency", time.Since(start)),
+			zap.String("client_ip", c.ClientIP()),
+		}
+		if len(c.Errors) > 0 {
+			fields = append(fields, zap.String("errors", c.Errors.String()))
+		}
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			logger.Error("request", fields...)
+		} else {
+			logger.Info("request", fields...)
+		}
+	}
+}
+
+//获取认证中间件保存的claims，只能在认证路由组的handler中调用
+func authClaims(c *gin.Context) *token2.Claims {
+	return c.MustGet(ContextClaimsKey).(*token2.Claims)
+}
+
+//请求中携带的uid必须是认证的uid，没有携带(为0)时使用认证的uid；不一致时已经写入响应
+func authUid(c *gin.Context, logger *zap.Logger, uid int64) (int64, bool) {
+	claims := authClaims(c)
+	if uid != 0 && uid != claims.Uid {
+		logger.Info("uid is not equal authenticated uid", zap.Int64("request_uid", uid), zap.Int64("auth_uid", claims.Uid))
+		c.JSON(http.StatusOK, fail(HttpErrorUidMismatch, "uid is not equal authenticated uid"))
+		return 0, false
+	}
+	return claims.Uid, true
+}
+
+//header中携带的uid必须是认证的uid，没有携带时使用认证的uid；不一致时已经写入响应
+func authHeaderUid(c *gin.Context, logger *zap.Logger, key string) (int64, bool) {
+	uidStr := c.GetHeader(key)
+	if uidStr == "" {
+		return authUid(c, logger, 0)
+	}
+	uid, err := strconv.ParseInt(uidStr, 10, 64)
+	if err != nil || uid < 1 {
+		logger.Info("header uid is invalid", zap.String("header_uid", uidStr))
+		c.JSON(http.StatusOK, fail(HttpErrorUidMismatch, "uid is not equal authenticated uid"))
+		return 0, false
+	}
+	return authUid(c, logger, uid)
+}
+
+//校验请求是application/json并且body长度与Content-Length一致，然后将body反序列化到request；失败时已经写入响应
+func bindJsonBody(c *gin.Context, logger *zap.Logger, request interface{}) bool {
+	contentType := c.ContentType()
+	if contentType != HttpApplicationJson {
+		logger.Info("content type must application/json")
+		c.JSON(http.StatusOK, fail(HttpErrorContentTypeInvalid, "content type must application/json"))
+		return false
+	}
+	contentLenStr := c.GetHeader(HttpContentLengthKey)
+	if contentLenStr == "" {
+		logger.Info("content length is empty")
+		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
+		return false
+	}
+	contentLen, err := strconv.Atoi(contentLenStr)
+	if err != nil {
+		logger.Info("content length is invalid")
+		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is invalid"))
+		return false
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		logger.Info("read body error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
+		return false
+	}
+	if len(body) != contentLen {
+		logger.Info("content length is not equal body len", zap.Int("content_len", contentLen), zap.Int("body_len", len(body)))
+		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
+		return false
+	}
+	err = json.Unmarshal(body, request)
+	if err != nil {
+		logger.Info("unmarshal request error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return false
 	}
 	return true
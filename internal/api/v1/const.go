@@ -5,13 +5,23 @@ const (
 	HttpContentTypeKey    = "Content-Type"
 	HttpImagePng          = "image/png"
 	HttpImageJPG          = "image/jpg"
+	HttpImageJPEG         = "image/jpeg"
+	HttpVideoMp4          = "video/mp4"
+	HttpVideoQuickTime    = "video/quicktime"
 	HttpApplicationJson   = "application/json"
 	HttpResponseServerKey = "Server"
 	HttpTokenKey          = "Authorization"
 	HttpTokenPrefix       = "Bearer "
+	HttpRequestIdKey      = "X-Request-Id"
 	HttpMultipartFormData = "multipart/form-data"
 	UserIdKey             = "id"
 	UserPwdKey            = "pwd"
+	ContextClaimsKey      = "claims" //认证中间件保存在gin.Context中的token claims
+)
+
+const (
+	requestIdBytes  = 16 //生成的请求id的随机字节数
+	requestIdMaxLen = 64 //请求头中的请求id的最大长度
 )
 
 const (
@@ -22,4 +32,5 @@ const (
 	HttpErrorMarshalJsonFail
 	HttpTokenEmpty
 	HttpErrorGenerateTokenFail
+	HttpErrorUidMismatch
 )
@@ -5,8 +5,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/liqifyl/chat-go/internal/cache"
 	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
 	"github.com/liqifyl/chat-go/internal/sql"
-	"log"
+	"go.uber.org/zap"
 	"net/http"
 	"strconv"
 )
@@ -21,6 +22,15 @@ const (
 	friendV1NewNickEmpty
 	friendV1ExeUpdateFriendNickFail
 	friendV1ExeDelFriendFail
+	friendV1IdInvalid
+	friendV1ExeSendRequestFail
+	friendV1ExeAcceptRequestFail
+	friendV1ExeRejectRequestFail
+	friendV1QueryRequestsFail
+	friendV1BidInvalid
+	friendV1ExeBlockFail
+	friendV1ExeUnblockFail
+	friendV1QueryBlocksFail
 )
 
 const (
@@ -31,17 +41,32 @@ type getFriendsResponse struct {
 	Friends []*sql.Friend `json:"friends"`
 }
 
-type addFriendRequest struct {
-	Uid int64 `json:"uid"`
-	Fid int64 `json:"fid"`
+type sendFriendRequestRequest struct {
+	Fid      int64  `json:"fid"`
+	Greeting string `json:"greeting"`
 }
 
-type addFriendResponse struct {
+type sendFriendRequestResponse struct {
 	Id    int64  `json:"id"`
-	Uid   int64  `json:"uid"`
-	Fid   int64  `json:"fid"`
-	Fnick string `json:"fnick"`
-	Etime string `json:"etime"`
+	Ctime string `json:"ctime"`
+}
+
+//同意或者拒绝好友申请的请求
+type handleFriendRequestRequest struct {
+	Id int64 `json:"id"`
+}
+
+type getFriendRequestsResponse struct {
+	Requests []*sql.FriendRequest `json:"requests"`
+}
+
+//拉黑或者取消拉黑的请求
+type blockRequest struct {
+	Bid int64 `json:"bid"`
+}
+
+type getBlocksResponse struct {
+	Blocks []*sql.Block `json:"blocks"`
 }
 
 type updateFriendNickRequest struct {
@@ -73,35 +98,31 @@ func NewFriendV1API(config config.GinServerConfig) *FriendV1API {
 	return &FriendV1API{Config: config}
 }
 
-//注册对外输出api
-func (self *FriendV1API) RegisterFriendApi(gin *gin.Engine) {
-	gin.POST("/v1/friend/add", self.addFriend)
-	gin.POST("/v1/friend/update/nick", self.updateFriendNick)
-	gin.POST("/v1/friend/delete", self.deleteFriend)
-	gin.GET("/v1/friend/query/friends", self.getFriendsByUid)
+//注册对外输出api，所有接口都需要认证
+func (self *FriendV1API) RegisterFriendApi(auth *gin.RouterGroup) {
+	auth.POST("/v1/friend/request/send", self.sendFriendRequest)
+	auth.POST("/v1/friend/request/accept", self.acceptFriendRequest)
+	auth.POST("/v1/friend/request/reject", self.rejectFriendRequest)
+	auth.GET("/v1/friend/query/requests/incoming", self.getIncomingFriendRequests)
+	auth.GET("/v1/friend/query/requests/outgoing", self.getOutgoingFriendRequests)
+	auth.POST("/v1/friend/update/nick", self.updateFriendNick)
+	auth.POST("/v1/friend/delete", self.deleteFriend)
+	auth.GET("/v1/friend/query/friends", self.getFriendsByUid)
+	auth.POST("/v1/friend/block", self.blockUser)
+	auth.POST("/v1/friend/unblock", self.unblockUser)
+	auth.GET("/v1/friend/query/blocks", self.getBlocks)
 }
 
 //通过用户id获取通讯录
 func (self *FriendV1API) getFriendsByUid(c *gin.Context) {
-	logTag := "friend->get->friends->"
-	uidStr := c.GetHeader(friendHeaderUidKey)
-	if uidStr == "" {
-		log.Printf("%suid invalid", logTag)
-		c.JSON(http.StatusOK, fail(friendV1UidInvalid, "uid invalid"))
+	logger := ctxlog.From(c.Request.Context()).Named("friend.get.friends")
+	uid, matched := authHeaderUid(c, logger, friendHeaderUidKey)
+	if !matched {
 		return
 	}
-	uid, err := strconv.Atoi(uidStr)
+	friends, err := cache.GetFriendsByUid(c.Request.Context(), uid)
 	if err != nil {
-		log.Printf("%sstrconv uid error %v", logTag, err)
-		c.JSON(http.StatusOK, fail(friendV1ConvertUidFail, "uid invalid"))
-		return
-	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-	friends, err := cache.GetFriendsByUid(int64(uid))
-	if err != nil {
-		log.Printf("%sget friends error from redis or db, %v", logTag, err)
+		logger.Error("get friends error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(friendV1QueryFriendsFail, err.Error()))
 		return
 	}
@@ -109,142 +130,163 @@ func (self *FriendV1API) getFriendsByUid(c *gin.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
-//添加好友
-func (self *FriendV1API) addFriend(c *gin.Context) {
-	logTag := "friend->add->"
-	contentType := c.ContentType()
-	if contentType != HttpApplicationJson {
-		msg := "content type must application/json"
-		code := HttpErrorContentTypeInvalid
-		log.Printf("%scontent type must application/json", logTag)
-		c.JSON(http.StatusOK, fail(code, msg))
+//发送好友申请，对方同意后才会成为好友
+func (self *FriendV1API) sendFriendRequest(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend.request.send")
+	claims := authClaims(c)
+	request := &sendFriendRequestRequest{}
+	if !bindJsonBody(c, logger, request) {
 		return
 	}
-	contentLenStr := c.GetHeader("Content-Length")
-	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
-		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
+	if request.Fid <= 0 {
+		logger.Info("fid invalid")
+		c.JSON(http.StatusOK, fail(friendV1FidInvalid, "fid invalid"))
 		return
 	}
-	contentLen, err := strconv.Atoi(contentLenStr)
-	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
-		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
+	if request.Fid == claims.Uid {
+		logger.Info("uid is equal fid")
+		c.JSON(http.StatusOK, fail(friendV1UidAndFidSame, "uid is equal fid"))
 		return
 	}
-	body, err := c.GetRawData()
+	friendRequest := &sql.FriendRequest{Uid: claims.Uid, Fid: request.Fid, Greeting: request.Greeting}
+	id, err := cache.SendFriendRequest(c.Request.Context(), friendRequest)
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
-		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
+		logger.Error("exe send friend request error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendV1ExeSendRequestFail, err.Error()))
 		return
 	}
-	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len, contentLen:%d, bodyLen:%d", logTag, contentLen, len(body))
-		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
+	c.JSON(http.StatusOK, sendFriendRequestResponse{Id: id, Ctime: friendRequest.Ctime})
+}
+
+//同意好友申请，双方互相成为好友
+func (self *FriendV1API) acceptFriendRequest(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend.request.accept")
+	claims := authClaims(c)
+	request := &handleFriendRequestRequest{}
+	if !bindJsonBody(c, logger, request) {
 		return
 	}
-	request := &addFriendRequest{}
-	err = json.Unmarshal(body, &request)
-	if err != nil {
-		log.Printf("%smarshal addFriendRequest err %v", logTag, err)
-		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
+	if request.Id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendV1IdInvalid, "id invalid"))
 		return
 	}
-	if request.Uid <= 0 {
-		log.Printf("%suid invalid", logTag)
-		c.JSON(http.StatusOK, fail(friendV1UidInvalid, "uid invalid"))
+	_, err := cache.AcceptFriendRequest(c.Request.Context(), request.Id, claims.Uid)
+	if err != nil {
+		logger.Error("exe accept friend request error", zap.Int64("id", request.Id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendV1ExeAcceptRequestFail, err.Error()))
 		return
 	}
-	if request.Fid <= 0 {
-		log.Printf("%sfid invalid", logTag)
-		c.JSON(http.StatusOK, fail(friendV1FidInvalid, "fid invalid"))
+	c.JSON(http.StatusOK, ok())
+}
+
+//拒绝好友申请
+func (self *FriendV1API) rejectFriendRequest(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend.request.reject")
+	claims := authClaims(c)
+	request := &handleFriendRequestRequest{}
+	if !bindJsonBody(c, logger, request) {
 		return
 	}
-	if request.Uid == request.Fid {
-		log.Printf("%suid is equal fid", logTag)
-		c.JSON(http.StatusOK, fail(friendV1UidAndFidSame, "uid is equal fid"))
+	if request.Id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendV1IdInvalid, "id invalid"))
 		return
 	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
+	_, err := cache.RejectFriendRequest(c.Request.Context(), request.Id, claims.Uid)
+	if err != nil {
+		logger.Error("exe reject friend request error", zap.Int64("id", request.Id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendV1ExeRejectRequestFail, err.Error()))
 		return
 	}
-	friend := &sql.Friend{Fid: request.Fid, Uid: request.Uid}
-	id, err := cache.AddFriend(friend)
+	c.JSON(http.StatusOK, ok())
+}
+
+//获取收到的好友申请
+func (self *FriendV1API) getIncomingFriendRequests(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend.get.requests.incoming")
+	claims := authClaims(c)
+	requests, err := cache.GetIncomingFriendRequests(c.Request.Context(), claims.Uid)
 	if err != nil {
-		log.Printf("%sexe add friend error %v", logTag, err)
-		c.JSON(http.StatusOK, fail(friendV1ExeAddFriendFail, "exe add friend fail"))
+		logger.Error("get incoming friend requests error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendV1QueryRequestsFail, err.Error()))
 		return
 	}
-	response := addFriendResponse{Id: id, Uid: friend.Uid, Fid: friend.Fid, Fnick: friend.Fnick}
-	if friend.Etime != "" {
-		response.Etime = friend.Etime
+	c.JSON(http.StatusOK, getFriendRequestsResponse{Requests: requests})
+}
+
+//获取发出的好友申请
+func (self *FriendV1API) getOutgoingFriendRequests(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend.get.requests.outgoing")
+	claims := authClaims(c)
+	requests, err := cache.GetOutgoingFriendRequests(c.Request.Context(), claims.Uid)
+	if err != nil {
+		logger.Error("get outgoing friend requests error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendV1QueryRequestsFail, err.Error()))
+		return
 	}
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusOK, getFriendRequestsResponse{Requests: requests})
 }
 
 //更新朋友的昵称
 func (self *FriendV1API) updateFriendNick(c *gin.Context) {
-	logTag := "friend->update->friend->nick->"
+	logger := ctxlog.From(c.Request.Context()).Named("friend.update.friend.nick")
 	contentType := c.ContentType()
 	if contentType != HttpApplicationJson {
 		msg := "content type must application/json"
 		code := HttpErrorContentTypeInvalid
-		log.Printf("%scontent type must application/json", logTag)
+		logger.Info("content type must application/json")
 		c.JSON(http.StatusOK, fail(code, msg))
 		return
 	}
 	contentLenStr := c.GetHeader("Content-Length")
 	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
 		return
 	}
 	contentLen, err := strconv.Atoi(contentLenStr)
 	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
 		return
 	}
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
+		logger.Info("read body error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
 		return
 	}
 	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len, contentLen:%d, bodyLen:%d", logTag, contentLen, len(body))
+		logger.Info("content length is not equal body len", zap.Int("content_len", contentLen), zap.Int("body_len", len(body)))
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
 		return
 	}
 	request := &updateFriendNickRequest{}
 	err = json.Unmarshal(body, &request)
 	if err != nil {
-		log.Printf("%smarshal updateFriendNickRequest err %v", logTag, err)
+		logger.Error("marshal updateFriendNickRequest error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return
 	}
-	if request.Uid < 1 {
-		log.Printf("%suid is invalid", logTag)
-		c.JSON(http.StatusOK, fail(friendV1UidInvalid, "uid is invalid"))
+	uid, matched := authUid(c, logger, request.Uid)
+	if !matched {
 		return
 	}
 	if request.Fid < 1 {
-		log.Printf("%suid is invalid", logTag)
+		logger.Info("uid is invalid")
 		c.JSON(http.StatusOK, fail(friendV1FidInvalid, "uid is invalid"))
 		return
 	}
 	if request.NewNick == "" {
-		log.Printf("%snew nick is empty", logTag)
+		logger.Info("new nick is empty")
 		c.JSON(http.StatusOK, fail(friendV1NewNickEmpty, "new nick is empty"))
 		return
 	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-	friend := sql.Friend{Id: request.Id, Fid: request.Fid, Uid: request.Uid, Fnick: request.NewNick}
-	err = cache.UpdateFriendNick(&friend)
+	friend := sql.Friend{Id: request.Id, Fid: request.Fid, Uid: uid, Fnick: request.NewNick}
+	err = cache.UpdateFriendNick(c.Request.Context(), &friend)
 	if err != nil {
-		log.Printf("%sexe update nick fail %v", logTag, err)
+		logger.Error("exe update nick fail", zap.Error(err))
 		c.JSON(http.StatusOK, fail(friendV1ExeUpdateFriendNickFail, "fid or uid or id is wrong"))
 		return
 	}
@@ -258,62 +300,58 @@ func (self *FriendV1API) updateFriendNick(c *gin.Context) {
 
 //删除好友
 func (self *FriendV1API) deleteFriend(c *gin.Context) {
-	logTag := "friend->delete->friend->"
+	logger := ctxlog.From(c.Request.Context()).Named("friend.delete.friend")
 	contentType := c.ContentType()
 	if contentType != HttpApplicationJson {
 		msg := "content type must application/json"
 		code := HttpErrorContentTypeInvalid
-		log.Printf("%scontent type must application/json", logTag)
+		logger.Info("content type must application/json")
 		c.JSON(http.StatusOK, fail(code, msg))
 		return
 	}
 	contentLenStr := c.GetHeader("Content-Length")
 	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
 		return
 	}
 	contentLen, err := strconv.Atoi(contentLenStr)
 	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
 		return
 	}
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
+		logger.Info("read body error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
 		return
 	}
 	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len, contentLen:%d, bodyLen:%d", logTag, contentLen, len(body))
+		logger.Info("content length is not equal body len", zap.Int("content_len", contentLen), zap.Int("body_len", len(body)))
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
 		return
 	}
 	request := &deleteFriendRequest{}
 	err = json.Unmarshal(body, &request)
 	if err != nil {
-		log.Printf("%smarshal deleteFriendRequest err %v", logTag, err)
+		logger.Error("marshal deleteFriendRequest error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return
 	}
-	if request.Uid < 1 {
-		log.Printf("%suid is invalid", logTag)
-		c.JSON(http.StatusOK, fail(friendV1UidInvalid, "uid is invalid"))
+	uid, matched := authUid(c, logger, request.Uid)
+	if !matched {
 		return
 	}
 	if request.Fid < 1 {
-		log.Printf("%suid is invalid", logTag)
+		logger.Info("uid is invalid")
 		c.JSON(http.StatusOK, fail(friendV1FidInvalid, "uid is invalid"))
 		return
 	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-	friend := sql.Friend{Id: request.Id, Fid: request.Fid, Uid: request.Uid}
-	err = cache.DelFriend(&friend)
+	friend := sql.Friend{Id: request.Id, Fid: request.Fid, Uid: uid}
+	err = cache.DelFriend(c.Request.Context(), &friend)
 	if err != nil {
-		log.Printf("%sexe delete friend fail %v", logTag, err)
+		logger.Error("exe delete friend fail", zap.Error(err))
 		c.JSON(http.StatusOK, fail(friendV1ExeDelFriendFail, "fid or uid or id is wrong"))
 		return
 	}
@@ -322,3 +360,60 @@ func (self *FriendV1API) deleteFriend(c *gin.Context) {
 	response.Msg = ""
 	c.JSON(http.StatusOK, response)
 }
+
+//把用户加入黑名单，被拉黑的用户不能再发送好友申请和消息，也看不到自己的朋友圈
+func (self *FriendV1API) blockUser(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend.block")
+	claims := authClaims(c)
+	request := &blockRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Bid < 1 || request.Bid == claims.Uid {
+		logger.Info("bid invalid")
+		c.JSON(http.StatusOK, fail(friendV1BidInvalid, "bid invalid"))
+		return
+	}
+	err := cache.BlockUser(c.Request.Context(), claims.Uid, request.Bid)
+	if err != nil {
+		logger.Error("exe block error", zap.Int64("bid", request.Bid), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendV1ExeBlockFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//把用户移出黑名单
+func (self *FriendV1API) unblockUser(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend.unblock")
+	claims := authClaims(c)
+	request := &blockRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Bid < 1 {
+		logger.Info("bid invalid")
+		c.JSON(http.StatusOK, fail(friendV1BidInvalid, "bid invalid"))
+		return
+	}
+	err := cache.UnblockUser(c.Request.Context(), claims.Uid, request.Bid)
+	if err != nil {
+		logger.Error("exe unblock error", zap.Int64("bid", request.Bid), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendV1ExeUnblockFail, "bid is not blocked"))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//获取自己的黑名单
+func (self *FriendV1API) getBlocks(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend.get.blocks")
+	claims := authClaims(c)
+	blocks, err := cache.GetBlocksByUid(c.Request.Context(), claims.Uid)
+	if err != nil {
+		logger.Error("get blocks error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendV1QueryBlocksFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, getBlocksResponse{Blocks: blocks})
+}
@@ -1,16 +1,557 @@
 package v1
 
-import "github.com/gin-gonic/gin"
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/liqifyl/chat-go/internal/cache"
+	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"github.com/liqifyl/chat-go/internal/util"
+	"go.uber.org/zap"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
 
-//注册对出输出Api
-func RegisterFriendCircleApi(gin *gin.Engine) {
+const (
+	friendCircleV1IdInvalid = iota + 400
+	friendCircleV1LimitInvalid
+	friendCircleV1ExePublishFail
+	friendCircleV1ExeDeleteFail
+	friendCircleV1QueryTimelineFail
+	friendCircleV1ExeCommentFail
+	friendCircleV1ExeDeleteCommentFail
+	friendCircleV1QueryCommentsFail
+	friendCircleV1ExeLikeFail
+	friendCircleV1ExeUnlikeFail
+	friendCircleV1QueryLikesFail
+	friendCircleV1ExeUpdateVisibilityFail
+	friendCircleV1ParseMultipartFormFail
+	friendCircleV1MediaCountInvalid
+	friendCircleV1MediaFormatMismatch
+	friendCircleV1MediaSizeInvalid
+	friendCircleV1SaveMediaFail
+	friendCircleV1QueryMediaFail
+	friendCircleV1VisibleUidsInvalid
+)
+
+const (
+	friendCircleQueryMaxPTimeKey = "max_ptime"
+	friendCircleQueryMaxIdKey    = "max_id"
+	friendCircleQueryLimitKey    = "limit"
+	friendCircleQueryIdKey       = "id"
+	friendCircleQueryThumbKey    = "thumb"
+)
+
+const (
+	friendCircleFormTitleKey       = "title"
+	friendCircleFormUrlKey         = "url"
+	friendCircleFormVisibilityKey  = "visibility"
+	friendCircleFormVisibleUidsKey = "visible_uids"
+	friendCircleFormImageKey       = "image"
+	friendCircleFormVideoKey       = "video"
+)
+
+const (
+	friendCircleMaxImageSize = 10 << 20 //单张图片最大10M
+	friendCircleMaxVideoSize = 50 << 20 //视频最大50M
+	friendCircleThumbMaxSize = 320      //缩略图最长边
+	friendCircleThumbSuffix  = ".thumb.jpg"
+)
+
+//朋友圈支持的媒体格式以及保存时使用的扩展名
+var friendCircleImageExts = map[string]string{
+	HttpImagePng:  ".png",
+	HttpImageJPG:  ".jpg",
+	HttpImageJPEG: ".jpg",
+}
+
+var friendCircleVideoExts = map[string]string{
+	HttpVideoMp4:       ".mp4",
+	HttpVideoQuickTime: ".mov",
+}
+
+type publishFriendCircleRequest struct {
+	Title       string  `json:"title"`
+	Url         string  `json:"url"`
+	Visibility  uint8   `json:"visibility"`
+	VisibleUids []int64 `json:"visible_uids"`
+}
+
+type publishFriendCircleResponse struct {
+	Id    int64                    `json:"id"`
+	Ptime string                   `json:"ptime"`
+	Media []*sql.FriendCircleMedia `json:"media,omitempty"`
+}
+
+//删除、点赞、取消点赞朋友圈以及删除评论的请求
+type deleteFriendCircleRequest struct {
+	Id int64 `json:"id"`
+}
+
+type updateVisibilityRequest struct {
+	Id          int64   `json:"id"`
+	Visibility  uint8   `json:"visibility"`
+	VisibleUids []int64 `json:"visible_uids"`
+}
+
+type commentFriendCircleRequest struct {
+	Id      int64  `json:"id"`
+	Content string `json:"content"`
+}
+
+type commentFriendCircleResponse struct {
+	Id    int64  `json:"id"`
+	Ctime string `json:"ctime"`
+}
+
+type getCommentsResponse struct {
+	Comments []*sql.FriendCircleComment `json:"comments"`
+}
+
+type getLikesResponse struct {
+	Likes []*sql.FriendCircleLike `json:"likes"`
+}
+
+type getTimelineResponse struct {
+	FriendCircles []*sql.FriendCircle `json:"friend_circles"`
+	NextMaxPTime  string              `json:"next_max_ptime"` //下一页请求使用的max_ptime，为空表示没有更多
+	NextMaxId     int64               `json:"next_max_id"`    //下一页请求使用的max_id，和max_ptime一起使用
+}
+
+type FriendCircleV1API struct {
+	Config config.GinServerConfig
+}
+
+func NewFriendCircleV1API(config config.GinServerConfig) *FriendCircleV1API {
+	return &FriendCircleV1API{Config: config}
+}
+
+//注册对外输出api，所有接口都需要认证
+func (self *FriendCircleV1API) RegisterFriendCircleApi(auth *gin.RouterGroup) {
+	auth.POST("/v1/friend_circle/publish", self.publishFriendCircle)
+	auth.POST("/v1/friend_circle/delete", self.deleteFriendCircle)
+	auth.POST("/v1/friend_circle/update/visibility", self.updateVisibility)
+	auth.GET("/v1/friend_circle/query/timeline", self.getFriendsCircleByUid)
+	auth.POST("/v1/friend_circle/comment", self.commentFriendCircle)
+	auth.POST("/v1/friend_circle/delete/comment", self.deleteComment)
+	auth.GET("/v1/friend_circle/query/comments", self.getComments)
+	auth.POST("/v1/friend_circle/like", self.likeFriendCircle)
+	auth.POST("/v1/friend_circle/unlike", self.unlikeFriendCircle)
+	auth.GET("/v1/friend_circle/query/likes", self.getLikes)
+	auth.GET("/v1/friend_circle/media/:id", self.getMedia)
+}
+
+//朋友圈媒体保存的目录，按上传者uid分目录
+func (self *FriendCircleV1API) mediaSaveDir(uid int64) string {
+	return fmt.Sprintf("%s/friend_circle/%d", self.Config.UserImageSaveDir, uid)
+}
+
+//媒体以及缩略图在磁盘上的路径
+func (self *FriendCircleV1API) mediaPaths(media []*sql.FriendCircleMedia) []string {
+	var paths []string
+	for _, m := range media {
+		saveDir := self.mediaSaveDir(m.Uid)
+		paths = append(paths, saveDir+"/"+m.Name)
+		if m.Thumb != "" {
+			paths = append(paths, saveDir+"/"+m.Thumb)
+		}
+	}
+	return paths
+}
+
+//生成媒体的访问地址
+func (self *FriendCircleV1API) fillMediaUrl(media []*sql.FriendCircleMedia) {
+	if self.Config.HostName == "" || self.Config.Port == "" {
+		return
+	}
+	for _, m := range media {
+		m.Url = fmt.Sprintf("%s:%s/v1/friend_circle/media/%d", self.Config.HostName, self.Config.Port, m.Id)
+		if m.Thumb != "" {
+			m.ThumbUrl = m.Url + "?" + friendCircleQueryThumbKey + "=1"
+		}
+	}
 }
 
 //查看用户自己以朋友发布的朋友圈，按时间排序
-func getFriendsCircleByUid(id int64, maxDateTime string, limit int) {
-	
+func (self *FriendCircleV1API) getFriendsCircleByUid(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.get.timeline")
+	claims := authClaims(c)
+	limit, err := strconv.Atoi(c.DefaultQuery(friendCircleQueryLimitKey, "20"))
+	if err != nil || limit < 1 {
+		logger.Info("limit invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1LimitInvalid, "limit invalid"))
+		return
+	}
+	//超过数据库一次最多查询的条数时按最大值查询，缓存和是否有下一页都按该值判断
+	limit = clampTimelineLimit(limit)
+	maxPublishTime := c.Query(friendCircleQueryMaxPTimeKey)
+	maxId, err := strconv.ParseInt(c.DefaultQuery(friendCircleQueryMaxIdKey, "0"), 10, 64)
+	if err != nil || maxId < 0 {
+		logger.Info("max id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "max id invalid"))
+		return
+	}
+	friendCircles, err := cache.GetFriendCircleByUid(c.Request.Context(), claims.Uid, maxPublishTime, maxId, limit)
+	if err != nil {
+		logger.Error("get timeline error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1QueryTimelineFail, err.Error()))
+		return
+	}
+	for _, friendCircle := range friendCircles {
+		self.fillMediaUrl(friendCircle.Media)
+	}
+	c.JSON(http.StatusOK, newTimelineResponse(friendCircles, limit))
+}
+
+func clampTimelineLimit(limit int) int {
+	if limit > sql.FriendCircleMaxLimit {
+		return sql.FriendCircleMaxLimit
+	}
+	return limit
+}
+
+//返回的条数等于limit时可能还有下一页，用最后一条的(ptime, id)作为下一页的游标
+func newTimelineResponse(friendCircles []*sql.FriendCircle, limit int) getTimelineResponse {
+	response := getTimelineResponse{FriendCircles: friendCircles}
+	if len(friendCircles) > 0 && len(friendCircles) == limit {
+		response.NextMaxPTime = friendCircles[len(friendCircles)-1].Ptime
+		response.NextMaxId = friendCircles[len(friendCircles)-1].Id
+	}
+	return response
+}
+
+//用户发布朋友圈，application/json只能发布标题和链接，multipart/form-data可以同时上传最多9张图片和1个视频
+func (self *FriendCircleV1API) publishFriendCircle(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.publish")
+	claims := authClaims(c)
+	request := &publishFriendCircleRequest{}
+	var media []*sql.FriendCircleMedia
+	if strings.HasPrefix(c.ContentType(), HttpMultipartFormData) {
+		var bound bool
+		media, bound = self.bindPublishMultipart(c, logger, claims.Uid, request)
+		if !bound {
+			return
+		}
+	} else if !bindJsonBody(c, logger, request) {
+		return
+	}
+	friendCircle := &sql.FriendCircle{Uid: claims.Uid, Title: request.Title, Url: request.Url, Visibility: request.Visibility, VisibleUids: request.VisibleUids, Media: media}
+	id, err := cache.PublishFriendCircle(c.Request.Context(), friendCircle)
+	if err != nil {
+		logger.Error("exe publish error", zap.Error(err))
+		util.RemoveFiles(self.mediaPaths(media)...)
+		c.JSON(http.StatusOK, fail(friendCircleV1ExePublishFail, err.Error()))
+		return
+	}
+	self.fillMediaUrl(media)
+	c.JSON(http.StatusOK, publishFriendCircleResponse{Id: id, Ptime: friendCircle.Ptime, Media: media})
+}
+
+//解析multipart/form-data格式的发布请求，并把图片和视频保存到磁盘，图片同时生成缩略图
+func (self *FriendCircleV1API) bindPublishMultipart(c *gin.Context, logger *zap.Logger, uid int64, request *publishFriendCircleRequest) ([]*sql.FriendCircleMedia, bool) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		logger.Info("parse multipart form error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1ParseMultipartFormFail, err.Error()))
+		return nil, false
+	}
+	request.Title = c.PostForm(friendCircleFormTitleKey)
+	request.Url = c.PostForm(friendCircleFormUrlKey)
+	if visibilityStr := c.PostForm(friendCircleFormVisibilityKey); visibilityStr != "" {
+		visibility, err := strconv.ParseUint(visibilityStr, 10, 8)
+		if err != nil {
+			logger.Error("convert visibility error", zap.Error(err))
+			c.JSON(http.StatusOK, fail(friendCircleV1VisibleUidsInvalid, "visibility invalid"))
+			return nil, false
+		}
+		request.Visibility = uint8(visibility)
+	}
+	for _, uidStr := range c.PostFormArray(friendCircleFormVisibleUidsKey) {
+		visibleUid, err := strconv.ParseInt(uidStr, 10, 64)
+		if err != nil {
+			logger.Error("convert visible uid error", zap.Error(err))
+			c.JSON(http.StatusOK, fail(friendCircleV1VisibleUidsInvalid, "visible uids invalid"))
+			return nil, false
+		}
+		request.VisibleUids = append(request.VisibleUids, visibleUid)
+	}
+	imageFiles := form.File[friendCircleFormImageKey]
+	videoFiles := form.File[friendCircleFormVideoKey]
+	if len(imageFiles) > sql.FriendCircleMaxImageCount || len(videoFiles) > sql.FriendCircleMaxVideoCount {
+		logger.Info("media count invalid", zap.Int("image_files", len(imageFiles)), zap.Int("video_files", len(videoFiles)))
+		c.JSON(http.StatusOK, fail(friendCircleV1MediaCountInvalid, "image count must be in [0,9] and video count must be in [0,1]"))
+		return nil, false
+	}
+	var media []*sql.FriendCircleMedia
+	for _, imageFile := range imageFiles {
+		m, verified := self.saveMedia(c, logger, uid, imageFile, sql.FriendCircleMediaImage, len(media))
+		if !verified {
+			util.RemoveFiles(self.mediaPaths(media)...)
+			return nil, false
+		}
+		media = append(media, m)
+	}
+	for _, videoFile := range videoFiles {
+		m, verified := self.saveMedia(c, logger, uid, videoFile, sql.FriendCircleMediaVideo, len(media))
+		if !verified {
+			util.RemoveFiles(self.mediaPaths(media)...)
+			return nil, false
+		}
+		media = append(media, m)
+	}
+	return media, true
+}
+
+//校验并保存一个媒体文件，文件名使用发布时间加序号
+func (self *FriendCircleV1API) saveMedia(c *gin.Context, logger *zap.Logger, uid int64, httpFile *multipart.FileHeader, mtype uint8, idx int) (*sql.FriendCircleMedia, bool) {
+	mime := httpFile.Header.Get(HttpContentTypeKey)
+	exts := friendCircleImageExts
+	maxSize := int64(friendCircleMaxImageSize)
+	if mtype == sql.FriendCircleMediaVideo {
+		exts = friendCircleVideoExts
+		maxSize = friendCircleMaxVideoSize
+	}
+	ext, supported := exts[mime]
+	if !supported {
+		logger.Info("media format is not supported", zap.String("mime", mime))
+		c.JSON(http.StatusOK, fail(friendCircleV1MediaFormatMismatch, "media format "+mime+" is not supported"))
+		return nil, false
+	}
+	if httpFile.Size == 0 || httpFile.Size > maxSize {
+		logger.Info("media size invalid", zap.Int64("size", httpFile.Size))
+		c.JSON(http.StatusOK, fail(friendCircleV1MediaSizeInvalid, fmt.Sprintf("media size must be in (0,%d]", maxSize)))
+		return nil, false
+	}
+	saveDir := self.mediaSaveDir(uid)
+	m := &sql.FriendCircleMedia{Uid: uid, Mtype: mtype, Mime: mime, Size: httpFile.Size,
+		Name: fmt.Sprintf("%d-%d%s", time.Now().UnixNano(), idx, ext)}
+	err := util.SaveMultipartFile(httpFile, saveDir, m.Name)
+	if err != nil {
+		logger.Error("save media error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1SaveMediaFail, err.Error()))
+		return nil, false
+	}
+	if mtype == sql.FriendCircleMediaImage {
+		thumb := m.Name + friendCircleThumbSuffix
+		err = util.GenerateThumbnail(saveDir+"/"+m.Name, saveDir+"/"+thumb, friendCircleThumbMaxSize)
+		if err != nil {
+			logger.Error("generate thumbnail error", zap.Error(err))
+			util.RemoveFiles(saveDir + "/" + m.Name)
+			c.JSON(http.StatusOK, fail(friendCircleV1SaveMediaFail, err.Error()))
+			return nil, false
+		}
+		m.Thumb = thumb
+	}
+	return m, true
+}
+
+//用户删除自己发布的朋友圈
+func (self *FriendCircleV1API) deleteFriendCircle(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.delete")
+	claims := authClaims(c)
+	request := &deleteFriendCircleRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	media, err := cache.RemoveFriendCircle(c.Request.Context(), request.Id, claims.Uid)
+	if err != nil {
+		logger.Error("exe delete error", zap.Int64("id", request.Id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1ExeDeleteFail, "id is wrong"))
+		return
+	}
+	util.RemoveFiles(self.mediaPaths(media)...)
+	c.JSON(http.StatusOK, ok())
+}
+
+//修改自己发布的朋友圈的可见范围
+func (self *FriendCircleV1API) updateVisibility(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.update.visibility")
+	claims := authClaims(c)
+	request := &updateVisibilityRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	err := cache.UpdateFriendCircleVisibility(c.Request.Context(), request.Id, claims.Uid, request.Visibility, request.VisibleUids)
+	if err != nil {
+		logger.Error("exe update visibility error", zap.Int64("id", request.Id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1ExeUpdateVisibilityFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//评论朋友圈
+func (self *FriendCircleV1API) commentFriendCircle(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.comment")
+	claims := authClaims(c)
+	request := &commentFriendCircleRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	comment := &sql.FriendCircleComment{Fcid: request.Id, Uid: claims.Uid, Content: request.Content}
+	id, err := cache.AddFriendCircleComment(c.Request.Context(), comment)
+	if err != nil {
+		logger.Error("exe comment error", zap.Int64("id", request.Id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1ExeCommentFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, commentFriendCircleResponse{Id: id, Ctime: comment.Ctime})
+}
+
+//删除评论，id为评论id
+func (self *FriendCircleV1API) deleteComment(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.delete.comment")
+	claims := authClaims(c)
+	request := &deleteFriendCircleRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	err := cache.RemoveFriendCircleComment(c.Request.Context(), request.Id, claims.Uid)
+	if err != nil {
+		logger.Error("exe delete comment error", zap.Int64("id", request.Id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1ExeDeleteCommentFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//获取朋友圈的评论，只返回共同好友的评论
+func (self *FriendCircleV1API) getComments(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.get.comments")
+	claims := authClaims(c)
+	id, err := strconv.ParseInt(c.Query(friendCircleQueryIdKey), 10, 64)
+	if err != nil || id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	comments, err := cache.GetFriendCircleComments(c.Request.Context(), id, claims.Uid)
+	if err != nil {
+		logger.Error("get comments error", zap.Int64("id", id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1QueryCommentsFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, getCommentsResponse{Comments: comments})
+}
+
+//点赞朋友圈
+func (self *FriendCircleV1API) likeFriendCircle(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.like")
+	claims := authClaims(c)
+	request := &deleteFriendCircleRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	err := cache.LikeFriendCircle(c.Request.Context(), request.Id, claims.Uid)
+	if err != nil {
+		logger.Error("exe like error", zap.Int64("id", request.Id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1ExeLikeFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//取消点赞
+func (self *FriendCircleV1API) unlikeFriendCircle(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.unlike")
+	claims := authClaims(c)
+	request := &deleteFriendCircleRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	err := cache.UnlikeFriendCircle(c.Request.Context(), request.Id, claims.Uid)
+	if err != nil {
+		logger.Error("exe unlike error", zap.Int64("id", request.Id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1ExeUnlikeFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//获取朋友圈的点赞，只返回共同好友的点赞
+func (self *FriendCircleV1API) getLikes(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.get.likes")
+	claims := authClaims(c)
+	id, err := strconv.ParseInt(c.Query(friendCircleQueryIdKey), 10, 64)
+	if err != nil || id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	likes, err := cache.GetFriendCircleLikes(c.Request.Context(), id, claims.Uid)
+	if err != nil {
+		logger.Error("get likes error", zap.Int64("id", id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1QueryLikesFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, getLikesResponse{Likes: likes})
 }
 
-//用户发布朋友圈
-func publishFriendCircle() {
+//获取朋友圈的图片或视频，thumb=1时获取图片的缩略图；只有可以看到朋友圈的用户才能获取
+func (self *FriendCircleV1API) getMedia(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("friend_circle.get.media")
+	claims := authClaims(c)
+	id, err := strconv.ParseInt(c.Param(friendCircleQueryIdKey), 10, 64)
+	if err != nil || id < 1 {
+		logger.Info("id invalid")
+		c.JSON(http.StatusOK, fail(friendCircleV1IdInvalid, "id invalid"))
+		return
+	}
+	media, err := cache.GetFriendCircleMedia(c.Request.Context(), id, claims.Uid)
+	if err != nil {
+		logger.Error("get media error", zap.Int64("id", id), zap.Error(err))
+		c.JSON(http.StatusOK, fail(friendCircleV1QueryMediaFail, err.Error()))
+		return
+	}
+	name := media.Name
+	if c.Query(friendCircleQueryThumbKey) == "1" {
+		if media.Thumb == "" {
+			logger.Info("media has no thumbnail", zap.Int64("id", id))
+			c.JSON(http.StatusOK, fail(friendCircleV1QueryMediaFail, "media has no thumbnail"))
+			return
+		}
+		name = media.Thumb
+	}
+	path := self.mediaSaveDir(media.Uid) + "/" + name
+	if !util.FileIsExist(path) {
+		logger.Info("media file is not exist", zap.String("path", path))
+		c.JSON(http.StatusOK, fail(friendCircleV1QueryMediaFail, "media file is not exist"))
+		return
+	}
+	c.Header(HttpResponseServerKey, "com.liqi")
+	c.File(path)
 }
@@ -0,0 +1,59 @@
+package v1
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/liqifyl/chat-go/internal/sql"
+)
+
+//模拟数据库中按(ptime, id)降序的朋友圈，最多返回sql.FriendCircleMaxLimit条
+func queryTimeline(all []*sql.FriendCircle, limit int) []*sql.FriendCircle {
+	if limit > sql.FriendCircleMaxLimit {
+		limit = sql.FriendCircleMaxLimit
+	}
+	if len(all) < limit {
+		return all
+	}
+	return all[:limit]
+}
+
+func newFriendCircles(n int) []*sql.FriendCircle {
+	results := make([]*sql.FriendCircle, 0, n)
+	for i := n; i > 0; i-- {
+		results = append(results, &sql.FriendCircle{Id: int64(i), Ptime: fmt.Sprintf("2021-10-01 00:00:%02d", i%60)})
+	}
+	return results
+}
+
+func TestTimelineCursorWithLimitAboveMax(t *testing.T) {
+	all := newFriendCircles(sql.FriendCircleMaxLimit + 50)
+	for _, requested := range []int{sql.FriendCircleMaxLimit + 1, 500} {
+		limit := clampTimelineLimit(requested)
+		if limit != sql.FriendCircleMaxLimit {
+			t.Errorf("limit %d is clamped to %d", requested, limit)
+		}
+		response := newTimelineResponse(queryTimeline(all, limit), limit)
+		last := all[sql.FriendCircleMaxLimit-1]
+		if response.NextMaxPTime != last.Ptime || response.NextMaxId != last.Id {
+			t.Errorf("limit %d: next cursor is (%s, %d), want (%s, %d)", requested, response.NextMaxPTime, response.NextMaxId, last.Ptime, last.Id)
+		}
+	}
+}
+
+func TestTimelineCursorOnLastPage(t *testing.T) {
+	all := newFriendCircles(30)
+	for _, requested := range []int{20, 30, 200} {
+		limit := clampTimelineLimit(requested)
+		response := newTimelineResponse(queryTimeline(all, limit), limit)
+		//刚好取满一页时无法知道是否还有更多，也返回游标，下一页为空
+		hasMore := requested <= len(all)
+		if hasMore != (response.NextMaxPTime != "") {
+			t.Errorf("limit %d: next cursor is (%s, %d)", requested, response.NextMaxPTime, response.NextMaxId)
+		}
+	}
+	response := newTimelineResponse(nil, clampTimelineLimit(20))
+	if response.NextMaxPTime != "" || response.NextMaxId != 0 {
+		t.Errorf("empty page: next cursor is (%s, %d)", response.NextMaxPTime, response.NextMaxId)
+	}
+}
@@ -0,0 +1,253 @@
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/liqifyl/chat-go/internal/cache"
+	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+)
+
+const (
+	groupV1GidInvalid = iota + 700
+	groupV1MemberInvalid
+	groupV1ExeCreateGroupFail
+	groupV1ExeAddMembersFail
+	groupV1ExeRemoveMemberFail
+	groupV1ExeUpdateRoleFail
+	groupV1ExeUpdateInfoFail
+	groupV1QueryMembersFail
+	groupV1QueryGroupsFail
+	groupV1NotGroupMember
+)
+
+const (
+	groupQueryGidKey = "gid"
+)
+
+type createGroupRequest struct {
+	Name      string  `json:"name"`
+	Avatar    string  `json:"avatar"`
+	MaxMember int     `json:"max_member"`
+	Members   []int64 `json:"members"`
+}
+
+type createGroupResponse struct {
+	Group *sql.Group `json:"group"`
+}
+
+type addGroupMembersRequest struct {
+	Gid     int64   `json:"gid"`
+	Members []int64 `json:"members"`
+}
+
+type removeGroupMemberRequest struct {
+	Gid    int64 `json:"gid"`
+	Member int64 `json:"member"`
+}
+
+type updateGroupRoleRequest struct {
+	Gid    int64 `json:"gid"`
+	Member int64 `json:"member"`
+	Role   uint8 `json:"role"`
+}
+
+type updateGroupInfoRequest struct {
+	Gid    int64  `json:"gid"`
+	Name   string `json:"name"`
+	Avatar string `json:"avatar"`
+}
+
+type getGroupMembersResponse struct {
+	Members []*sql.GroupMember `json:"members"`
+}
+
+type getGroupsResponse struct {
+	Groups []*sql.Group `json:"groups"`
+}
+
+type GroupV1API struct {
+	Config config.GinServerConfig
+}
+
+func NewGroupV1API(config config.GinServerConfig) *GroupV1API {
+	return &GroupV1API{Config: config}
+}
+
+//注册对外输出api，所有接口都需要认证
+func (self *GroupV1API) RegisterGroupApi(auth *gin.RouterGroup) {
+	auth.POST("/v1/group/create", self.createGroup)
+	auth.POST("/v1/group/add/members", self.addGroupMembers)
+	auth.POST("/v1/group/delete/member", self.removeGroupMember)
+	auth.POST("/v1/group/update/role", self.updateGroupRole)
+	auth.POST("/v1/group/update/info", self.updateGroupInfo)
+	auth.GET("/v1/group/query/members", self.getGroupMembers)
+	auth.GET("/v1/group/query/groups", self.getGroups)
+}
+
+//从自己的好友中选择成员创建群，创建者为群主
+func (self *GroupV1API) createGroup(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("group.create")
+	claims := authClaims(c)
+	request := &createGroupRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	group := &sql.Group{Name: request.Name, Avatar: request.Avatar, Owner: claims.Uid, MaxMember: request.MaxMember}
+	_, err := cache.CreateGroup(c.Request.Context(), group, request.Members)
+	if err != nil {
+		logger.Error("exe create group error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(groupV1ExeCreateGroupFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, createGroupResponse{Group: group})
+}
+
+//群主或管理员添加成员
+func (self *GroupV1API) addGroupMembers(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("group.add.members")
+	claims := authClaims(c)
+	request := &addGroupMembersRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Gid < 1 {
+		logger.Info("gid invalid")
+		c.JSON(http.StatusOK, fail(groupV1GidInvalid, "gid invalid"))
+		return
+	}
+	if len(request.Members) == 0 {
+		logger.Info("members is empty")
+		c.JSON(http.StatusOK, fail(groupV1MemberInvalid, "members is empty"))
+		return
+	}
+	err := cache.AddGroupMembers(c.Request.Context(), claims.Uid, request.Gid, request.Members)
+	if err != nil {
+		logger.Error("exe add members error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(groupV1ExeAddMembersFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//移除成员，member为自己时表示退群
+func (self *GroupV1API) removeGroupMember(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("group.delete.member")
+	claims := authClaims(c)
+	request := &removeGroupMemberRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Gid < 1 {
+		logger.Info("gid invalid")
+		c.JSON(http.StatusOK, fail(groupV1GidInvalid, "gid invalid"))
+		return
+	}
+	if request.Member < 1 {
+		logger.Info("member invalid")
+		c.JSON(http.StatusOK, fail(groupV1MemberInvalid, "member invalid"))
+		return
+	}
+	err := cache.RemoveGroupMember(c.Request.Context(), claims.Uid, request.Gid, request.Member)
+	if err != nil {
+		logger.Error("exe remove member error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(groupV1ExeRemoveMemberFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//群主设置管理员
+func (self *GroupV1API) updateGroupRole(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("group.update.role")
+	claims := authClaims(c)
+	request := &updateGroupRoleRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Gid < 1 {
+		logger.Info("gid invalid")
+		c.JSON(http.StatusOK, fail(groupV1GidInvalid, "gid invalid"))
+		return
+	}
+	if request.Member < 1 {
+		logger.Info("member invalid")
+		c.JSON(http.StatusOK, fail(groupV1MemberInvalid, "member invalid"))
+		return
+	}
+	err := cache.UpdateGroupMemberRole(c.Request.Context(), claims.Uid, request.Gid, request.Member, request.Role)
+	if err != nil {
+		logger.Error("exe update role error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(groupV1ExeUpdateRoleFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//群主或管理员更新群名称和头像
+func (self *GroupV1API) updateGroupInfo(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("group.update.info")
+	claims := authClaims(c)
+	request := &updateGroupInfoRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Gid < 1 {
+		logger.Info("gid invalid")
+		c.JSON(http.StatusOK, fail(groupV1GidInvalid, "gid invalid"))
+		return
+	}
+	err := cache.UpdateGroupInfo(c.Request.Context(), claims.Uid, request.Gid, request.Name, request.Avatar)
+	if err != nil {
+		logger.Error("exe update info error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(groupV1ExeUpdateInfoFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
+//群成员获取所有成员
+func (self *GroupV1API) getGroupMembers(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("group.get.members")
+	claims := authClaims(c)
+	gid, err := strconv.ParseInt(c.Query(groupQueryGidKey), 10, 64)
+	if err != nil || gid < 1 {
+		logger.Info("gid invalid")
+		c.JSON(http.StatusOK, fail(groupV1GidInvalid, "gid invalid"))
+		return
+	}
+	members, err := cache.GetGroupMembers(c.Request.Context(), gid)
+	if err != nil {
+		logger.Error("get members error", zap.Int64("gid", gid), zap.Error(err))
+		c.JSON(http.StatusOK, fail(groupV1QueryMembersFail, err.Error()))
+		return
+	}
+	isMember := false
+	for _, member := range members {
+		if member.Uid == claims.Uid {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		c.JSON(http.StatusOK, fail(groupV1NotGroupMember, "not group member"))
+		return
+	}
+	c.JSON(http.StatusOK, getGroupMembersResponse{Members: members})
+}
+
+//获取自己加入的所有群
+func (self *GroupV1API) getGroups(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("group.get.groups")
+	claims := authClaims(c)
+	groups, err := cache.GetGroupsByUid(c.Request.Context(), claims.Uid)
+	if err != nil {
+		logger.Error("get groups error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(groupV1QueryGroupsFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, getGroupsResponse{Groups: groups})
+}
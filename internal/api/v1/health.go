@@ -0,0 +1,82 @@
+package v1
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/liqifyl/chat-go/internal/cache"
+	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+const (
+	healthStatusOk    = "ok"
+	healthStatusFail  = "fail"
+	healthPingTimeout = 2 * time.Second //readyz检查依赖的超时时间，需要小于探针的超时时间
+)
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"` //依赖名称到检查结果，失败时为错误信息
+}
+
+type versionResponse struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+}
+
+type HealthV1API struct {
+	Config config.GinServerConfig
+}
+
+func NewHealthV1API(config config.GinServerConfig) *HealthV1API {
+	return &HealthV1API{Config: config}
+}
+
+//注册对外输出api，探针接口不需要认证
+func (self *HealthV1API) RegisterHealthApi(gin *gin.Engine) {
+	gin.GET("/healthz", self.healthz)
+	gin.GET("/readyz", self.readyz)
+	gin.GET("/version", self.version)
+}
+
+//进程存活检查，能响应即为存活
+func (self *HealthV1API) healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, healthResponse{Status: healthStatusOk})
+}
+
+//就绪检查，mysql和redis都可以访问时才能接收流量
+func (self *HealthV1API) readyz(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("health.readyz")
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthPingTimeout)
+	defer cancel()
+	response := healthResponse{Status: healthStatusOk, Checks: map[string]string{}}
+	checks := map[string]func(context.Context) error{
+		"mysql": sql.PingDb,
+		"redis": cache.PingRedis,
+	}
+	for name, check := range checks {
+		err := check(ctx)
+		if err != nil {
+			logger.Error("ping error", zap.String("name", name), zap.Error(err))
+			response.Status = healthStatusFail
+			response.Checks[name] = err.Error()
+			continue
+		}
+		response.Checks[name] = healthStatusOk
+	}
+	if response.Status != healthStatusOk {
+		c.JSON(http.StatusServiceUnavailable, response)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+//编译时通过ldflags注入的版本号
+func (self *HealthV1API) version(c *gin.Context) {
+	c.JSON(http.StatusOK, versionResponse{Version: self.Config.BuildVersion, GoVersion: runtime.Version()})
+}
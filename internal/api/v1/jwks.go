@@ -0,0 +1,40 @@
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/token"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+const (
+	jwksV1QueryKeysFail = iota + 800
+)
+
+type JwksV1API struct {
+	Config config.GinServerConfig
+}
+
+func NewJwksV1API(config config.GinServerConfig) *JwksV1API {
+	return &JwksV1API{Config: config}
+}
+
+//注册对外输出api
+func (self *JwksV1API) RegisterJwksApi(gin *gin.Engine) {
+	gin.GET("/.well-known/jwks.json", self.getJwks)
+}
+
+//公开token签名的公钥，其他服务可以用来校验token
+func (self *JwksV1API) getJwks(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("jwks.get")
+	keySet, err := token.JWKS()
+	if err != nil {
+		logger.Error("get jwks error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(jwksV1QueryKeysFail, err.Error()))
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, keySet)
+}
@@ -3,19 +3,20 @@ package v1
 import (
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/liqifyl/chat-go/internal/cache"
+	"github.com/liqifyl/chat-go/internal/chat"
 	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
 	"github.com/liqifyl/chat-go/internal/sql"
-	"github.com/liqifyl/chat-go/internal/token"
 	"github.com/liqifyl/chat-go/internal/util"
+	"go.uber.org/zap"
 	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -42,6 +43,13 @@ const (
 	userErrNewNickInvalid
 	userErrNewSignInvalid
 	userErrNewBirthDayInvalid
+	userErrRefreshTokenInvalid
+	userErrLogoutFail
+	userErrDeviceIdInvalid
+	userErrPlatformInvalid
+	userErrQuerySessionsFail
+	userErrSidInvalid
+	userErrRevokeSessionFail
 )
 
 type registerSuccessResponse struct {
@@ -53,6 +61,30 @@ type userLoginRequest struct {
 	Pwd string `json:"pwd"`
 }
 
+const (
+	userDefaultDeviceId   = "default"
+	userMaxDeviceIdLength = 64
+	userPlatformUnknown   = "unknown"
+)
+
+//登录设备平台
+var userPlatforms = map[string]bool{"ios": true, "android": true, "web": true, "pc": true, userPlatformUnknown: true}
+
+type userDeviceLoginRequest struct {
+	userLoginRequest
+	DeviceId string `json:"device_id"` //设备id，同一个设备重复登录会替换旧的会话；为空时为default
+	Platform string `json:"platform"`  //ios、android、web、pc，为空时为unknown
+}
+
+type userSessionResponse struct {
+	*cache.Session
+	Current bool `json:"current"` //是否为当前请求使用的会话
+}
+
+type userRevokeSessionRequest struct {
+	Sid string `json:"sid"`
+}
+
 type userLoginSuccessResponse struct {
 	Id       int64  `json:"id"`
 	Nick     string `json:"nick"`
@@ -62,7 +94,11 @@ type userLoginSuccessResponse struct {
 	Sex      string `json:"sex"`
 	Country  string `json:"country"`
 	ImageUrl string `json:"image_url"`
-	Token    string `json:"token"`
+	cache.TokenPair
+}
+
+type userRefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 type userUpdatePwdRequest struct {
@@ -97,16 +133,21 @@ func NewUserV1API(config config.GinServerConfig) *UserV1API {
 	return &UserV1API{Config: config}
 }
 
-//注册所有对外输出接口
-func (self *UserV1API) RegisterUserRestfulAPI(gin *gin.Engine) {
+//注册所有对外输出接口，注册、登录和刷新token之外的接口都需要认证
+func (self *UserV1API) RegisterUserRestfulAPI(gin *gin.Engine, auth *gin.RouterGroup) {
 	gin.POST("/v1/user/register", self.register)
 	gin.POST("/v1/user/login", self.login)
-	gin.POST("/v1/user/update/pwd", self.updatePwd)
-	gin.POST("/v1/user/update/image", self.updateImage)
-	gin.POST("/v1/user/update/nick", self.updateNick)
-	gin.POST("/v1/user/update/sign", self.updateSign)
-	gin.POST("/v1/user/update/birthday", self.updateBirthDay)
-	gin.GET("/v1/user/image/:id", self.getUserImage)
+	auth.POST("/v1/user/logout", self.logout)
+	gin.POST("/v1/user/token/refresh", self.refreshToken)
+	auth.GET("/v1/user/sessions", self.getSessions)
+	auth.POST("/v1/user/session/revoke", self.revokeSession)
+	auth.POST("/v1/user/session/revoke_others", self.revokeOtherSessions)
+	auth.POST("/v1/user/update/pwd", self.updatePwd)
+	auth.POST("/v1/user/update/image", self.updateImage)
+	auth.POST("/v1/user/update/nick", self.updateNick)
+	auth.POST("/v1/user/update/sign", self.updateSign)
+	auth.POST("/v1/user/update/birthday", self.updateBirthDay)
+	auth.GET("/v1/user/image/:id", self.getUserImage)
 }
 
 func (self *UserV1API) generateUserImageUrl(id int64) string {
@@ -127,48 +168,48 @@ func (self *UserV1API) generateUserImageUrl(id int64) string {
 
 //用户注册
 func (self *UserV1API) register(c *gin.Context) {
-	logTag := "user->register->"
+	logger := ctxlog.From(c.Request.Context()).Named("user.register")
 	contentType := c.ContentType()
 	if contentType != HttpApplicationJson {
 		msg := "content type must application/json"
 		code := HttpErrorContentTypeInvalid
-		log.Printf("%scontent type must application/json", logTag)
+		logger.Info("content type must application/json")
 		c.JSON(http.StatusOK, fail(code, msg))
 		return
 	}
 	contentLenStr := c.GetHeader("Content-Length")
 	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
 		return
 	}
 	contentLen, err := strconv.Atoi(contentLenStr)
 	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
 		return
 	}
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
+		logger.Info("read body error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
 		return
 	}
 	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len, contentLen:%d, bodyLen:%d", logTag, contentLen, len(body))
+		logger.Info("content length is not equal body len", zap.Int("content_len", contentLen), zap.Int("body_len", len(body)))
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
 		return
 	}
 	user := &sql.ChatUser{}
 	err = json.Unmarshal(body, user)
 	if err != nil {
-		log.Printf("%smarshal user info err %v", logTag, err)
+		logger.Error("marshal user info error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return
 	}
-	uid, err := sql.InsertUser(user)
+	uid, err := sql.InsertUser(c.Request.Context(), user)
 	if err != nil {
-		log.Printf("%sinsert user info err %v, code:%d", logTag, err, uid)
+		logger.Error("insert user info error", zap.Error(err), zap.Int64("uid", uid))
 		c.JSON(http.StatusOK, fail(userErrSqlExeErr, err.Error()))
 		return
 	}
@@ -177,60 +218,74 @@ func (self *UserV1API) register(c *gin.Context) {
 
 //登录
 func (self *UserV1API) login(c *gin.Context) {
-	logTag := "user->login->"
+	logger := ctxlog.From(c.Request.Context()).Named("user.login")
 	contentType := c.ContentType()
 	if contentType != HttpApplicationJson {
 		msg := "content type must application/json"
-		log.Printf("%s%s", logTag, msg)
+		logger.Info(msg)
 		c.JSON(http.StatusOK, fail(HttpErrorContentTypeInvalid, msg))
 		return
 	}
 	contentLenStr := c.GetHeader("Content-Length")
 	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
 		return
 	}
 	contentLen, err := strconv.Atoi(contentLenStr)
 	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
 		return
 	}
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
+		logger.Info("read body error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
 		return
 	}
 	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len, contentLen:%d, bodyLen:%d", logTag, contentLen, len(body))
+		logger.Info("content length is not equal body len", zap.Int("content_len", contentLen), zap.Int("body_len", len(body)))
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
 		return
 	}
-	log.Printf("%s%s", logTag, string(body))
-	request := &userLoginRequest{}
+	request := &userDeviceLoginRequest{}
 	err = json.Unmarshal(body, &request)
 	if err != nil {
-		log.Printf("%smarshal user info err %v", logTag, err)
+		logger.Error("marshal user info error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return
 	}
-	log.Printf("%s(%d,%s)", logTag, request.Uid, request.Pwd)
 	if request.Uid <= 0 {
-		log.Printf("%suid invalid", logTag)
+		logger.Info("uid invalid")
 		c.JSON(http.StatusOK, fail(userErrUidInvalid, "uid invalid"))
 		return
 	}
 	if request.Pwd == "" {
-		log.Printf("%spwd is empty", logTag)
+		logger.Info("pwd is empty")
 		c.JSON(http.StatusOK, fail(userErrPwdInvalid, "pwd is empty"))
 		return
 	}
+	if request.DeviceId == "" {
+		request.DeviceId = userDefaultDeviceId
+	}
+	if len(request.DeviceId) > userMaxDeviceIdLength {
+		logger.Info("device id is too long")
+		c.JSON(http.StatusOK, fail(userErrDeviceIdInvalid, fmt.Sprintf("device_id length must be le %d", userMaxDeviceIdLength)))
+		return
+	}
+	if request.Platform == "" {
+		request.Platform = userPlatformUnknown
+	}
+	if !userPlatforms[request.Platform] {
+		logger.Info("platform is invalid", zap.String("platform", request.Platform))
+		c.JSON(http.StatusOK, fail(userErrPlatformInvalid, "platform must be ios, android, web or pc"))
+		return
+	}
 	user := &sql.ChatUser{Id: request.Uid, Password: request.Pwd}
-	code, err := cache.UserLogin(user)
+	code, err := cache.UserLogin(c.Request.Context(), user)
 	if err != nil {
-		log.Printf("%sexe login fail, (%d, %v)", logTag, code, err)
+		logger.Error("exe login fail", zap.Int("code", code), zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrLoginFail, err.Error()))
 		return
 	}
@@ -247,257 +302,285 @@ func (self *UserV1API) login(c *gin.Context) {
 	response.Nick = user.Nick
 	response.Age = user.Age
 	response.ImageUrl = self.generateUserImageUrl(request.Uid)
-	token, err := token.GenerateToken(user.Id)
+	session, replaced, err := cache.CreateSession(c.Request.Context(), user.Id, request.DeviceId, request.Platform, c.ClientIP())
 	if err != nil {
-		log.Printf("%sgenerate token fail, %v", logTag, err)
+		logger.Error("create session fail", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorGenerateTokenFail, "generate token fail"))
 		return
 	}
-	response.Token = token
+	if replaced != nil {
+		chat.DefaultHub.KickDevice(user.Id, replaced.DeviceId)
+	}
+	tokens, err := cache.IssueTokens(c.Request.Context(), user.Id, session)
+	if err != nil {
+		logger.Error("generate token fail", zap.Error(err))
+		c.JSON(http.StatusOK, fail(HttpErrorGenerateTokenFail, "generate token fail"))
+		return
+	}
+	response.TokenPair = *tokens
+	c.JSON(http.StatusOK, response)
+}
+
+//注销，当前的access token和请求中的refresh token立即失效
+func (self *UserV1API) logout(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("user.logout")
+	claims := authClaims(c)
+	request := &userRefreshTokenRequest{}
+	if c.Request.ContentLength > 0 && !bindJsonBody(c, logger, request) {
+		return
+	}
+	err := cache.RevokeToken(c.Request.Context(), claims, request.RefreshToken)
+	if err != nil {
+		logger.Error("revoke token error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(userErrLogoutFail, err.Error()))
+		return
+	}
+	chat.DefaultHub.KickDevice(claims.Uid, claims.DeviceId)
+	c.JSON(http.StatusOK, ok())
+}
+
+//使用refresh token换取新的access token和refresh token，旧的refresh token失效
+func (self *UserV1API) refreshToken(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("user.token.refresh")
+	request := &userRefreshTokenRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	tokens, err := cache.RefreshTokens(c.Request.Context(), request.RefreshToken, c.ClientIP())
+	if err != nil {
+		logger.Error("refresh token error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(userErrRefreshTokenInvalid, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+//获取当前用户所有设备上的登录会话
+func (self *UserV1API) getSessions(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("user.sessions")
+	claims := authClaims(c)
+	sessions, err := cache.GetSessions(c.Request.Context(), claims.Uid)
+	if err != nil {
+		logger.Error("query sessions error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(userErrQuerySessionsFail, err.Error()))
+		return
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActive > sessions[j].LastActive
+	})
+	response := make([]*userSessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, &userSessionResponse{session, session.Sid == claims.Sid})
+	}
 	c.JSON(http.StatusOK, response)
 }
 
+//删除一个设备上的登录会话，该设备的token立即失效并断开聊天连接
+func (self *UserV1API) revokeSession(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("user.session.revoke")
+	claims := authClaims(c)
+	request := &userRevokeSessionRequest{}
+	if !bindJsonBody(c, logger, request) {
+		return
+	}
+	if request.Sid == "" {
+		c.JSON(http.StatusOK, fail(userErrSidInvalid, "sid is empty"))
+		return
+	}
+	session, err := cache.RemoveSession(c.Request.Context(), claims.Uid, request.Sid)
+	if err != nil {
+		logger.Error("remove session error", zap.String("sid", request.Sid), zap.Error(err))
+		c.JSON(http.StatusOK, fail(userErrRevokeSessionFail, err.Error()))
+		return
+	}
+	chat.DefaultHub.KickDevice(claims.Uid, session.DeviceId)
+	c.JSON(http.StatusOK, ok())
+}
+
+//删除当前会话之外的所有登录会话
+func (self *UserV1API) revokeOtherSessions(c *gin.Context) {
+	logger := ctxlog.From(c.Request.Context()).Named("user.session.revoke_others")
+	claims := authClaims(c)
+	removed, err := cache.RemoveOtherSessions(c.Request.Context(), claims.Uid, claims.Sid)
+	for _, session := range removed {
+		chat.DefaultHub.KickDevice(claims.Uid, session.DeviceId)
+	}
+	if err != nil {
+		logger.Error("remove other sessions error", zap.Error(err))
+		c.JSON(http.StatusOK, fail(userErrRevokeSessionFail, err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ok())
+}
+
 //更新密码
 func (self *UserV1API) updatePwd(c *gin.Context) {
-	logTag := "user->updatePwd->"
+	logger := ctxlog.From(c.Request.Context()).Named("user.updatePwd")
 	contentType := c.ContentType()
 	if contentType != HttpApplicationJson {
 		msg := "content type must application/json"
-		log.Printf("%scontent type must application/json", logTag)
+		logger.Info("content type must application/json")
 		c.JSON(http.StatusOK, fail(HttpErrorContentTypeInvalid, msg))
 		return
 	}
 	contentLenStr := c.GetHeader("Content-Length")
 	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
 		return
 	}
 	contentLen, err := strconv.Atoi(contentLenStr)
 	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
 		return
 	}
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
+		logger.Info("read body error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
 		return
 	}
 	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len", logTag)
+		logger.Info("content length is not equal body len")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
 		return
 	}
 
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-
 	request := &userUpdatePwdRequest{}
 	err = json.Unmarshal(body, &request)
 	if err != nil {
-		log.Printf("%smarshal user info err %v", logTag, err)
+		logger.Error("marshal user info error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return
 	}
-	if request.Uid <= 0 {
-		log.Printf("%suid invalid", logTag)
-		c.JSON(http.StatusOK, fail(userErrUidInvalid, "uid is le 0"))
+	uid, matched := authUid(c, logger, request.Uid)
+	if !matched {
 		return
 	}
 
-	user := &sql.ChatUser{Id: request.Uid, Password: request.Pwd}
-	code, err := cache.UpdateUserPwd(user, request.NewPwd)
+	user := &sql.ChatUser{Id: uid, Password: request.Pwd}
+	code, err := cache.UpdateUserPwd(c.Request.Context(), user, request.NewPwd)
 	if err != nil {
-		log.Printf("%supdate user pwd failed, (%d, %v)", logTag, code, err)
+		logger.Error("update user pwd failed", zap.Int("code", code), zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrUpdatePwdFail, err.Error()))
 		return
 	}
+	//修改密码后所有会话失效，断开所有设备的聊天连接
+	chat.DefaultHub.KickUser(user.Id)
 	c.JSON(http.StatusOK, ok())
 }
 
 func (self *UserV1API) saveImageToDisk(httpFile *multipart.FileHeader, id string) error {
 	imageSaveDir := self.Config.UserImageSaveDir + "/image/" + id
-	saveDirInfo, err := os.Stat(imageSaveDir)
-	if err != nil {
-		//不存在
-		err := os.MkdirAll(imageSaveDir, os.ModePerm)
-		if err != nil {
-			return err
-		}
-	} else {
-		//存在
-		if !saveDirInfo.IsDir() {
-			return errors.New("save path is directory")
-		}
-	}
-	//创建文件
-	saveFilePath := imageSaveDir + "/" + id + ".png"
-	saveFileTmpPath := saveFilePath + ".tmp"
-	saveFileTmp, err := os.Create(saveFileTmpPath)
-	if err != nil {
-		return err
-	} else {
-		defer saveFileTmp.Close()
-		reader, err := httpFile.Open()
-		if err != nil {
-			return err
-		} else {
-			defer reader.Close()
-			contents, err := ioutil.ReadAll(reader)
-			if err != nil {
-				return err
-			}
-			if len(contents) == 0 {
-				return errors.New("upload file size is zero")
-			}
-			n, err := saveFileTmp.Write(contents)
-			if err != nil {
-				return err
-			} else {
-				log.Printf("write %d to %s", n, saveFilePath)
-			}
-		}
-	}
-	err = os.Rename(saveFileTmpPath, saveFilePath)
-	if err != nil {
-		removeErr := os.Remove(saveFileTmpPath)
-		if removeErr != nil {
-			log.Printf("remove %s error %v", saveFileTmpPath, removeErr)
-		}
-		return err
-	}
-	return nil
+	return util.SaveMultipartFile(httpFile, imageSaveDir, id+".png")
 }
 
 //更新用户图像
 func (self *UserV1API) updateImage(c *gin.Context) {
-	logTag := "user->updateImage->"
+	logger := ctxlog.From(c.Request.Context()).Named("user.updateImage")
 	contentType := c.ContentType()
 	if !strings.HasPrefix(contentType, HttpMultipartFormData) {
 		msg := "content type must be multipart/form-data"
-		log.Printf("%s%s,%s", logTag, msg, contentType)
+		logger.Info(msg, zap.String("content_type", contentType))
 		c.JSON(http.StatusOK, fail(HttpErrorContentTypeInvalid, msg))
 		return
 	}
-	userIdStr := c.GetHeader(UserIdKey)
-	if userIdStr == "" {
-		log.Printf("%suserId is empty", logTag)
-		c.JSON(http.StatusOK, fail(userErrUidInvalid, "userId is empty"))
+	userId, matched := authHeaderUid(c, logger, UserIdKey)
+	if !matched {
 		return
 	}
-	userId, err := strconv.Atoi(userIdStr)
-	if err != nil {
-		log.Printf("%sconvert uid error %v", logTag, err)
-		c.JSON(http.StatusOK, fail(userErrUidInvalid, "convert uid fail"))
-		return
-	}
-	if userId < 1 {
-		log.Printf("%suser id is le to 0", logTag)
-		c.JSON(http.StatusOK, fail(userErrUidInvalid, "user id is le to 0"))
-		return
-	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-
+	userIdStr := strconv.FormatInt(userId, 10)
 	multipartFrom, err := c.MultipartForm()
 	if err != nil {
-		log.Printf("%sParseMultipartForm error %v", logTag, err)
+		logger.Info("parse multipart form error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrParseMultipartFormFail, err.Error()))
 		return
 	}
 
 	imageFiles := multipartFrom.File["image"]
 	if len(imageFiles) == 0 {
-		log.Printf("%simage file count must greater than 0", logTag)
+		logger.Info("image file count must greater than 0")
 		c.JSON(http.StatusOK, fail(userErrImageFileLenInvalid, "image file count must greater than 0"))
 		return
 	}
 	imageFile := imageFiles[0]
 	if imageFile.Header.Get(HttpContentTypeKey) != HttpImagePng {
-		log.Printf("%simage file format must be image/png", logTag)
+		logger.Info("image file format must be image/png")
 		c.JSON(http.StatusOK, fail(userErrImageFileFormatMismatch, "image format must be image/png"))
 		return
 	}
 	if imageFile.Size == 0 {
-		log.Printf("%simage file size must be greater than 0", logTag)
+		logger.Info("image file size must be greater than 0")
 		c.JSON(http.StatusOK, fail(userErrImageFileSizeInvalid, "image file size must be greater than 0"))
 		return
 	}
 	err = self.saveImageToDisk(imageFile, userIdStr)
 	if err != nil {
-		log.Printf("%ssave image error %v", logTag, err)
+		logger.Error("save image error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrSaveImageFileFail, err.Error()))
 		return
 	}
 	//生成新的用户图像url
-	newImageUrl := self.generateUserImageUrl(int64(userId))
+	newImageUrl := self.generateUserImageUrl(userId)
 	response := userUpdateImageResponse{NewImageUrl: newImageUrl}
 	c.JSON(http.StatusOK, response)
 }
 
 //更新用户名
 func (self *UserV1API) updateNick(c *gin.Context) {
-	logTag := "user->updateNick->"
+	logger := ctxlog.From(c.Request.Context()).Named("user.updateNick")
 	contentType := c.ContentType()
 	if contentType != HttpApplicationJson {
 		msg := "content type must application/json"
-		log.Printf("%scontent type must application/json", logTag)
+		logger.Info("content type must application/json")
 		c.JSON(http.StatusOK, fail(HttpErrorContentTypeInvalid, msg))
 		return
 	}
 	contentLenStr := c.GetHeader("Content-Length")
 	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
 		return
 	}
 	contentLen, err := strconv.Atoi(contentLenStr)
 	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
 		return
 	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
+		logger.Info("read body error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
 		return
 	}
 	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len", logTag)
+		logger.Info("content length is not equal body len")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
 		return
 	}
 	request := &userUpdateNickRequest{}
 	err = json.Unmarshal(body, &request)
 	if err != nil {
-		log.Printf("%smarshal user info err %v", logTag, err)
+		logger.Error("marshal user info error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return
 	}
-	if request.Uid <= 0 {
-		log.Printf("%suid invalid", logTag)
-		c.JSON(http.StatusOK, fail(userErrUidInvalid, "uid is le 0"))
+	uid, matched := authUid(c, logger, request.Uid)
+	if !matched {
 		return
 	}
 
 	if request.NewNick == "" {
-		log.Printf("%snew nick is empty", logTag)
+		logger.Info("new nick is empty")
 		c.JSON(http.StatusOK, fail(userErrNewNickInvalid, "new nick is empty"))
 		return
 	}
-	user := &sql.ChatUser{Id: request.Uid, Password: request.Pwd}
-	code, err := cache.UpdateUserNick(user, request.NewNick)
+	user := &sql.ChatUser{Id: uid, Password: request.Pwd}
+	code, err := cache.UpdateUserNick(c.Request.Context(), user, request.NewNick)
 	if err != nil {
-		log.Printf("%supdate user name fail, (%d, %v)", logTag, code, err)
+		logger.Error("update user name fail", zap.Int("code", code), zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrUpdateNameFail, err.Error()))
 		return
 	}
@@ -506,62 +589,57 @@ func (self *UserV1API) updateNick(c *gin.Context) {
 
 //更新用户签名
 func (self *UserV1API) updateSign(c *gin.Context) {
-	logTag := "user->updateSign->"
+	logger := ctxlog.From(c.Request.Context()).Named("user.updateSign")
 	contentType := c.ContentType()
 	if contentType != HttpApplicationJson {
 		msg := "content type must application/json"
-		log.Printf("%scontent type must application/json", logTag)
+		logger.Info("content type must application/json")
 		c.JSON(http.StatusOK, fail(HttpErrorContentTypeInvalid, msg))
 		return
 	}
 	contentLenStr := c.GetHeader("Content-Length")
 	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
 		return
 	}
 	contentLen, err := strconv.Atoi(contentLenStr)
 	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
 		return
 	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
+		logger.Info("read body error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
 		return
 	}
 	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len", logTag)
+		logger.Info("content length is not equal body len")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
 		return
 	}
 	request := &userUpdateSignRequest{}
 	err = json.Unmarshal(body, &request)
 	if err != nil {
-		log.Printf("%smarshal user info err %v", logTag, err)
+		logger.Error("marshal user info error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return
 	}
-	if request.Uid <= 0 {
-		log.Printf("%suid invalid", logTag)
-		c.JSON(http.StatusOK, fail(userErrUidInvalid, "uid is le 0"))
+	uid, matched := authUid(c, logger, request.Uid)
+	if !matched {
 		return
 	}
 	if request.NewSign == "" {
-		log.Printf("%snew sign is empty", logTag)
+		logger.Info("new sign is empty")
 		c.JSON(http.StatusOK, fail(userErrNewSignInvalid, "new self sign is empty"))
 		return
 	}
-	user := &sql.ChatUser{Id: request.Uid, Password: request.Pwd}
-	code, err := cache.UpdateUserSign(user, request.NewSign)
+	user := &sql.ChatUser{Id: uid, Password: request.Pwd}
+	code, err := cache.UpdateUserSign(c.Request.Context(), user, request.NewSign)
 	if err != nil {
-		log.Printf("%supdate user self sign fail, (%d, %v)", logTag, code, err)
+		logger.Error("update user self sign fail", zap.Int("code", code), zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrUpdateSignFail, err.Error()))
 		return
 	}
@@ -570,62 +648,57 @@ func (self *UserV1API) updateSign(c *gin.Context) {
 
 //更新用户生日
 func (self *UserV1API) updateBirthDay(c *gin.Context) {
-	logTag := "user->updateBirthDay->"
+	logger := ctxlog.From(c.Request.Context()).Named("user.updateBirthDay")
 	contentType := c.ContentType()
 	if contentType != HttpApplicationJson {
 		msg := "content type must application/json"
-		log.Printf("%scontent type must application/json", logTag)
+		logger.Info("content type must application/json")
 		c.JSON(http.StatusOK, fail(HttpErrorContentTypeInvalid, msg))
 		return
 	}
 	contentLenStr := c.GetHeader("Content-Length")
 	if contentLenStr == "" {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenEmpty, "content length is empty"))
 		return
 	}
 	contentLen, err := strconv.Atoi(contentLenStr)
 	if err != nil {
-		log.Printf("%scontent length is empty", logTag)
+		logger.Info("content length is empty")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is empty"))
 		return
 	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("%sread body err %v", logTag, err)
+		logger.Info("read body error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorReadBodyFail, err.Error()))
 		return
 	}
 	if len(body) != contentLen {
-		log.Printf("%scontent length is not equal body len", logTag)
+		logger.Info("content length is not equal body len")
 		c.JSON(http.StatusOK, fail(HttpErrorContentLenInvalid, "content length is not equal body len"))
 		return
 	}
 	request := &userUpdateBirthdayRequest{}
 	err = json.Unmarshal(body, &request)
 	if err != nil {
-		log.Printf("%smarshal user info err %v", logTag, err)
+		logger.Error("marshal user info error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(HttpErrorMarshalJsonFail, err.Error()))
 		return
 	}
-	if request.Uid <= 0 {
-		log.Printf("%suid invalid", logTag)
-		c.JSON(http.StatusOK, fail(userErrUidInvalid, "uid is le 0"))
+	uid, matched := authUid(c, logger, request.Uid)
+	if !matched {
 		return
 	}
 	if request.NewBirthday == "" {
-		log.Printf("%snew birthday is empty", logTag)
+		logger.Info("new birthday is empty")
 		c.JSON(http.StatusOK, fail(userErrNewBirthDayInvalid, "new birthday is empty"))
 		return
 	}
-	user := &sql.ChatUser{Id: request.Uid, Password: request.Pwd}
-	code, err := cache.UpdateUserBirthday(user, request.NewBirthday)
+	user := &sql.ChatUser{Id: uid, Password: request.Pwd}
+	code, err := cache.UpdateUserBirthday(c.Request.Context(), user, request.NewBirthday)
 	if err != nil {
-		log.Printf("%supdate user birthday fail, (%d, %v)", logTag, code, err)
+		logger.Error("update user birthday fail", zap.Int("code", code), zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrUpdateBirthdayFail, err.Error()))
 		return
 	}
@@ -634,53 +707,49 @@ func (self *UserV1API) updateBirthDay(c *gin.Context) {
 
 //获取用户图像
 func (self *UserV1API) getUserImage(c *gin.Context) {
-	logTag := "user->getUserImage->"
+	logger := ctxlog.From(c.Request.Context()).Named("user.getUserImage")
 	id := c.Param("id")
 	if id == "" {
-		log.Printf("%suser id is empty", logTag)
+		logger.Info("user id is empty")
 		c.JSON(http.StatusOK, fail(userErrUidInvalid, "user id is empty"))
 		return
 	}
 	//查询用户是否存在
 	path := c.Query("url")
 	if path == "" {
-		log.Printf("%surl is invalid", logTag)
+		logger.Info("url is invalid")
 		c.JSON(http.StatusOK, fail(userErrImagePathInvalid, "url is invalid"))
 		return
 	}
 	decodePathBytes, err := base64.StdEncoding.DecodeString(path)
 	if err != nil {
-		log.Printf("%s%s", logTag, err.Error())
+		logger.Info("decode path error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrDecodeImagePathErr, err.Error()))
 		return
 	}
-	if !verifyToken(c, logTag, self.Config.TestUid) {
-		return
-	}
-
 	decodePath := string(decodePathBytes)
 	imageAbsPath := self.Config.UserImageSaveDir + "/image/" + id + "/" + decodePath
 	fileInfo, err := os.Stat(imageAbsPath)
 	if err != nil {
-		log.Printf("%s%s", logTag, err.Error())
+		logger.Info("decode path error", zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrStatImageErr, err.Error()))
 		return
 	}
 	if fileInfo.IsDir() {
-		log.Printf("%s%s is dir", logTag, imageAbsPath)
+		logger.Info("image path is dir", zap.String("path", imageAbsPath))
 		c.JSON(http.StatusOK, fail(userErrImageFileTypeMismatch, "image is directory"))
 		return
 	}
 	file, err := os.Open(imageAbsPath)
 	if err != nil {
-		log.Printf("%sopen %s error %v", logTag, imageAbsPath, err)
+		logger.Error("open error", zap.String("path", imageAbsPath), zap.Error(err))
 		c.JSON(http.StatusOK, fail(userErrImageFileOpenFail, err.Error()))
 		return
 	}
 	defer file.Close()
 	contents, err := ioutil.ReadAll(file)
 	if err != nil {
-		log.Printf("%sread %s error %v", logTag, imageAbsPath, err)
+		logger.Error("read error", zap.String("path", imageAbsPath), zap.Error(err))
 		return
 	}
 	c.Header(HttpContentTypeKey, HttpImagePng)
@@ -689,8 +758,8 @@ func (self *UserV1API) getUserImage(c *gin.Context) {
 	c.Status(http.StatusOK)
 	n, err := c.Writer.Write(contents)
 	if err != nil {
-		log.Printf("%sfail to write : %v", logTag, err)
+		logger.Error("write image error", zap.Error(err))
 	} else {
-		log.Printf("%swrite : %d", logTag, n)
+		logger.Debug("write image", zap.Int("size", n))
 	}
 }
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	cacheBlockPrefix = "block"
+)
+
+//被对方加入黑名单时返回的error
+var ErrBlocked = errors.New("blocked by the user")
+
+func generateBlocksCacheKeyByUid(uid int64) string {
+	return fmt.Sprintf("%s-%d-blocks", cacheBlockPrefix, uid)
+}
+
+func delBlocksFromCacheByUid(ctx context.Context, uid int64) {
+	client := getRedisClient()
+	keyId := generateBlocksCacheKeyByUid(uid)
+	_, err := client.Del(ctx, keyId).Result()
+	if err != nil {
+		ctxlog.From(ctx).Named("cache.delBlocksFromCacheByUid").Error("del error", zap.String("key", keyId), zap.Error(err))
+	}
+}
+
+//uid把bid加入黑名单，bid立即看不到uid的朋友圈
+func BlockUser(ctx context.Context, uid int64, bid int64) error {
+	_, err := getExistUserNick(ctx, ctxlog.From(ctx).Named("cache.BlockUser"), bid)
+	if err != nil {
+		return err
+	}
+	err = sql.BlockUser(ctx, uid, bid)
+	if err != nil {
+		return err
+	}
+	delBlocksFromCacheByUid(ctx, uid)
+	delTimelineFromCacheByUid(ctx, bid)
+	return nil
+}
+
+//uid把bid移出黑名单
+func UnblockUser(ctx context.Context, uid int64, bid int64) error {
+	err := sql.UnblockUser(ctx, uid, bid)
+	if err != nil {
+		return err
+	}
+	delBlocksFromCacheByUid(ctx, uid)
+	delTimelineFromCacheByUid(ctx, bid)
+	return nil
+}
+
+//获取uid的黑名单
+func GetBlocksByUid(ctx context.Context, uid int64) ([]*sql.Block, error) {
+	logger := ctxlog.From(ctx).Named("cache.GetBlocksByUid")
+	client := getRedisClient()
+	keyId := generateBlocksCacheKeyByUid(uid)
+	blocksJsonStr, err := client.Get(ctx, keyId).Result()
+	if err != nil || blocksJsonStr == "" {
+		blocks, err := sql.GetBlocksByUid(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		//保存到redis中
+		jsonBytes, saveToCacheErr := json.Marshal(blocks)
+		if saveToCacheErr != nil {
+			logger.Error("marshal blocks error", zap.Error(saveToCacheErr))
+		} else {
+			str, saveToCacheErr := client.Set(ctx, keyId, string(jsonBytes), time.Second*5).Result()
+			logger.Debug("save to redis", zap.String("key", keyId), zap.String("result", str), zap.Error(saveToCacheErr))
+		}
+		return blocks, nil
+	}
+	var blocks []*sql.Block
+	err = json.Unmarshal([]byte(blocksJsonStr), &blocks)
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+//判断uid是否把bid加入了黑名单
+func IsBlocked(ctx context.Context, uid int64, bid int64) (bool, error) {
+	blocks, err := GetBlocksByUid(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	for _, block := range blocks {
+		if block.Bid == bid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
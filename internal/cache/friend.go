@@ -1,11 +1,14 @@
 package cache
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/metrics"
 	"github.com/liqifyl/chat-go/internal/sql"
-	"log"
+	"go.uber.org/zap"
 	"time"
 )
 
@@ -20,77 +23,122 @@ func generateFriendCacheKey(id int64, suffix string) string {
 	return fmt.Sprintf("%s-%d-%s", cacheFriendPrefix, id, suffix)
 }
 
-func generateFriendCacheKeyByUid(id int64) string {
-	return generateFriendCacheKey(id, "")
+func generateFriendsCacheKeyByUid(id int64) string {
+	return generateFriendCacheKey(id, "friends")
 }
 
-func delFriendsFromCacheByUid(uid int64) {
+func delFriendsFromCacheByUid(ctx context.Context, uid int64) {
 	client := getRedisClient()
-	keyId := generateFriendCacheKeyByUid(uid)
-	_, err := client.Del(cacheRedisCtx, keyId).Result()
+	keyId := generateFriendsCacheKeyByUid(uid)
+	_, err := client.Del(ctx, keyId).Result()
 	if err != nil {
-		log.Printf("delFriendsFromCacheByUid->del %s error %v", keyId, err)
+		ctxlog.From(ctx).Named("cache.delFriendsFromCacheByUid").Error("del error", zap.String("key", keyId), zap.Error(err))
 	}
 }
 
-//添加好友
-func AddFriend(friend *sql.Friend) (int64, error) {
-	logTag := "AddFriend->"
-	nick, err := GetUserNickById(friend.Fid)
+//获取用户昵称，用户不存在时返回error
+func getExistUserNick(ctx context.Context, logger *zap.Logger, uid int64) (string, error) {
+	nick, err := GetUserNickById(ctx, uid)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
 	if nick == "" {
-		errMsg := fmt.Sprintf("%d is not exist", friend.Fid)
-		log.Printf("%s%s", logTag, errMsg)
-		return 0, errors.New(errMsg)
+		errMsg := fmt.Sprintf("%d is not exist", uid)
+		logger.Info("user is not exist", zap.Int64("uid", uid))
+		return "", errors.New(errMsg)
 	}
-	friend.Fnick = nick
-	id, err := sql.AddFriend(friend)
+	return nick, nil
+}
+
+//发送好友申请，被申请人必须存在
+func SendFriendRequest(ctx context.Context, request *sql.FriendRequest) (int64, error) {
+	_, err := getExistUserNick(ctx, ctxlog.From(ctx).Named("cache.SendFriendRequest"), request.Fid)
 	if err != nil {
 		return 0, err
 	}
-	delFriendsFromCacheByUid(friend.Uid)
-	return id, nil
+	return sql.SendFriendRequest(ctx, request)
 }
 
-//删除好友
-func DelFriend(friend *sql.Friend) error {
+//同意好友申请，双方的好友列表以及朋友圈时间线都会刷新
+func AcceptFriendRequest(ctx context.Context, id int64, fid int64) (*sql.FriendRequest, error) {
+	logger := ctxlog.From(ctx).Named("cache.AcceptFriendRequest")
+	request, err := sql.GetFriendRequestById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if request.Fid != fid {
+		return nil, errors.New("friend request is not exist")
+	}
+	uidFnick, err := getExistUserNick(ctx, logger, request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	fidFnick, err := getExistUserNick(ctx, logger, request.Uid)
+	if err != nil {
+		return nil, err
+	}
+	request, err = sql.AcceptFriendRequest(ctx, id, fid, uidFnick, fidFnick)
+	if err != nil {
+		return nil, err
+	}
+	delFriendsFromCacheByUid(ctx, request.Uid)
+	delFriendsFromCacheByUid(ctx, request.Fid)
+	delTimelineFromCacheByUid(ctx, request.Uid, request.Fid)
+	return request, nil
+}
+
+//拒绝好友申请
+func RejectFriendRequest(ctx context.Context, id int64, fid int64) (*sql.FriendRequest, error) {
+	return sql.RejectFriendRequest(ctx, id, fid)
+}
+
+//获取收到的好友申请
+func GetIncomingFriendRequests(ctx context.Context, uid int64) ([]*sql.FriendRequest, error) {
+	return sql.GetIncomingFriendRequests(ctx, uid)
+}
+
+//获取发出的好友申请
+func GetOutgoingFriendRequests(ctx context.Context, uid int64) ([]*sql.FriendRequest, error) {
+	return sql.GetOutgoingFriendRequests(ctx, uid)
+}
+
+//删除好友，双方的好友关系都会删除
+func DelFriend(ctx context.Context, friend *sql.Friend) error {
 	_ = "DelFriend->"
 	if friend.Id > 0 {
-		err := sql.DeleteFriendById(friend.Id)
+		deleted, err := sql.DeleteFriendById(ctx, friend.Id, friend.Uid)
 		if err == nil {
-			if friend.Uid > 0 {
-				delFriendsFromCacheByUid(friend.Uid)
-			}
+			delFriendsFromCacheByUid(ctx, deleted.Uid)
+			delFriendsFromCacheByUid(ctx, deleted.Fid)
+			delTimelineFromCacheByUid(ctx, deleted.Uid, deleted.Fid)
 			return nil
 		}
 	}
-	err := sql.DeleteFriend(friend)
+	err := sql.DeleteFriend(ctx, friend)
 	if err != nil {
 		return err
 	}
-	delFriendsFromCacheByUid(friend.Uid)
+	delFriendsFromCacheByUid(ctx, friend.Uid)
+	delFriendsFromCacheByUid(ctx, friend.Fid)
+	delTimelineFromCacheByUid(ctx, friend.Uid, friend.Fid)
 	return nil
 }
 
 //更新好友昵称
-func UpdateFriendNick(friend *sql.Friend) error {
+func UpdateFriendNick(ctx context.Context, friend *sql.Friend) error {
 	_ = "UpdateFriendNick->"
 	if friend.Id >= 1 {
-		err := sql.UpdateFriendNickBy(friend.Id, friend.Fnick)
+		err := sql.UpdateFriendNickBy(ctx, friend.Id, friend.Uid, friend.Fnick)
 		if err == nil {
-			if friend.Uid > 0 {
-				delFriendsFromCacheByUid(friend.Uid)
-			}
+			delFriendsFromCacheByUid(ctx, friend.Uid)
 			return nil
 		}
 	}
-	err := sql.UpdateFriendNick(friend)
+	err := sql.UpdateFriendNick(ctx, friend)
 	if err != nil {
 		return err
 	}
-	delFriendsFromCacheByUid(friend.Uid)
+	delFriendsFromCacheByUid(ctx, friend.Uid)
 	return nil
 }
 
@@ -105,31 +153,33 @@ func marshalFriends(friends []*sql.Friend) (string, error) {
 }
 
 //获取用户所有好友
-func GetFriendsByUid(uid int64) ([]*sql.Friend, error) {
-	logTag := "GetFriends->"
+func GetFriendsByUid(ctx context.Context, uid int64) ([]*sql.Friend, error) {
+	logger := ctxlog.From(ctx).Named("cache.GetFriends")
 	client := getRedisClient()
-	keyId := generateFriendCacheKey(uid, "friends")
-	friendsJsonStr, err := client.Get(cacheRedisCtx, keyId).Result()
+	keyId := generateFriendsCacheKeyByUid(uid)
+	friendsJsonStr, err := client.Get(ctx, keyId).Result()
 	if err != nil || friendsJsonStr == "" {
 		if err != nil {
-			log.Printf("%sget friends from cache error %v", logTag, err)
+			logger.Debug("get friends from cache error", zap.Error(err))
 		} else {
-			log.Printf("%sfriends is empty from cache", logTag)
+			logger.Debug("friends is empty from cache")
 		}
-		friends, err := sql.GetFriendsByUid(uid)
+		metrics.ObserveCache(cacheMetricsFriends, metrics.CacheResultMiss)
+		friends, err := sql.GetFriendsByUid(ctx, uid)
 		if err != nil {
 			return nil, err
 		}
 		//保存到redis中
 		friendsJsonStr, saveToCacheErr := marshalFriends(friends)
 		if saveToCacheErr != nil {
-			log.Printf("%smarshal friends error %v", logTag, saveToCacheErr)
+			logger.Error("marshal friends error", zap.Error(saveToCacheErr))
 		} else {
-			str, saveToCacheErr := client.Set(cacheRedisCtx, keyId, friendsJsonStr, time.Second*5).Result()
-			log.Printf("%sexe save %s to redis result(%s,%v)", logTag, keyId, str, saveToCacheErr)
+			str, saveToCacheErr := client.Set(ctx, keyId, friendsJsonStr, time.Second*5).Result()
+			logger.Debug("save to redis", zap.String("key", keyId), zap.String("result", str), zap.Error(saveToCacheErr))
 		}
 		return friends, err
 	}
+	metrics.ObserveCache(cacheMetricsFriends, metrics.CacheResultHit)
 	var friends []*sql.Friend
 	err = json.Unmarshal([]byte(friendsJsonStr), &friends)
 	if err != nil {
@@ -137,3 +187,17 @@ func GetFriendsByUid(uid int64) ([]*sql.Friend, error) {
 	}
 	return friends, nil
 }
+
+//判断fid是否是uid的好友
+func IsFriend(ctx context.Context, uid int64, fid int64) (bool, error) {
+	friends, err := GetFriendsByUid(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	for _, friend := range friends {
+		if friend.Fid == fid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
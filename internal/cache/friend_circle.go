@@ -0,0 +1,317 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	cacheFriendCirclePrefix = "friend_circle"
+)
+
+func generateFriendCircleCacheKey(id int64, suffix string) string {
+	if suffix == "" {
+		return fmt.Sprintf("%s-%d", cacheFriendCirclePrefix, id)
+	}
+	return fmt.Sprintf("%s-%d-%s", cacheFriendCirclePrefix, id, suffix)
+}
+
+//用户朋友圈时间线的缓存，hash中每个field对应一页
+func generateTimelineCacheKeyByUid(uid int64) string {
+	return generateFriendCircleCacheKey(uid, "timeline")
+}
+
+func generateTimelineCacheField(maxPublishTime string, maxId int64, limit int) string {
+	return fmt.Sprintf("%s-%d-%d", maxPublishTime, maxId, limit)
+}
+
+//朋友圈评论的缓存，评论对不同查看者可见范围不同，hash中每个field对应一个查看者
+func generateCommentsCacheKeyByFcid(fcid int64) string {
+	return generateFriendCircleCacheKey(fcid, "comments")
+}
+
+//朋友圈点赞的缓存，hash中每个field对应一个查看者
+func generateLikesCacheKeyByFcid(fcid int64) string {
+	return generateFriendCircleCacheKey(fcid, "likes")
+}
+
+func delFriendCircleKeysFromCache(ctx context.Context, logger *zap.Logger, keyIds ...string) {
+	client := getRedisClient()
+	_, err := client.Del(ctx, keyIds...).Result()
+	if err != nil {
+		logger.Error("del error", zap.Strings("keys", keyIds), zap.Error(err))
+	}
+}
+
+func delTimelineFromCacheByUid(ctx context.Context, uids ...int64) {
+	keyIds := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		keyIds = append(keyIds, generateTimelineCacheKeyByUid(uid))
+	}
+	delFriendCircleKeysFromCache(ctx, ctxlog.From(ctx).Named("cache.delTimelineFromCacheByUid"), keyIds...)
+}
+
+//删除uid以及uid所有好友的时间线缓存，朋友圈被删除或者可见范围变化后好友立即生效
+func delFriendsTimelineFromCacheByUid(ctx context.Context, uid int64) {
+	uids := []int64{uid}
+	friends, err := GetFriendsByUid(ctx, uid)
+	if err != nil {
+		ctxlog.From(ctx).Named("cache.delFriendsTimelineFromCacheByUid").Error("get friends error", zap.Int64("uid", uid), zap.Error(err))
+	}
+	for _, friend := range friends {
+		uids = append(uids, friend.Fid)
+	}
+	delTimelineFromCacheByUid(ctx, uids...)
+}
+
+//从hash缓存的field中读取json到result，不存在时调用load从数据库加载并缓存5秒
+func getJsonFromHashCache(ctx context.Context, logger *zap.Logger, keyId string, field string, result interface{}, load func() (interface{}, error)) error {
+	client := getRedisClient()
+	jsonStr, err := client.HGet(ctx, keyId, field).Result()
+	if err == nil && jsonStr != "" {
+		err = json.Unmarshal([]byte(jsonStr), result)
+		if err == nil {
+			return nil
+		}
+		logger.Error("unmarshal error", zap.String("key", keyId), zap.String("field", field), zap.Error(err))
+	} else if err != nil && err != redis.Nil {
+		logger.Debug("get from cache error", zap.String("key", keyId), zap.String("field", field), zap.Error(err))
+	}
+	value, err := load()
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, saveToCacheErr := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, keyId, field, string(jsonBytes))
+		pipe.Expire(ctx, keyId, time.Second*5)
+		return nil
+	})
+	if saveToCacheErr != nil {
+		logger.Error("save to redis error", zap.String("key", keyId), zap.String("field", field), zap.Error(saveToCacheErr))
+	}
+	return json.Unmarshal(jsonBytes, result)
+}
+
+//查看者可以看到朋友圈时返回朋友圈，否则返回error
+func verifyFriendCircleVisible(ctx context.Context, fcid int64, viewer int64) (*sql.FriendCircle, error) {
+	friendCircle, visible, err := sql.CanViewFriendCircle(ctx, fcid, viewer)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, errors.New("friend circle is not visible")
+	}
+	return friendCircle, nil
+}
+
+//发布朋友圈，可见范围中的uid必须都是发布者的好友
+func PublishFriendCircle(ctx context.Context, friendCircle *sql.FriendCircle) (int64, error) {
+	err := verifyAllFriends(ctx, friendCircle.Uid, friendCircle.VisibleUids)
+	if err != nil {
+		return 0, err
+	}
+	id, err := sql.PublishFriendCircle(ctx, friendCircle)
+	if err != nil {
+		return 0, err
+	}
+	delTimelineFromCacheByUid(ctx, friendCircle.Uid)
+	return id, nil
+}
+
+//删除自己发布的朋友圈，返回朋友圈的媒体
+func RemoveFriendCircle(ctx context.Context, id int64, uid int64) ([]*sql.FriendCircleMedia, error) {
+	media, err := sql.RemoveFriendCircleById(ctx, id, uid)
+	if err != nil {
+		return nil, err
+	}
+	delFriendsTimelineFromCacheByUid(ctx, uid)
+	delFriendCircleKeysFromCache(ctx, ctxlog.From(ctx).Named("cache.RemoveFriendCircle"), generateCommentsCacheKeyByFcid(id), generateLikesCacheKeyByFcid(id))
+	return media, nil
+}
+
+//获取查看者可以看到的朋友圈媒体
+func GetFriendCircleMedia(ctx context.Context, id int64, viewer int64) (*sql.FriendCircleMedia, error) {
+	media, err := sql.GetFriendCircleMediaById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = verifyFriendCircleVisible(ctx, media.Fcid, viewer)
+	if err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+//修改自己发布的朋友圈的可见范围，可见范围中的uid必须都是发布者的好友
+func UpdateFriendCircleVisibility(ctx context.Context, id int64, uid int64, visibility uint8, visibleUids []int64) error {
+	err := verifyAllFriends(ctx, uid, visibleUids)
+	if err != nil {
+		return err
+	}
+	err = sql.UpdateFriendCircleVisibility(ctx, id, uid, visibility, visibleUids)
+	if err != nil {
+		return err
+	}
+	delFriendsTimelineFromCacheByUid(ctx, uid)
+	delFriendCircleKeysFromCache(ctx, ctxlog.From(ctx).Named("cache.UpdateFriendCircleVisibility"), generateCommentsCacheKeyByFcid(id), generateLikesCacheKeyByFcid(id))
+	return nil
+}
+
+//时间线缓存中的媒体，保留FriendCircleMedia中不输出到api的字段，api层根据这些字段生成访问地址
+type cachedFriendCircleMedia struct {
+	*sql.FriendCircleMedia
+	Uid   int64  `json:"uid"`
+	Name  string `json:"name"`
+	Thumb string `json:"thumb"`
+}
+
+//时间线缓存中的朋友圈
+type cachedFriendCircle struct {
+	*sql.FriendCircle
+	Media []*cachedFriendCircleMedia `json:"media,omitempty"`
+}
+
+func toCachedFriendCircles(friendCircles []*sql.FriendCircle) []*cachedFriendCircle {
+	results := make([]*cachedFriendCircle, 0, len(friendCircles))
+	for _, friendCircle := range friendCircles {
+		cached := &cachedFriendCircle{FriendCircle: friendCircle}
+		for _, m := range friendCircle.Media {
+			cached.Media = append(cached.Media, &cachedFriendCircleMedia{FriendCircleMedia: m, Uid: m.Uid, Name: m.Name, Thumb: m.Thumb})
+		}
+		results = append(results, cached)
+	}
+	return results
+}
+
+func fromCachedFriendCircles(cachedFriendCircles []*cachedFriendCircle) []*sql.FriendCircle {
+	results := make([]*sql.FriendCircle, 0, len(cachedFriendCircles))
+	for _, cached := range cachedFriendCircles {
+		friendCircle := cached.FriendCircle
+		friendCircle.Media = nil
+		for _, m := range cached.Media {
+			m.FriendCircleMedia.Uid, m.FriendCircleMedia.Name, m.FriendCircleMedia.Thumb = m.Uid, m.Name, m.Thumb
+			friendCircle.Media = append(friendCircle.Media, m.FriendCircleMedia)
+		}
+		results = append(results, friendCircle)
+	}
+	return results
+}
+
+//获取自己以及朋友的朋友圈，根据ptime、id降序；好友的时间线缓存在过期后才能看到新发布的朋友圈
+func GetFriendCircleByUid(ctx context.Context, uid int64, maxPublishTime string, maxId int64, limit int) ([]*sql.FriendCircle, error) {
+	keyId := generateTimelineCacheKeyByUid(uid)
+	field := generateTimelineCacheField(maxPublishTime, maxId, limit)
+	var cachedFriendCircles []*cachedFriendCircle
+	err := getJsonFromHashCache(ctx, ctxlog.From(ctx).Named("cache.GetFriendCircleByUid"), keyId, field, &cachedFriendCircles, func() (interface{}, error) {
+		friendCircles, err := sql.GetFriendCircleByUid(ctx, uid, maxPublishTime, maxId, limit)
+		if err != nil {
+			return nil, err
+		}
+		return toCachedFriendCircles(friendCircles), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fromCachedFriendCircles(cachedFriendCircles), nil
+}
+
+//评论朋友圈，只能评论自己可以看到的朋友圈
+func AddFriendCircleComment(ctx context.Context, comment *sql.FriendCircleComment) (int64, error) {
+	friendCircle, err := verifyFriendCircleVisible(ctx, comment.Fcid, comment.Uid)
+	if err != nil {
+		return 0, err
+	}
+	id, err := sql.AddFriendCircleComment(ctx, comment)
+	if err != nil {
+		return 0, err
+	}
+	delFriendCircleKeysFromCache(ctx, ctxlog.From(ctx).Named("cache.AddFriendCircleComment"), generateCommentsCacheKeyByFcid(comment.Fcid))
+	delTimelineFromCacheByUid(ctx, friendCircle.Uid, comment.Uid)
+	return id, nil
+}
+
+//删除评论，评论者和朋友圈发布者都可以删除
+func RemoveFriendCircleComment(ctx context.Context, id int64, uid int64) error {
+	friendCircle, err := sql.RemoveFriendCircleComment(ctx, id, uid)
+	if err != nil {
+		return err
+	}
+	delFriendCircleKeysFromCache(ctx, ctxlog.From(ctx).Named("cache.RemoveFriendCircleComment"), generateCommentsCacheKeyByFcid(friendCircle.Id))
+	delTimelineFromCacheByUid(ctx, friendCircle.Uid, uid)
+	return nil
+}
+
+//获取查看者可以看到的评论
+func GetFriendCircleComments(ctx context.Context, fcid int64, viewer int64) ([]*sql.FriendCircleComment, error) {
+	_, err := verifyFriendCircleVisible(ctx, fcid, viewer)
+	if err != nil {
+		return nil, err
+	}
+	keyId := generateCommentsCacheKeyByFcid(fcid)
+	var comments []*sql.FriendCircleComment
+	err = getJsonFromHashCache(ctx, ctxlog.From(ctx).Named("cache.GetFriendCircleComments"), keyId, fmt.Sprintf("%d", viewer), &comments, func() (interface{}, error) {
+		return sql.GetFriendCircleComments(ctx, fcid, viewer)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+//点赞朋友圈，只能点赞自己可以看到的朋友圈
+func LikeFriendCircle(ctx context.Context, fcid int64, uid int64) error {
+	friendCircle, err := verifyFriendCircleVisible(ctx, fcid, uid)
+	if err != nil {
+		return err
+	}
+	err = sql.LikeFriendCircle(ctx, fcid, uid)
+	if err != nil {
+		return err
+	}
+	delFriendCircleKeysFromCache(ctx, ctxlog.From(ctx).Named("cache.LikeFriendCircle"), generateLikesCacheKeyByFcid(fcid))
+	delTimelineFromCacheByUid(ctx, friendCircle.Uid, uid)
+	return nil
+}
+
+//取消点赞
+func UnlikeFriendCircle(ctx context.Context, fcid int64, uid int64) error {
+	friendCircle, _, err := sql.CanViewFriendCircle(ctx, fcid, uid)
+	if err != nil {
+		return err
+	}
+	err = sql.UnlikeFriendCircle(ctx, fcid, uid)
+	if err != nil {
+		return err
+	}
+	delFriendCircleKeysFromCache(ctx, ctxlog.From(ctx).Named("cache.UnlikeFriendCircle"), generateLikesCacheKeyByFcid(fcid))
+	delTimelineFromCacheByUid(ctx, friendCircle.Uid, uid)
+	return nil
+}
+
+//获取查看者可以看到的点赞
+func GetFriendCircleLikes(ctx context.Context, fcid int64, viewer int64) ([]*sql.FriendCircleLike, error) {
+	_, err := verifyFriendCircleVisible(ctx, fcid, viewer)
+	if err != nil {
+		return nil, err
+	}
+	keyId := generateLikesCacheKeyByFcid(fcid)
+	var likes []*sql.FriendCircleLike
+	err = getJsonFromHashCache(ctx, ctxlog.From(ctx).Named("cache.GetFriendCircleLikes"), keyId, fmt.Sprintf("%d", viewer), &likes, func() (interface{}, error) {
+		return sql.GetFriendCircleLikes(ctx, fcid, viewer)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return likes, nil
+}
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	cacheGroupPrefix = "group"
+)
+
+func generateGroupCacheKey(gid int64, suffix string) string {
+	if suffix == "" {
+		return fmt.Sprintf("%s-%d", cacheGroupPrefix, gid)
+	}
+	return fmt.Sprintf("%s-%d-%s", cacheGroupPrefix, gid, suffix)
+}
+
+func generateGroupMembersCacheKey(gid int64) string {
+	return generateGroupCacheKey(gid, "members")
+}
+
+func delGroupMembersFromCache(ctx context.Context, gid int64) {
+	client := getRedisClient()
+	keyId := generateGroupMembersCacheKey(gid)
+	_, err := client.Del(ctx, keyId).Result()
+	if err != nil {
+		ctxlog.From(ctx).Named("cache.delGroupMembersFromCache").Error("del error", zap.String("key", keyId), zap.Error(err))
+	}
+}
+
+//校验uids都是uid的好友
+func verifyAllFriends(ctx context.Context, uid int64, uids []int64) error {
+	friends, err := GetFriendsByUid(ctx, uid)
+	if err != nil {
+		return err
+	}
+	fids := make(map[int64]bool, len(friends))
+	for _, friend := range friends {
+		fids[friend.Fid] = true
+	}
+	for _, fid := range uids {
+		if !fids[fid] {
+			return fmt.Errorf("%d is not friend", fid)
+		}
+	}
+	return nil
+}
+
+//获取群的所有成员
+func GetGroupMembers(ctx context.Context, gid int64) ([]*sql.GroupMember, error) {
+	logger := ctxlog.From(ctx).Named("cache.GetGroupMembers")
+	client := getRedisClient()
+	keyId := generateGroupMembersCacheKey(gid)
+	membersJsonStr, err := client.Get(ctx, keyId).Result()
+	if err != nil || membersJsonStr == "" {
+		if err != nil {
+			logger.Debug("get members from cache error", zap.Error(err))
+		}
+		members, err := sql.GetGroupMembers(ctx, gid)
+		if err != nil {
+			return nil, err
+		}
+		jsonBytes, saveToCacheErr := json.Marshal(members)
+		if saveToCacheErr != nil {
+			logger.Error("marshal members error", zap.Error(saveToCacheErr))
+		} else {
+			str, saveToCacheErr := client.Set(ctx, keyId, string(jsonBytes), time.Second*5).Result()
+			logger.Debug("save to redis", zap.String("key", keyId), zap.String("result", str), zap.Error(saveToCacheErr))
+		}
+		return members, nil
+	}
+	var members []*sql.GroupMember
+	err = json.Unmarshal([]byte(membersJsonStr), &members)
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+//获取uid在群中的成员信息，不是群成员时返回nil
+func GetGroupMember(ctx context.Context, gid int64, uid int64) (*sql.GroupMember, error) {
+	members, err := GetGroupMembers(ctx, gid)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		if member.Uid == uid {
+			return member, nil
+		}
+	}
+	return nil, nil
+}
+
+//获取操作者在群中的成员信息，不是群成员或者角色低于minRole时返回error
+func getGroupOperator(ctx context.Context, gid int64, operator int64, minRole uint8) (*sql.GroupMember, error) {
+	member, err := GetGroupMember(ctx, gid, operator)
+	if err != nil {
+		return nil, err
+	}
+	if member == nil {
+		return nil, errors.New("operator is not group member")
+	}
+	if member.Role < minRole {
+		return nil, errors.New("operator permission denied")
+	}
+	return member, nil
+}
+
+//创建群，memberUids必须都是群主的好友
+func CreateGroup(ctx context.Context, group *sql.Group, memberUids []int64) (int64, error) {
+	err := verifyAllFriends(ctx, group.Owner, memberUids)
+	if err != nil {
+		return 0, err
+	}
+	return sql.CreateGroup(ctx, group, memberUids)
+}
+
+//群主或管理员添加群成员，uids必须都是操作者的好友
+func AddGroupMembers(ctx context.Context, operator int64, gid int64, uids []int64) error {
+	_, err := getGroupOperator(ctx, gid, operator, sql.GroupRoleAdmin)
+	if err != nil {
+		return err
+	}
+	err = verifyAllFriends(ctx, operator, uids)
+	if err != nil {
+		return err
+	}
+	err = sql.AddGroupMembers(ctx, gid, uids)
+	if err != nil {
+		return err
+	}
+	delGroupMembersFromCache(ctx, gid)
+	return nil
+}
+
+//移除群成员：成员可以自己退群，群主可以移除任何人，管理员只能移除普通成员；群主不能退群
+func RemoveGroupMember(ctx context.Context, operator int64, gid int64, uid int64) error {
+	member, err := GetGroupMember(ctx, gid, uid)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return errors.New("uid is not group member")
+	}
+	if member.Role == sql.GroupRoleOwner {
+		return errors.New("owner can not be removed")
+	}
+	if operator != uid {
+		minRole := uint8(sql.GroupRoleAdmin)
+		if member.Role == sql.GroupRoleAdmin {
+			minRole = sql.GroupRoleOwner
+		}
+		_, err = getGroupOperator(ctx, gid, operator, minRole)
+		if err != nil {
+			return err
+		}
+	}
+	err = sql.RemoveGroupMember(ctx, gid, uid)
+	if err != nil {
+		return err
+	}
+	delGroupMembersFromCache(ctx, gid)
+	return nil
+}
+
+//群主设置成员为管理员或普通成员
+func UpdateGroupMemberRole(ctx context.Context, operator int64, gid int64, uid int64, role uint8) error {
+	if role != sql.GroupRoleMember && role != sql.GroupRoleAdmin {
+		return errors.New("role must be member or admin")
+	}
+	if operator == uid {
+		return errors.New("owner can not change self role")
+	}
+	_, err := getGroupOperator(ctx, gid, operator, sql.GroupRoleOwner)
+	if err != nil {
+		return err
+	}
+	err = sql.UpdateGroupMemberRole(ctx, gid, uid, role)
+	if err != nil {
+		return err
+	}
+	delGroupMembersFromCache(ctx, gid)
+	return nil
+}
+
+//群主或管理员更新群名称和头像
+func UpdateGroupInfo(ctx context.Context, operator int64, gid int64, name string, avatar string) error {
+	_, err := getGroupOperator(ctx, gid, operator, sql.GroupRoleAdmin)
+	if err != nil {
+		return err
+	}
+	return sql.UpdateGroupInfo(ctx, gid, name, avatar)
+}
+
+//获取用户加入的所有群
+func GetGroupsByUid(ctx context.Context, uid int64) ([]*sql.Group, error) {
+	return sql.GetGroupsByUid(ctx, uid)
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	cacheInboxPrefix  = "inbox"
+	cacheInboxMaxSize = 1000               //离线收件箱最多保存的消息条数，超出后丢弃最旧的，客户端可以通过seq同步
+	cacheInboxExpire  = time.Hour * 24 * 7 //离线收件箱长时间没有新消息后过期
+)
+
+func generateInboxCacheKey(uid int64) string {
+	return fmt.Sprintf("%s-%d", cacheInboxPrefix, uid)
+}
+
+//将消息放入uid的离线收件箱，按消息id排序
+func PushOfflineMessage(ctx context.Context, uid int64, message *sql.Message) error {
+	jsonBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	client := getRedisClient()
+	keyId := generateInboxCacheKey(uid)
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, keyId, &redis.Z{Score: float64(message.Id), Member: string(jsonBytes)})
+		pipe.ZRemRangeByRank(ctx, keyId, 0, -cacheInboxMaxSize-1)
+		pipe.Expire(ctx, keyId, cacheInboxExpire)
+		return nil
+	})
+	return err
+}
+
+//获取uid离线收件箱中id大于afterId的消息，根据id升序
+func GetOfflineMessages(ctx context.Context, uid int64, afterId int64, limit int) ([]*sql.Message, error) {
+	logger := ctxlog.From(ctx).Named("cache.GetOfflineMessages")
+	client := getRedisClient()
+	keyId := generateInboxCacheKey(uid)
+	members, err := client.ZRangeByScore(ctx, keyId, &redis.ZRangeBy{
+		Min:   fmt.Sprintf("(%d", afterId),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*sql.Message, 0, len(members))
+	for _, member := range members {
+		message := &sql.Message{}
+		err = json.Unmarshal([]byte(member), message)
+		if err != nil {
+			logger.Error("unmarshal message error", zap.String("key", keyId), zap.Error(err))
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+//从uid的离线收件箱中移除消息
+func RemoveOfflineMessage(ctx context.Context, uid int64, id int64) {
+	client := getRedisClient()
+	keyId := generateInboxCacheKey(uid)
+	score := fmt.Sprintf("%d", id)
+	_, err := client.ZRemRangeByScore(ctx, keyId, score, score).Result()
+	if err != nil {
+		ctxlog.From(ctx).Named("cache.RemoveOfflineMessage").Error("remove message error", zap.Int64("id", id), zap.String("key", keyId), zap.Error(err))
+	}
+}
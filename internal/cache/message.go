@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	cacheMessagePrefix     = "message"
+	cacheMessageTailSize   = 200              //每个会话在redis中保存最新消息的条数
+	cacheMessageTailExpire = time.Minute * 30 //会话长时间没有新消息后从redis中淘汰
+)
+
+var (
+	//只有会话缓存尾部中存在该seq时才替换，避免为旧消息单独创建一个不完整的缓存尾部
+	cacheReplaceMessageScript = redis.NewScript(`
+if redis.call('zcount', KEYS[1], ARGV[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('zremrangebyscore', KEYS[1], ARGV[1], ARGV[1])
+redis.call('zadd', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+)
+
+func generateMessageTailCacheKey(conversation string) string {
+	return fmt.Sprintf("%s-%s-tail", cacheMessagePrefix, conversation)
+}
+
+func delMessageTailFromCache(ctx context.Context, conversation string) {
+	client := getRedisClient()
+	keyId := generateMessageTailCacheKey(conversation)
+	_, err := client.Del(ctx, keyId).Result()
+	if err != nil {
+		ctxlog.From(ctx).Named("cache.delMessageTailFromCache").Error("del error", zap.String("key", keyId), zap.Error(err))
+	}
+}
+
+//将消息按seq加入会话的缓存尾部，只保留最新的cacheMessageTailSize条
+func appendMessagesToCache(ctx context.Context, conversation string, messages []*sql.Message) error {
+	members := make([]*redis.Z, 0, len(messages))
+	for _, message := range messages {
+		jsonBytes, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		members = append(members, &redis.Z{Score: float64(message.Seq), Member: string(jsonBytes)})
+	}
+	client := getRedisClient()
+	keyId := generateMessageTailCacheKey(conversation)
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, keyId, members...)
+		pipe.ZRemRangeByRank(ctx, keyId, 0, -cacheMessageTailSize-1)
+		pipe.Expire(ctx, keyId, cacheMessageTailExpire)
+		return nil
+	})
+	return err
+}
+
+func filterMessagesAfterSeq(messages []*sql.Message, seq int64, limit int) []*sql.Message {
+	results := make([]*sql.Message, 0)
+	for _, message := range messages {
+		if message.Seq <= seq {
+			continue
+		}
+		results = append(results, message)
+		if len(results) == limit {
+			break
+		}
+	}
+	return results
+}
+
+//保存消息，并将消息加入会话的缓存尾部
+func SaveMessage(ctx context.Context, message *sql.Message) (int64, error) {
+	logger := ctxlog.From(ctx).Named("cache.SaveMessage")
+	if message.Gid == 0 {
+		//单聊时接收者把发送者加入黑名单后不能再发送
+		blocked, err := IsBlocked(ctx, message.Receiver, message.Sender)
+		if err != nil {
+			return 0, err
+		}
+		if blocked {
+			return 0, ErrBlocked
+		}
+	}
+	id, err := sql.InsertMessage(ctx, message)
+	if err != nil {
+		return 0, err
+	}
+	//事务提交后才加入缓存尾部，并发发送时可能先加入较大的seq，读取时检查seq是否连续
+	err = appendMessagesToCache(ctx, message.Conversation, []*sql.Message{message})
+	if err != nil {
+		//缓存尾部出现空洞后不能再用于同步，直接删除
+		logger.Error("append to cache error", zap.String("conversation", message.Conversation), zap.Int64("seq", message.Seq), zap.Error(err))
+		delMessageTailFromCache(ctx, message.Conversation)
+	}
+	return id, nil
+}
+
+//获取会话中seq之后的消息，根据seq升序；缓存尾部能覆盖seq+1并且其中的seq连续时从redis读取，否则从数据库读取
+func GetMessagesAfterSeq(ctx context.Context, conversation string, seq int64, limit int) ([]*sql.Message, error) {
+	logger := ctxlog.From(ctx).Named("cache.GetMessagesAfterSeq")
+	if limit < 1 || limit > cacheMessageTailSize {
+		limit = cacheMessageTailSize
+	}
+	client := getRedisClient()
+	keyId := generateMessageTailCacheKey(conversation)
+	first, err := client.ZRangeWithScores(ctx, keyId, 0, 0).Result()
+	if err != nil {
+		logger.Error("get first message error", zap.String("key", keyId), zap.Error(err))
+		return sql.GetMessagesAfterSeq(ctx, conversation, seq, limit)
+	}
+	if len(first) == 0 {
+		//缓存中没有会话尾部，从数据库加载后保存到redis
+		tail, err := sql.GetLatestMessages(ctx, conversation, cacheMessageTailSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(tail) == 0 {
+			return tail, nil
+		}
+		saveToCacheErr := appendMessagesToCache(ctx, conversation, tail)
+		if saveToCacheErr != nil {
+			logger.Error("save to cache error", zap.String("key", keyId), zap.Error(saveToCacheErr))
+			delMessageTailFromCache(ctx, conversation)
+		}
+		if tail[0].Seq > seq+1 {
+			return sql.GetMessagesAfterSeq(ctx, conversation, seq, limit)
+		}
+		return filterMessagesAfterSeq(tail, seq, limit), nil
+	}
+	if int64(first[0].Score) > seq+1 {
+		return sql.GetMessagesAfterSeq(ctx, conversation, seq, limit)
+	}
+	members, err := client.ZRangeByScore(ctx, keyId, &redis.ZRangeBy{
+		Min:   fmt.Sprintf("(%d", seq),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		logger.Error("get messages after seq error", zap.String("key", keyId), zap.Int64("seq", seq), zap.Error(err))
+		return sql.GetMessagesAfterSeq(ctx, conversation, seq, limit)
+	}
+	messages := make([]*sql.Message, 0, len(members))
+	for _, member := range members {
+		message := &sql.Message{}
+		err = json.Unmarshal([]byte(member), message)
+		if err != nil {
+			logger.Error("unmarshal message error", zap.String("key", keyId), zap.Error(err))
+			return sql.GetMessagesAfterSeq(ctx, conversation, seq, limit)
+		}
+		messages = append(messages, message)
+	}
+	if !isContinuousAfterSeq(messages, seq) {
+		//同一会话并发发送时，加入缓存尾部的顺序可能和seq顺序不同，缓存中暂时缺少的消息从数据库读取
+		logger.Info("messages in cache are not continuous", zap.String("key", keyId), zap.Int64("seq", seq))
+		return sql.GetMessagesAfterSeq(ctx, conversation, seq, limit)
+	}
+	return messages, nil
+}
+
+//消息的seq是否从seq+1开始连续
+func isContinuousAfterSeq(messages []*sql.Message, seq int64) bool {
+	for i, message := range messages {
+		if message.Seq != seq+int64(i)+1 {
+			return false
+		}
+	}
+	return true
+}
+
+//替换会话缓存尾部中的一条消息
+func replaceMessageInCache(ctx context.Context, message *sql.Message) {
+	logger := ctxlog.From(ctx).Named("cache.replaceMessageInCache")
+	jsonBytes, err := json.Marshal(message)
+	if err != nil {
+		logger.Error("marshal message error", zap.Error(err))
+		delMessageTailFromCache(ctx, message.Conversation)
+		return
+	}
+	client := getRedisClient()
+	keyId := generateMessageTailCacheKey(message.Conversation)
+	_, err = cacheReplaceMessageScript.Run(ctx, client, []string{keyId}, message.Seq, string(jsonBytes)).Result()
+	if err != nil {
+		logger.Error("replace error", zap.String("key", keyId), zap.Int64("seq", message.Seq), zap.Error(err))
+		delMessageTailFromCache(ctx, message.Conversation)
+	}
+}
+
+//接收者确认消息已收到或已读，更新消息状态并从离线收件箱中移除；状态有变化时返回更新后的消息，否则返回nil
+//群消息没有单独的接收者，只从离线收件箱中移除
+func AckMessage(ctx context.Context, receiver int64, conversation string, seq int64, status uint8) (*sql.Message, error) {
+	message, err := sql.GetMessageBySeq(ctx, conversation, seq)
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, errors.New("message is not exist")
+	}
+	if message.Gid > 0 {
+		RemoveOfflineMessage(ctx, receiver, message.Id)
+		return nil, nil
+	}
+	if message.Receiver != receiver {
+		return nil, errors.New("message is not exist")
+	}
+	RemoveOfflineMessage(ctx, receiver, message.Id)
+	updated, err := sql.UpdateMessageStatus(ctx, conversation, seq, receiver, status)
+	if err != nil {
+		return nil, err
+	}
+	if !updated {
+		return nil, nil
+	}
+	message.Status = status
+	replaceMessageInCache(ctx, message)
+	return message, nil
+}
@@ -3,7 +3,9 @@ package cache
 import (
 	"context"
 	"fmt"
+	"github.com/go-redis/redis/extra/redisotel/v8"
 	"github.com/go-redis/redis/v8"
+	"github.com/liqifyl/chat-go/internal/metrics"
 	"sync"
 )
 
@@ -11,12 +13,18 @@ const (
 	cacheRedisError = iota + 10000
 )
 
+//缓存命中率监控中的缓存名称
+const (
+	cacheMetricsUser    = "user"
+	cacheMetricsSign    = "sign"
+	cacheMetricsNick    = "nick"
+	cacheMetricsFriends = "friends"
+)
+
 var (
-	cacheRedisCtx                               = context.Background()
-	cacheRedisClient              *redis.Client = nil
-	cacheRedisClientLock                        = sync.Mutex{}
-	cacheRedisClientMap                         = make(map[string]*redisClient)
-	CacheDefaultRedisClientConfig               = RedisClientConfig{}
+	cacheRedisClientLock          = sync.Mutex{}
+	cacheRedisClientMap           = make(map[string]*redisClient)
+	CacheDefaultRedisClientConfig = RedisClientConfig{}
 )
 
 type RedisClientConfig struct {
@@ -45,13 +53,36 @@ func getRedisClientByConfig(config RedisClientConfig) *redis.Client {
 	key := convertConfigToStr(config)
 	client := cacheRedisClientMap[key]
 	if client == nil {
-		client := &redisClient{}
+		client = &redisClient{}
 		client.config = config
 		client.client = redis.NewClient(&redis.Options{
 			Addr:     config.Addr,
 			Password: config.Pwd, // no password set
 			DB:       config.Db,  // use default DB
 		})
+		client.client.AddHook(metrics.RedisHook{})
+		client.client.AddHook(redisotel.NewTracingHook())
+		cacheRedisClientMap[key] = client
 	}
 	return client.client
 }
+
+//关闭所有redis客户端，进程退出前调用
+func CloseRedisClients() error {
+	cacheRedisClientLock.Lock()
+	defer cacheRedisClientLock.Unlock()
+	var lastErr error
+	for key, client := range cacheRedisClientMap {
+		err := client.client.Close()
+		if err != nil {
+			lastErr = err
+		}
+		delete(cacheRedisClientMap, key)
+	}
+	return lastErr
+}
+
+//检查默认redis是否可以访问
+func PingRedis(ctx context.Context) error {
+	return getRedisClient().Ping(ctx).Err()
+}
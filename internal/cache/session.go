@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/token"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	cacheSessionPrefix         = "session"
+	cacheSessionExpire         = token.RefreshTokenValidDuration //最后一个会话的refresh token过期后整个hash过期
+	cacheSessionActiveInterval = time.Minute                     //最后活跃时间的更新间隔，避免每个请求都写redis
+)
+
+//一个设备上的登录会话，一个设备同时只有一个会话
+type Session struct {
+	Sid        string `json:"sid"`
+	DeviceId   string `json:"device_id"`
+	Platform   string `json:"platform"`
+	Ip         string `json:"ip"`
+	LoginTime  int64  `json:"login_time"`  //登录时间，unix秒
+	LastActive int64  `json:"last_active"` //最后活跃时间，unix秒
+}
+
+//用户所有的会话保存在一个hash中，field为sid
+func generateSessionsCacheKeyByUid(uid int64) string {
+	return fmt.Sprintf("%s-%d", cacheSessionPrefix, uid)
+}
+
+func saveSession(ctx context.Context, uid int64, session *Session) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	client := getRedisClient()
+	keyId := generateSessionsCacheKeyByUid(uid)
+	pipe := client.TxPipeline()
+	pipe.HSet(ctx, keyId, session.Sid, string(value))
+	pipe.Expire(ctx, keyId, cacheSessionExpire)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//创建会话，同一个设备上的旧会话会被删除；返回新会话以及被替换的旧会话
+func CreateSession(ctx context.Context, uid int64, deviceId string, platform string, ip string) (*Session, *Session, error) {
+	sessions, err := GetSessions(ctx, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	var replaced *Session
+	for _, session := range sessions {
+		if session.DeviceId == deviceId {
+			replaced, err = RemoveSession(ctx, uid, session.Sid)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	sid, err := token.GenerateSessionId()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now().Unix()
+	session := &Session{Sid: sid, DeviceId: deviceId, Platform: platform, Ip: ip, LoginTime: now, LastActive: now}
+	err = saveSession(ctx, uid, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, replaced, nil
+}
+
+//获取会话，不存在时返回nil
+func getSession(ctx context.Context, uid int64, sid string) (*Session, error) {
+	client := getRedisClient()
+	value, err := client.HGet(ctx, generateSessionsCacheKeyByUid(uid), sid).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	err = json.Unmarshal([]byte(value), session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+//会话仍然有效时更新最后活跃时间，ip为空时不更新ip；会话已经被删除时返回nil
+func TouchSession(ctx context.Context, uid int64, sid string, ip string) (*Session, error) {
+	session, err := getSession(ctx, uid, sid)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if now-session.LastActive < int64(cacheSessionActiveInterval/time.Second) && (ip == "" || ip == session.Ip) {
+		return session, nil
+	}
+	session.LastActive = now
+	if ip != "" {
+		session.Ip = ip
+	}
+	err = saveSession(ctx, uid, session)
+	if err != nil {
+		ctxlog.From(ctx).Named("cache.TouchSession").Error("save session error", zap.Int64("uid", uid), zap.String("sid", sid), zap.Error(err))
+	}
+	return session, nil
+}
+
+//获取用户所有会话
+func GetSessions(ctx context.Context, uid int64) ([]*Session, error) {
+	client := getRedisClient()
+	values, err := client.HGetAll(ctx, generateSessionsCacheKeyByUid(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0, len(values))
+	for sid, value := range values {
+		session := &Session{}
+		err = json.Unmarshal([]byte(value), session)
+		if err != nil {
+			ctxlog.From(ctx).Named("cache.GetSessions").Error("unmarshal session error", zap.Int64("uid", uid), zap.String("sid", sid), zap.Error(err))
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+//删除会话，会话的access token和refresh token立即失效
+func RemoveSession(ctx context.Context, uid int64, sid string) (*Session, error) {
+	session, err := getSession(ctx, uid, sid)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, errors.New("session is not exist")
+	}
+	client := getRedisClient()
+	err = client.HDel(ctx, generateSessionsCacheKeyByUid(uid), sid).Err()
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+//删除除keepSid之外的所有会话，返回被删除的会话
+func RemoveOtherSessions(ctx context.Context, uid int64, keepSid string) ([]*Session, error) {
+	sessions, err := GetSessions(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	var removed []*Session
+	for _, session := range sessions {
+		if session.Sid == keepSid {
+			continue
+		}
+		_, err = RemoveSession(ctx, uid, session.Sid)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, session)
+	}
+	return removed, nil
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/token"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cacheTokenPrefix           = "token"
+	cacheRefreshTokenUsedMark  = "used:"
+	cacheTokenValidAfterExpire = token.RefreshTokenValidDuration //超过refresh token有效期后所有旧的token都已经失效
+)
+
+var (
+	//读取refresh token并标记为已使用，已使用的token保留到原来的过期时间，用于发现被盗用的token
+	cacheUseRefreshTokenScript = redis.NewScript(`
+local v = redis.call('get', KEYS[1])
+if not v then
+	return false
+end
+if string.sub(v, 1, 5) ~= 'used:' then
+	local ttl = redis.call('pttl', KEYS[1])
+	if ttl > 0 then
+		redis.call('set', KEYS[1], 'used:' .. v, 'PX', ttl)
+	end
+end
+return v
+`)
+)
+
+//登录或者刷新后返回给客户端的token
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` //access token有效时间，单位秒
+}
+
+//refresh token在redis中保存的状态
+type refreshTokenRecord struct {
+	Uid int64  `json:"uid"`
+	Sid string `json:"sid"`
+	Iat int64  `json:"iat"`
+}
+
+//redis中只保存refresh token的sha256，redis泄漏时也不能直接使用
+func generateRefreshTokenCacheKey(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return fmt.Sprintf("%s-refresh-%s", cacheTokenPrefix, hex.EncodeToString(sum[:]))
+}
+
+func generateRevokedTokenCacheKey(jti string) string {
+	return fmt.Sprintf("%s-revoked-%s", cacheTokenPrefix, jti)
+}
+
+//早于这个时间签发的token全部失效，修改密码等场景使用
+func generateTokenValidAfterCacheKey(uid int64) string {
+	return fmt.Sprintf("%s-%d-valid_after", cacheTokenPrefix, uid)
+}
+
+//为登录会话签发access token以及refresh token
+func IssueTokens(ctx context.Context, uid int64, session *Session) (*TokenPair, error) {
+	accessToken, _, err := token.GenerateToken(uid, session.Sid, session.DeviceId, session.Platform)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := token.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	record, err := json.Marshal(&refreshTokenRecord{Uid: uid, Sid: session.Sid, Iat: time.Now().Unix()})
+	if err != nil {
+		return nil, err
+	}
+	client := getRedisClient()
+	err = client.Set(ctx, generateRefreshTokenCacheKey(refreshToken), string(record), token.RefreshTokenValidDuration).Err()
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, ExpiresIn: int64(token.AccessTokenValidDuration / time.Second)}, nil
+}
+
+//使用refresh token换取新的token，旧的refresh token只能使用一次；
+//已经使用过的refresh token再次出现说明被盗用，该用户所有token全部失效
+func RefreshTokens(ctx context.Context, refreshToken string, ip string) (*TokenPair, error) {
+	logger := ctxlog.From(ctx).Named("cache.RefreshTokens")
+	if refreshToken == "" {
+		return nil, errors.New("refresh token is empty")
+	}
+	client := getRedisClient()
+	value, err := cacheUseRefreshTokenScript.Run(ctx, client, []string{generateRefreshTokenCacheKey(refreshToken)}).Text()
+	if err == redis.Nil {
+		return nil, errors.New("refresh token is invalid")
+	}
+	if err != nil {
+		return nil, err
+	}
+	reused := strings.HasPrefix(value, cacheRefreshTokenUsedMark)
+	record := &refreshTokenRecord{}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(value, cacheRefreshTokenUsedMark)), record)
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		logger.Warn("refresh token is reused, revoke all tokens", zap.Int64("uid", record.Uid))
+		revokeErr := RevokeAllTokens(ctx, record.Uid)
+		if revokeErr != nil {
+			logger.Error("revoke all tokens error", zap.Int64("uid", record.Uid), zap.Error(revokeErr))
+		}
+		return nil, errors.New("refresh token is invalid")
+	}
+	validAfter, err := getTokenValidAfter(ctx, record.Uid)
+	if err != nil {
+		return nil, err
+	}
+	if record.Iat < validAfter {
+		return nil, errors.New("refresh token is revoked")
+	}
+	session, err := TouchSession(ctx, record.Uid, record.Sid, ip)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, errors.New("session is revoked")
+	}
+	return IssueTokens(ctx, record.Uid, session)
+}
+
+//注销：删除登录会话，access token加入黑名单直到过期，refresh token直接删除
+func RevokeToken(ctx context.Context, claims *token.Claims, refreshToken string) error {
+	_, err := RemoveSession(ctx, claims.Uid, claims.Sid)
+	if err != nil {
+		ctxlog.From(ctx).Named("cache.RevokeToken").Error("remove session error", zap.Int64("uid", claims.Uid), zap.String("sid", claims.Sid), zap.Error(err))
+	}
+	client := getRedisClient()
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0))
+	if ttl > 0 {
+		err := client.Set(ctx, generateRevokedTokenCacheKey(claims.Id), claims.Uid, ttl).Err()
+		if err != nil {
+			return err
+		}
+	}
+	if refreshToken != "" {
+		err := client.Del(ctx, generateRefreshTokenCacheKey(refreshToken)).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//让uid当前所有的登录会话、access token和refresh token失效
+func RevokeAllTokens(ctx context.Context, uid int64) error {
+	client := getRedisClient()
+	err := client.Set(ctx, generateTokenValidAfterCacheKey(uid), time.Now().Unix(), cacheTokenValidAfterExpire).Err()
+	if err != nil {
+		return err
+	}
+	return client.Del(ctx, generateSessionsCacheKeyByUid(uid)).Err()
+}
+
+func getTokenValidAfter(ctx context.Context, uid int64) (int64, error) {
+	client := getRedisClient()
+	value, err := client.Get(ctx, generateTokenValidAfterCacheKey(uid)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+//判断access token是否已经注销、所在会话被删除或者被统一吊销；有效时更新会话的最后活跃时间
+func IsTokenRevoked(ctx context.Context, claims *token.Claims, ip string) (bool, error) {
+	client := getRedisClient()
+	revoked, err := client.Exists(ctx, generateRevokedTokenCacheKey(claims.Id)).Result()
+	if err != nil {
+		return false, err
+	}
+	if revoked > 0 {
+		return true, nil
+	}
+	validAfter, err := getTokenValidAfter(ctx, claims.Uid)
+	if err != nil {
+		return false, err
+	}
+	if claims.IssuedAt < validAfter {
+		return true, nil
+	}
+	session, err := TouchSession(ctx, claims.Uid, claims.Sid, ip)
+	if err != nil {
+		return false, err
+	}
+	return session == nil, nil
+}
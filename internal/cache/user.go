@@ -1,11 +1,15 @@
 package cache
 
 import (
+	"context"
 	json2 "encoding/json"
 	"errors"
 	"fmt"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/metrics"
+	"github.com/liqifyl/chat-go/internal/password"
 	"github.com/liqifyl/chat-go/internal/sql"
-	"log"
+	"go.uber.org/zap"
 	"time"
 )
 
@@ -21,8 +25,8 @@ const (
 )
 
 //从数据库中查询用户
-func queryUserFromDbById(id int64) (*sql.ChatUser, error) {
-	users, err := sql.QueryUserById(id)
+func queryUserFromDbById(ctx context.Context, id int64) (*sql.ChatUser, error) {
+	users, err := sql.QueryUserById(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -32,9 +36,11 @@ func queryUserFromDbById(id int64) (*sql.ChatUser, error) {
 	return users[0], nil
 }
 
-//将user序列化成json字符串
+//将user序列化成json字符串，密码不会保存到redis
 func marshalUser(user *sql.ChatUser) (string, error) {
-	userJson, err := json2.Marshal(user)
+	withoutPassword := *user
+	withoutPassword.Password = ""
+	userJson, err := json2.Marshal(&withoutPassword)
 	if err != nil {
 		return "", err
 	}
@@ -43,8 +49,8 @@ func marshalUser(user *sql.ChatUser) (string, error) {
 }
 
 //从数据库中查询用户并将user信息序列化成json字符串
-func queryUserFromDbWithStr(id int64) (string, error) {
-	user, err := queryUserFromDbById(id)
+func queryUserFromDbWithStr(ctx context.Context, id int64) (string, error) {
+	user, err := queryUserFromDbById(ctx, id)
 	if err != nil {
 		return "", err
 	}
@@ -66,14 +72,14 @@ func generateUserCacheKey(id int64, suffix string) string {
 根据id查询用户是否存在
 返回error为空存在，不为空不存在
 */
-func IsExistOfUser(id int64) (int, error) {
+func IsExistOfUser(ctx context.Context, id int64) (int, error) {
 	client := getRedisClient()
 	keyId := generateUserCacheKeyById(id)
-	userExist, err := client.Exists(cacheRedisCtx, keyId).Result()
+	userExist, err := client.Exists(ctx, keyId).Result()
 	if err != nil {
-		log.Printf("cache exe exists error %v", err)
+		ctxlog.From(ctx).Error("exists user in cache error", zap.Error(err))
 		//从数据库中查询
-		ret, err := queryUserFromDbWithStr(id)
+		ret, err := queryUserFromDbWithStr(ctx, id)
 		if err != nil {
 			return cacheUserQueryUserErrorFromDb, err
 		}
@@ -84,8 +90,9 @@ func IsExistOfUser(id int64) (int, error) {
 		}
 	}
 	if userExist == 0 {
+		metrics.ObserveCache(cacheMetricsUser, metrics.CacheResultMiss)
 		//如果不存在redis中，从数据库查询
-		ret, err := queryUserFromDbWithStr(id)
+		ret, err := queryUserFromDbWithStr(ctx, id)
 		if err != nil {
 			return cacheUserQueryUserErrorFromDb, err
 		}
@@ -93,11 +100,12 @@ func IsExistOfUser(id int64) (int, error) {
 			return cacheUserIsEmptyFromDb, errors.New("query user from db, but user info is empty")
 		}
 		//将数据库中查询到数据保存到redis中
-		cmdRes, err := client.SetNX(cacheRedisCtx, keyId, ret, time.Second*5).Result()
-		log.Printf("save user info to cache (%d, %v)", cmdRes, err)
+		cmdRes, err := client.SetNX(ctx, keyId, ret, time.Second*5).Result()
+		ctxlog.From(ctx).Debug("save user info to cache", zap.Bool("result", cmdRes), zap.Error(err))
 		return cacheUserOK, nil
 	}
-	log.Printf("user info is exist in cache")
+	ctxlog.From(ctx).Debug("user info is exist in cache")
+	metrics.ObserveCache(cacheMetricsUser, metrics.CacheResultHit)
 	return cacheUserOK, nil
 }
 
@@ -111,168 +119,201 @@ func copyUser(dst *sql.ChatUser, src *sql.ChatUser) {
 	dst.PhoneNumber = src.PhoneNumber
 }
 
-//用户登录
-func UserLogin(user *sql.ChatUser) (int, error) {
+//校验用户密码，数据库中是旧版本的明文或者强度不够的hash时用新的hash替换
+func verifyUserPassword(ctx context.Context, id int64, plain string) (int, error) {
+	logger := ctxlog.From(ctx).Named("cache.verifyUserPassword")
+	stored, err := sql.GetUserPasswordById(ctx, id)
+	if err != nil {
+		return cacheUserQueryUserErrorFromDb, err
+	}
+	match, needRehash := password.Compare(stored, plain)
+	if !match {
+		return cacheUserPasswordWrong, errors.New("password is wrong")
+	}
+	if needRehash {
+		err = sql.RehashUserPwd(ctx, id, stored, plain)
+		if err != nil {
+			logger.Error("rehash password error", zap.Int64("id", id), zap.Error(err))
+		}
+	}
+	return cacheUserOK, nil
+}
+
+//用户登录，密码总是和数据库中的hash比较，用户信息优先从redis读取
+func UserLogin(ctx context.Context, user *sql.ChatUser) (int, error) {
+	code, err := verifyUserPassword(ctx, user.Id, user.Password)
+	if err != nil {
+		return code, err
+	}
 	client := getRedisClient()
 	keyId := generateUserCacheKeyById(user.Id)
-	userJsonStr, err := client.Get(cacheRedisCtx, keyId).Result()
+	userJsonStr, err := client.Get(ctx, keyId).Result()
 	if err == nil && userJsonStr != "" {
 		cacheUser := &sql.ChatUser{}
 		err = json2.Unmarshal([]byte(userJsonStr), cacheUser)
 		if err != nil {
-			log.Printf("unmarshal user string error %v", err)
+			ctxlog.From(ctx).Error("unmarshal user string error", zap.Error(err))
 		} else {
 			if cacheUser.Id == user.Id {
-				if user.Password != cacheUser.Password {
-					err = errors.New("password is wrong")
-				} else {
-					copyUser(user, cacheUser)
-					return cacheUserOK, nil
-				}
+				metrics.ObserveCache(cacheMetricsUser, metrics.CacheResultHit)
+				copyUser(user, cacheUser)
+				return cacheUserOK, nil
 			} else {
 				err = errors.New("cacheUser id is not equal request user id")
 			}
 		}
 	}
 
-	log.Printf("get user info from cache error %v", err)
+	ctxlog.From(ctx).Error("get user info from cache error", zap.Error(err))
+	metrics.ObserveCache(cacheMetricsUser, metrics.CacheResultMiss)
 	//从数据库中查询
-	ret, err := queryUserFromDbById(user.Id)
+	ret, err := queryUserFromDbById(ctx, user.Id)
 	if err != nil {
 		return cacheUserQueryUserErrorFromDb, err
 	}
 	if ret == nil {
 		return cacheUserIsEmptyFromDb, errors.New("query user from db, but user info is empty")
 	} else {
-		if user.Password != ret.Password {
-			return cacheUserPasswordWrong, errors.New("password is wrong")
-		}
 		copyUser(user, ret)
 		//保存用户信息到redis
 		userMarshalStr, err := marshalUser(ret)
 		if err != nil {
-			log.Printf("marshal user info error %v", err)
+			ctxlog.From(ctx).Error("marshal user info error", zap.Error(err))
 		} else {
-			cmdRes, err := client.SetNX(cacheRedisCtx, keyId, userMarshalStr, time.Second * 5).Result()
-			log.Printf("save user info to cache (%d, %v)", cmdRes, err)
+			cmdRes, err := client.SetNX(ctx, keyId, userMarshalStr, time.Second*5).Result()
+			ctxlog.From(ctx).Debug("save user info to cache", zap.Bool("result", cmdRes), zap.Error(err))
 		}
 		return 0, nil
 	}
 }
 
 //从redis中删除用户
-func DeleteUserFromRedis(user *sql.ChatUser) (int, error) {
+func DeleteUserFromRedis(ctx context.Context, user *sql.ChatUser) (int, error) {
 	client := getRedisClient()
 	keyId := generateUserCacheKeyById(user.Id)
-	_, err := client.Del(cacheRedisCtx, keyId).Result()
+	_, err := client.Del(ctx, keyId).Result()
 	if err != nil {
 		return -1, err
 	}
 	return 0, nil
 }
 
-//更新用户密码，对于redis缓存和数据库同步问题使用策略是双删策略
-func UpdateUserPwd(user *sql.ChatUser, newPwd string) (int, error) {
-	logTag := "UpdateUserPwd->"
-	err := sql.UpdateUserPwd(user, newPwd)
+//更新用户密码，user.Password必须是正确的旧密码；对于redis缓存和数据库同步问题使用策略是双删策略
+func UpdateUserPwd(ctx context.Context, user *sql.ChatUser, newPwd string) (int, error) {
+	logger := ctxlog.From(ctx).Named("cache.UpdateUserPwd")
+	code, err := verifyUserPassword(ctx, user.Id, user.Password)
+	if err != nil {
+		return code, err
+	}
+	err = sql.UpdateUserPwd(ctx, user, newPwd)
 	if err != nil {
 		return -1, err
 	}
-	code, err := DeleteUserFromRedis(user)
+	code, err = DeleteUserFromRedis(ctx, user)
+	if err != nil {
+		logger.Error("delete user from redis again fail", zap.Int("code", code), zap.Error(err))
+	}
+	//修改密码后所有旧的登录全部失效
+	err = RevokeAllTokens(ctx, user.Id)
 	if err != nil {
-		log.Printf("%s again delete user fail from redis, (%d,%v)", logTag, code, err)
+		logger.Error("revoke all tokens error", zap.Int64("id", user.Id), zap.Error(err))
+		return -1, err
 	}
 	return 0, nil
 }
 
 //更新用户nick
-func UpdateUserNick(user *sql.ChatUser, newNick string) (int, error) {
-	logTag := "UpdateUserNick->"
-	err := sql.UpdateUserNick(user, newNick)
+func UpdateUserNick(ctx context.Context, user *sql.ChatUser, newNick string) (int, error) {
+	logger := ctxlog.From(ctx).Named("cache.UpdateUserNick")
+	err := sql.UpdateUserNick(ctx, user, newNick)
 	if err != nil {
 		return -1, err
 	}
-	code, err := DeleteUserFromRedis(user)
+	code, err := DeleteUserFromRedis(ctx, user)
 	if err != nil {
-		log.Printf("%s again delete user fail from redis, (%d,%v)", logTag, code, err)
+		logger.Error("delete user from redis again fail", zap.Int("code", code), zap.Error(err))
 	}
 	return 0, nil
 }
 
 //更新用户签名
-func UpdateUserSign(user *sql.ChatUser, newSign string) (int, error) {
-	logTag := "UpdateUserSign->"
-	err := sql.UpdateUserSign(user, newSign)
+func UpdateUserSign(ctx context.Context, user *sql.ChatUser, newSign string) (int, error) {
+	logger := ctxlog.From(ctx).Named("cache.UpdateUserSign")
+	err := sql.UpdateUserSign(ctx, user, newSign)
 	if err != nil {
 		return -1, err
 	}
-	code, err := DeleteUserFromRedis(user)
+	code, err := DeleteUserFromRedis(ctx, user)
 	if err != nil {
-		log.Printf("%s again delete user fail from redis, (%d,%v)", logTag, code, err)
+		logger.Error("delete user from redis again fail", zap.Int("code", code), zap.Error(err))
 	}
 	return 0, nil
 }
 
 //更新用户生日
-func UpdateUserBirthday(user *sql.ChatUser, newBirthday string) (int, error) {
-	logTag := "UpdateUserBirthday->"
-	err := sql.UpdateUserBirthday(user, newBirthday)
+func UpdateUserBirthday(ctx context.Context, user *sql.ChatUser, newBirthday string) (int, error) {
+	logger := ctxlog.From(ctx).Named("cache.UpdateUserBirthday")
+	err := sql.UpdateUserBirthday(ctx, user, newBirthday)
 	if err != nil {
 		return -1, err
 	}
-	code, err := DeleteUserFromRedis(user)
+	code, err := DeleteUserFromRedis(ctx, user)
 	if err != nil {
-		log.Printf("%s again delete user fail from redis, (%d,%v)", logTag, code, err)
+		logger.Error("delete user from redis again fail", zap.Int("code", code), zap.Error(err))
 	}
 	return 0, nil
 }
 
 //通过id获取sign
-func GetUserSignById(id int64) (string, error) {
-	logTag := "GetUserSignById->"
+func GetUserSignById(ctx context.Context, id int64) (string, error) {
+	logger := ctxlog.From(ctx).Named("cache.GetUserSignById")
 	client := getRedisClient()
 	keyId := generateUserCacheKey(id, "sign")
-	cacheSign, err := client.Get(cacheRedisCtx, keyId).Result()
+	cacheSign, err := client.Get(ctx, keyId).Result()
 	if err != nil || cacheSign == "" {
 		if err != nil {
-			log.Printf("%sget sign from redis error %v", logTag, err)
+			logger.Debug("get sign from redis error", zap.Error(err))
 		} else {
-			log.Printf("%ssign is empty from  redis%v", logTag, err)
+			logger.Debug("sign is empty from redis")
 		}
+		metrics.ObserveCache(cacheMetricsSign, metrics.CacheResultMiss)
 		//从数据库中查询
-		ret, err := sql.GetUserSignById(id)
+		ret, err := sql.GetUserSignById(ctx, id)
 		if err != nil {
-			log.Printf("%sget sign from mysql error %v", logTag, err)
+			logger.Error("get sign from mysql error", zap.Error(err))
 			return "", err
 		}
-		status, err := client.Set(cacheRedisCtx, keyId, ret, time.Second*5).Result()
-		log.Printf("%ssave %v to redis result(%s,%v)", logTag, keyId, status, err)
+		status, err := client.Set(ctx, keyId, ret, time.Second*5).Result()
+		logger.Debug("save to redis", zap.String("key", keyId), zap.String("result", status), zap.Error(err))
 		return ret, nil
 	}
+	metrics.ObserveCache(cacheMetricsSign, metrics.CacheResultHit)
 	return cacheSign, nil
 }
 
 //通过id获取nick
-func GetUserNickById(id int64) (string, error) {
-	logTag := "GetUserNickById->"
+func GetUserNickById(ctx context.Context, id int64) (string, error) {
+	logger := ctxlog.From(ctx).Named("cache.GetUserNickById")
 	client := getRedisClient()
 	keyId := generateUserCacheKey(id, "nick")
-	cacheSign, err := client.Get(cacheRedisCtx, keyId).Result()
+	cacheSign, err := client.Get(ctx, keyId).Result()
 	if err != nil || cacheSign == "" {
 		if err != nil {
-			log.Printf("%sget nick from redis error %v", logTag, err)
+			logger.Debug("get nick from redis error", zap.Error(err))
 		} else {
-			log.Printf("%snick is empty from  redis%v", logTag, err)
+			logger.Debug("nick is empty from redis")
 		}
+		metrics.ObserveCache(cacheMetricsNick, metrics.CacheResultMiss)
 		//从数据库中查询
-		ret, err := sql.GetUserSignById(id)
+		ret, err := sql.GetUserNick(ctx, id)
 		if err != nil {
-			log.Printf("%sget nick from mysql error %v", logTag, err)
+			logger.Error("get nick from mysql error", zap.Error(err))
 			return "", err
 		}
-		status, err := client.Set(cacheRedisCtx, keyId, ret, time.Second*5).Result()
-		log.Printf("%ssave %v to redis result(%s,%v)", logTag, keyId, status, err)
+		status, err := client.Set(ctx, keyId, ret, time.Second*5).Result()
+		logger.Debug("save to redis", zap.String("key", keyId), zap.String("result", status), zap.Error(err))
 		return ret, nil
 	}
+	metrics.ObserveCache(cacheMetricsNick, metrics.CacheResultHit)
 	return cacheSign, nil
 }
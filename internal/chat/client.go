@@ -0,0 +1,162 @@
+package chat
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/liqifyl/chat-go/internal/tracing"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	clientWriteWait      = 10 * time.Second        //写超时时间
+	clientPongWait       = 60 * time.Second        //等待对端pong的超时时间
+	clientPingPeriod     = clientPongWait * 9 / 10 //发送ping的间隔，必须小于clientPongWait
+	clientMaxFrameSize   = 8 * 1024                //客户端单帧最大长度
+	clientSendBufferSize = 64                      //待发送帧缓冲个数，写满后认为客户端过慢并断开
+)
+
+//一个websocket连接
+type Client struct {
+	hub       *Hub
+	uid       int64
+	deviceId  string
+	conn      *websocket.Conn
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	logger    *zap.Logger //带有uid和device_id的logger
+}
+
+func newClient(hub *Hub, uid int64, deviceId string, conn *websocket.Conn, logger *zap.Logger) *Client {
+	return &Client{hub: hub, uid: uid, deviceId: deviceId, conn: conn, send: make(chan []byte, clientSendBufferSize), done: make(chan struct{}), logger: logger}
+}
+
+//将数据放入发送队列，发送队列已满时关闭连接
+func (c *Client) enqueue(data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- data:
+		return true
+	default:
+		c.logger.Named("chat.client").Info("send buffer is full, close it")
+		c.close()
+		return false
+	}
+}
+
+//将数据放入发送队列，发送队列已满时等待，直到超时或者连接关闭
+func (c *Client) enqueueWait(data []byte, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return false
+	case <-timer.C:
+		c.logger.Named("chat.client").Info("wait send buffer timeout, close it")
+		c.close()
+		return false
+	}
+}
+
+//通知writePump发送close帧后关闭连接
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *Client) sendFrame(frame *Frame) bool {
+	data, err := marshalFrame(frame)
+	if err != nil {
+		c.logger.Named("chat.client").Error("marshal frame error", zap.Error(err))
+		return false
+	}
+	return c.enqueue(data)
+}
+
+func (c *Client) sendFrameWait(frame *Frame) bool {
+	data, err := marshalFrame(frame)
+	if err != nil {
+		c.logger.Named("chat.client").Error("marshal frame error", zap.Error(err))
+		return false
+	}
+	return c.enqueueWait(data, clientWriteWait)
+}
+
+func (c *Client) sendError(cid string, code int, msg string) {
+	c.sendFrame(&Frame{Type: FrameTypeError, Cid: cid, Code: code, Msg: msg})
+}
+
+//读取客户端发送的帧，连接断开后从hub中移除
+func (c *Client) readPump(ctx context.Context) {
+	logger := c.logger.Named("chat.client.read")
+	defer func() {
+		c.hub.unregister(c)
+		c.close()
+		_ = c.conn.Close()
+	}()
+	c.conn.SetReadLimit(clientMaxFrameSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(clientPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(clientPongWait))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Error("read error", zap.Error(err))
+			}
+			return
+		}
+		frame, err := unmarshalFrame(data)
+		if err != nil {
+			logger.Error("unmarshal frame error", zap.Error(err))
+			c.sendError("", chatErrorFrameInvalid, "frame must be json")
+			continue
+		}
+		//每一帧是一个独立的trace，和websocket连接的span建立link
+		frameCtx, span := tracing.StartLinked(ctx, "chat.frame "+frame.Type)
+		c.hub.handleFrame(frameCtx, c, frame)
+		span.End()
+	}
+}
+
+//将发送队列中的帧写到连接，并定时发送ping
+func (c *Client) writePump() {
+	logger := c.logger.Named("chat.client.write")
+	ticker := time.NewTicker(clientPingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.conn.Close()
+	}()
+	for {
+		select {
+		case data := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(clientWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				logger.Error("write error", zap.Error(err))
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(clientWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				logger.Error("ping error", zap.Error(err))
+				c.close()
+				return
+			}
+		case <-c.done:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(clientWriteWait))
+			_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package chat
+
+import "encoding/json"
+
+const (
+	FrameTypeMessage = "message" //聊天消息，客户端发送以及服务端投递都使用此类型
+	FrameTypeAck     = "ack"     //服务端发送时确认已保存客户端发送的消息；客户端发送时确认消息已收到或已读
+	FrameTypeStatus  = "status"  //通知发送者消息状态变化
+	FrameTypeError   = "error"   //服务端处理客户端消息失败
+)
+
+const (
+	chatErrorFrameInvalid = iota + 600
+	chatErrorFrameTypeInvalid
+	chatErrorReceiverInvalid
+	chatErrorContentInvalid
+	chatErrorQueryFriendFail
+	chatErrorNotFriend
+	chatErrorSaveMessageFail
+	chatErrorAckInvalid
+	chatErrorAckFail
+	chatErrorQueryGroupFail
+	chatErrorNotGroupMember
+	chatErrorBlocked
+)
+
+//websocket上传输的数据帧，客户端和服务端使用同一结构
+type Frame struct {
+	Type         string `json:"type"`                   //帧类型
+	Cid          string `json:"cid,omitempty"`          //客户端生成的消息id，服务端在ack和error中原样返回
+	Conversation string `json:"conversation,omitempty"` //会话id，由服务端填写
+	Seq          int64  `json:"seq,omitempty"`          //会话内序列号，由服务端填写
+	From         int64  `json:"from,omitempty"`         //发送者uid，由服务端填写
+	To           int64  `json:"to,omitempty"`           //接收者uid，单聊消息有效
+	Gid          int64  `json:"gid,omitempty"`          //群id，群聊消息有效
+	Ctype        uint8  `json:"ctype"`                  //消息内容类型，参考sql.MessageContentType*
+	Content      string `json:"content,omitempty"`      //消息内容
+	Stime        string `json:"stime,omitempty"`        //服务端收到消息的时间
+	Status       uint8  `json:"status,omitempty"`       //消息状态，参考sql.MessageStatus*
+	Code         int    `json:"code,omitempty"`         //错误码，仅error帧有效
+	Msg          string `json:"msg,omitempty"`          //错误信息，仅error帧有效
+}
+
+func marshalFrame(frame *Frame) ([]byte, error) {
+	return json.Marshal(frame)
+}
+
+func unmarshalFrame(data []byte) (*Frame, error) {
+	frame := &Frame{}
+	err := json.Unmarshal(data, frame)
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
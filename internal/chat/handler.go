@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"context"
+	"github.com/liqifyl/chat-go/internal/cache"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/sql"
+	"go.uber.org/zap"
+)
+
+func (h *Hub) handleFrame(ctx context.Context, c *Client, frame *Frame) {
+	switch frame.Type {
+	case FrameTypeMessage:
+		h.handleMessage(ctx, c, frame)
+	case FrameTypeAck:
+		h.handleAck(ctx, c, frame)
+	default:
+		c.sendError(frame.Cid, chatErrorFrameTypeInvalid, "frame type is invalid")
+	}
+}
+
+//处理聊天消息，gid大于0时为群聊消息，否则为单聊消息
+func (h *Hub) handleMessage(ctx context.Context, c *Client, frame *Frame) {
+	if frame.Content == "" || frame.Ctype > sql.MessageContentTypeVideo {
+		c.sendError(frame.Cid, chatErrorContentInvalid, "content or ctype is invalid")
+		return
+	}
+	if frame.Gid > 0 {
+		h.handleGroupMessage(ctx, c, frame)
+		return
+	}
+	h.handleP2PMessage(ctx, c, frame)
+}
+
+//投递消息给uid的所有在线设备，uid没有设备在线时放入离线收件箱
+func (h *Hub) deliverOrPark(ctx context.Context, uid int64, message *sql.Message, cid string) {
+	if h.deliver(uid, messageToFrame(message, cid)) {
+		return
+	}
+	err := cache.PushOfflineMessage(ctx, uid, message)
+	if err != nil {
+		ctxlog.From(ctx).Named("chat.deliver").Error("push to inbox error", zap.String("conversation", message.Conversation), zap.Int64("seq", message.Seq), zap.Int64("receiver", uid), zap.Error(err))
+	}
+}
+
+//处理单聊消息，只有好友之间可以发送；消息保存成功后再投递和ack
+func (h *Hub) handleP2PMessage(ctx context.Context, c *Client, frame *Frame) {
+	logger := ctxlog.From(ctx).Named("chat.message")
+	if frame.To < 1 || frame.To == c.uid {
+		c.sendError(frame.Cid, chatErrorReceiverInvalid, "to is invalid")
+		return
+	}
+	isFriend, err := cache.IsFriend(ctx, c.uid, frame.To)
+	if err != nil {
+		logger.Error("query friend error", zap.Int64("to", frame.To), zap.Error(err))
+		c.sendError(frame.Cid, chatErrorQueryFriendFail, "query friend fail")
+		return
+	}
+	if !isFriend {
+		c.sendError(frame.Cid, chatErrorNotFriend, "to is not friend")
+		return
+	}
+	message := &sql.Message{
+		Conversation: sql.GenerateP2PConversation(c.uid, frame.To),
+		Sender:       c.uid,
+		Receiver:     frame.To,
+		Ctype:        frame.Ctype,
+		Content:      frame.Content,
+	}
+	_, err = cache.SaveMessage(ctx, message)
+	if err == cache.ErrBlocked {
+		c.sendError(frame.Cid, chatErrorBlocked, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("save message error", zap.Int64("to", frame.To), zap.Error(err))
+		c.sendError(frame.Cid, chatErrorSaveMessageFail, "save message fail")
+		return
+	}
+	h.deliverOrPark(ctx, frame.To, message, frame.Cid)
+	h.deliverExcept(c.uid, messageToFrame(message, ""), c)
+	c.sendFrame(&Frame{Type: FrameTypeAck, Cid: frame.Cid, Conversation: message.Conversation, Seq: message.Seq, Stime: message.Stime})
+}
+
+//处理群聊消息，只有群成员可以发送；消息保存一次后扇出给其他所有成员
+func (h *Hub) handleGroupMessage(ctx context.Context, c *Client, frame *Frame) {
+	logger := ctxlog.From(ctx).Named("chat.group.message")
+	members, err := cache.GetGroupMembers(ctx, frame.Gid)
+	if err != nil {
+		logger.Error("query members error", zap.Int64("gid", frame.Gid), zap.Error(err))
+		c.sendError(frame.Cid, chatErrorQueryGroupFail, "query group fail")
+		return
+	}
+	isMember := false
+	for _, member := range members {
+		if member.Uid == c.uid {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		c.sendError(frame.Cid, chatErrorNotGroupMember, "not group member")
+		return
+	}
+	message := &sql.Message{
+		Conversation: sql.GenerateGroupConversation(frame.Gid),
+		Sender:       c.uid,
+		Gid:          frame.Gid,
+		Ctype:        frame.Ctype,
+		Content:      frame.Content,
+	}
+	_, err = cache.SaveMessage(ctx, message)
+	if err != nil {
+		logger.Error("save message error", zap.Int64("gid", frame.Gid), zap.Error(err))
+		c.sendError(frame.Cid, chatErrorSaveMessageFail, "save message fail")
+		return
+	}
+	for _, member := range members {
+		if member.Uid == c.uid {
+			continue
+		}
+		h.deliverOrPark(ctx, member.Uid, message, frame.Cid)
+	}
+	h.deliverExcept(c.uid, messageToFrame(message, ""), c)
+	c.sendFrame(&Frame{Type: FrameTypeAck, Cid: frame.Cid, Conversation: message.Conversation, Seq: message.Seq, Stime: message.Stime})
+}
+
+//处理接收者的消息确认，状态变化后通知发送者
+func (h *Hub) handleAck(ctx context.Context, c *Client, frame *Frame) {
+	logger := ctxlog.From(ctx).Named("chat.ack")
+	if frame.Conversation == "" || frame.Seq < 1 {
+		c.sendError(frame.Cid, chatErrorAckInvalid, "conversation or seq is invalid")
+		return
+	}
+	if frame.Status != sql.MessageStatusDelivered && frame.Status != sql.MessageStatusRead {
+		c.sendError(frame.Cid, chatErrorAckInvalid, "status is invalid")
+		return
+	}
+	message, err := cache.AckMessage(ctx, c.uid, frame.Conversation, frame.Seq, frame.Status)
+	if err != nil {
+		logger.Error("ack error", zap.String("conversation", frame.Conversation), zap.Int64("seq", frame.Seq), zap.Error(err))
+		c.sendError(frame.Cid, chatErrorAckFail, "ack fail")
+		return
+	}
+	if message == nil {
+		return
+	}
+	h.deliver(message.Sender, &Frame{Type: FrameTypeStatus, Conversation: message.Conversation, Seq: message.Seq, Status: message.Status})
+}
+
+//投递离线收件箱中的消息，收件箱中的消息在客户端ack后移除；
+//多个设备同时在线时每个设备都会收到，其他设备通过query/messages同步历史消息
+func (h *Hub) flushOfflineMessages(ctx context.Context, c *Client) {
+	logger := ctxlog.From(ctx).Named("chat.flush")
+	var afterId int64
+	for {
+		messages, err := cache.GetOfflineMessages(ctx, c.uid, afterId, clientSendBufferSize)
+		if err != nil {
+			logger.Error("get inbox error", zap.Error(err))
+			return
+		}
+		if len(messages) == 0 {
+			return
+		}
+		for _, message := range messages {
+			if !c.sendFrameWait(messageToFrame(message, "")) {
+				return
+			}
+			afterId = message.Id
+		}
+	}
+}
+
+func messageToFrame(message *sql.Message, cid string) *Frame {
+	return &Frame{
+		Type:         FrameTypeMessage,
+		Cid:          cid,
+		Conversation: message.Conversation,
+		Seq:          message.Seq,
+		From:         message.Sender,
+		To:           message.Receiver,
+		Gid:          message.Gid,
+		Ctype:        message.Ctype,
+		Content:      message.Content,
+		Stime:        message.Stime,
+		Status:       message.Status,
+	}
+}
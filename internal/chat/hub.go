@@ -0,0 +1,181 @@
+package chat
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/metrics"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultHub = NewHub()
+)
+
+//在线连接注册表，每个uid的每个设备对应一个连接
+type Hub struct {
+	lock     sync.RWMutex
+	clients  map[int64]map[string]*Client
+	sessions sync.WaitGroup //正在处理的连接，关闭时等待全部结束
+	closing  bool           //关闭后不再接受新的连接
+}
+
+func NewHub() *Hub {
+	return &Hub{clients: make(map[int64]map[string]*Client)}
+}
+
+//为已通过token校验的uid设备处理websocket连接，直到连接断开才返回
+func (h *Hub) Serve(ctx context.Context, uid int64, deviceId string, conn *websocket.Conn) {
+	ctx = ctxlog.With(ctx, zap.String("device_id", deviceId))
+	c := newClient(h, uid, deviceId, conn, ctxlog.From(ctx))
+	if !h.register(c) {
+		c.logger.Named("chat.hub").Info("rejected, hub is shutting down")
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"), time.Now().Add(clientWriteWait))
+		_ = conn.Close()
+		return
+	}
+	defer h.sessions.Done()
+	go c.writePump()
+	go h.flushOfflineMessages(ctx, c)
+	c.readPump(ctx)
+}
+
+//注册连接，同一个设备的旧连接会被关闭；hub已经关闭时返回false
+func (h *Hub) register(c *Client) bool {
+	h.lock.Lock()
+	if h.closing {
+		h.lock.Unlock()
+		return false
+	}
+	h.sessions.Add(1)
+	devices := h.clients[c.uid]
+	if devices == nil {
+		devices = make(map[string]*Client)
+		h.clients[c.uid] = devices
+		metrics.ChatOnlineUsers.Inc()
+	}
+	old := devices[c.deviceId]
+	devices[c.deviceId] = c
+	if old == nil {
+		metrics.ChatConnections.Inc()
+	}
+	h.lock.Unlock()
+	if old != nil {
+		c.logger.Named("chat.hub").Info("connected again, close old connection")
+		old.close()
+	}
+	return true
+}
+
+func (h *Hub) unregister(c *Client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	devices := h.clients[c.uid]
+	if devices[c.deviceId] != c {
+		return
+	}
+	delete(devices, c.deviceId)
+	metrics.ChatConnections.Dec()
+	if len(devices) == 0 {
+		delete(h.clients, c.uid)
+		metrics.ChatOnlineUsers.Dec()
+	}
+}
+
+//uid是否有设备在线
+func (h *Hub) IsOnline(uid int64) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.clients[uid]) > 0
+}
+
+//获取uid在线的连接，except不为nil时排除该连接
+func (h *Hub) clientsOf(uid int64, except *Client) []*Client {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	devices := h.clients[uid]
+	clients := make([]*Client, 0, len(devices))
+	for _, c := range devices {
+		if c != except {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+//投递帧到uid所有设备的连接，没有任何设备投递成功返回false
+func (h *Hub) deliver(uid int64, frame *Frame) bool {
+	return h.deliverExcept(uid, frame, nil)
+}
+
+//投递帧到uid除except之外所有设备的连接，用于同步发送者在其他设备上发出的消息
+func (h *Hub) deliverExcept(uid int64, frame *Frame, except *Client) bool {
+	delivered := false
+	for _, c := range h.clientsOf(uid, except) {
+		if c.sendFrame(frame) {
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+//断开uid在deviceId上的连接，会话被删除后调用
+func (h *Hub) KickDevice(uid int64, deviceId string) {
+	h.lock.RLock()
+	c := h.clients[uid][deviceId]
+	h.lock.RUnlock()
+	if c != nil {
+		c.logger.Named("chat.hub").Info("kick")
+		c.close()
+	}
+}
+
+//断开uid所有设备的连接
+func (h *Hub) KickUser(uid int64) {
+	for _, c := range h.clientsOf(uid, nil) {
+		c.logger.Named("chat.hub").Info("kick")
+		c.close()
+	}
+}
+
+//关闭hub：不再接受新的连接，通知所有连接关闭并等待连接处理结束；ctx到期后强制断开剩余连接
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.lock.Lock()
+	h.closing = true
+	h.lock.Unlock()
+	clients := h.clientsOfAll()
+	ctxlog.From(ctx).Named("chat.hub").Info("shutdown, close connections", zap.Int("clients", len(clients)))
+	for _, c := range clients {
+		c.close()
+	}
+	drained := make(chan struct{})
+	go func() {
+		h.sessions.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		for _, c := range h.clientsOfAll() {
+			_ = c.conn.Close()
+		}
+		<-drained
+		return ctx.Err()
+	}
+}
+
+//获取所有在线的连接
+func (h *Hub) clientsOfAll() []*Client {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var clients []*Client
+	for _, devices := range h.clients {
+		for _, c := range devices {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
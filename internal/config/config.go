@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type GinServerConfig struct {
 	UserImageSaveDir        string
 	HostName                string
@@ -9,4 +11,17 @@ type GinServerConfig struct {
 	RedisServerAddress      string
 	RedisServerPwd          string
 	RedisSelectDB           int
-}
\ No newline at end of file
+	TokenKeys               []TokenKeyConfig //签名token的密钥，为空时使用进程内随机生成的HS256密钥
+	TokenSigningKid         string           //签发新token使用的密钥kid，为空时使用第一个可以签名的密钥
+	BuildVersion            string           //编译时注入的版本号
+	ShutdownTimeout         time.Duration    //收到退出信号后等待进行中的请求和websocket连接结束的最长时间
+}
+
+//token签名密钥；轮换时新旧密钥同时配置，旧密钥只保留公钥或者不再作为TokenSigningKid，直到旧token全部过期
+type TokenKeyConfig struct {
+	Kid            string `yaml:"kid"`              //密钥id，写入token的kid头
+	Alg            string `yaml:"alg"`              //HS256、RS256或者EdDSA
+	Secret         string `yaml:"secret"`           //HS256的密钥，至少32字节
+	PrivateKeyFile string `yaml:"private_key_file"` //RS256/EdDSA的PEM私钥，可以签发和校验
+	PublicKeyFile  string `yaml:"public_key_file"`  //RS256/EdDSA的PEM公钥，只能校验
+}
@@ -1,25 +1,98 @@
 package gin
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	v1 "github.com/liqifyl/chat-go/internal/api/v1"
 	"github.com/liqifyl/chat-go/internal/cache"
+	"github.com/liqifyl/chat-go/internal/chat"
 	"github.com/liqifyl/chat-go/internal/config"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/metrics"
 	"github.com/liqifyl/chat-go/internal/sql"
+	"github.com/liqifyl/chat-go/internal/tracing"
+	"go.uber.org/zap"
+	"net/http"
 )
 
-func StartGinServer(config config.GinServerConfig) {
-	r := gin.Default()
+//handler panic时记录日志并返回500
+func recovery(c *gin.Context, recovered interface{}) {
+	ctxlog.From(c.Request.Context()).Named("gin.recovery").Error("panic", zap.Any("recovered", recovered), zap.Stack("stack"))
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+//启动http服务，ctx结束后停止接受新的连接，在config.ShutdownTimeout内等待进行中的请求和websocket连接结束，
+//最后关闭数据库连接池和redis客户端
+func StartGinServer(ctx context.Context, config config.GinServerConfig) error {
+	r := gin.New()
+	r.Use(tracing.GinMiddleware()...)
+	r.Use(v1.RequestLogMiddleware(), gin.CustomRecovery(recovery))
+	r.Use(metrics.GinMiddleware())
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
 	cache.CacheDefaultRedisClientConfig.Addr = config.RedisServerAddress
 	cache.CacheDefaultRedisClientConfig.Pwd = config.RedisServerPwd
 	cache.CacheDefaultRedisClientConfig.Db = config.RedisSelectDB
 	sql.DefaultDbConfig.DriveName = "mysql"
 	sql.DefaultDbConfig.DataSourceName = config.MysqlChatDataSourceName
+	//需要认证的接口都注册到这个路由组，handler从gin.Context中获取认证的uid
+	auth := r.Group("/", v1.AuthMiddleware(config.TestUid))
 	userV1Api := v1.NewUserV1API(config)
-	userV1Api.RegisterUserRestfulAPI(r)
+	userV1Api.RegisterUserRestfulAPI(r, auth)
 	friendV1Api := v1.NewFriendV1API(config)
-	friendV1Api.RegisterFriendApi(r)
+	friendV1Api.RegisterFriendApi(auth)
+	friendCircleV1Api := v1.NewFriendCircleV1API(config)
+	friendCircleV1Api.RegisterFriendCircleApi(auth)
+	chatV1Api := v1.NewChatV1API(config)
+	chatV1Api.RegisterChatApi(auth)
+	groupV1Api := v1.NewGroupV1API(config)
+	groupV1Api.RegisterGroupApi(auth)
+	jwksV1Api := v1.NewJwksV1API(config)
+	jwksV1Api.RegisterJwksApi(r)
+	healthV1Api := v1.NewHealthV1API(config)
+	healthV1Api.RegisterHealthApi(r)
 	listenAddr := fmt.Sprintf("%s:%s", config.HostName, config.Port)
-	r.Run(listenAddr)
+	server := &http.Server{Addr: listenAddr, Handler: r}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		closeStores()
+		return err
+	case <-ctx.Done():
+	}
+	ctxlog.From(ctx).Named("gin.shutdown").Info("draining", zap.Duration("timeout", config.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	//websocket连接已经被hijack，http.Server.Shutdown不会等待它们，由hub负责关闭
+	hubDrained := make(chan error, 1)
+	server.RegisterOnShutdown(func() {
+		hubDrained <- chat.DefaultHub.Shutdown(shutdownCtx)
+	})
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		ctxlog.From(ctx).Named("gin.shutdown").Error("http error", zap.Error(err))
+		_ = server.Close()
+	}
+	hubErr := <-hubDrained
+	if hubErr != nil {
+		ctxlog.From(ctx).Named("gin.shutdown").Error("chat hub error", zap.Error(hubErr))
+	}
+	closeStores()
+	ctxlog.From(ctx).Named("gin.shutdown").Info("done")
+	return err
+}
+
+//关闭数据库连接池和redis客户端
+func closeStores() {
+	err := sql.CloseDbs()
+	if err != nil {
+		zap.L().Named("gin.shutdown").Error("close db error", zap.Error(err))
+	}
+	err = cache.CloseRedisClients()
+	if err != nil {
+		zap.L().Named("gin.shutdown").Error("close redis error", zap.Error(err))
+	}
 }
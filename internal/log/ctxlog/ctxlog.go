@@ -0,0 +1,36 @@
+package ctxlog
+
+import (
+	"context"
+	"github.com/liqifyl/chat-go/internal/tracing"
+	"go.uber.org/zap"
+)
+
+type loggerKey struct{}
+
+//把logger保存到ctx中，handler、cache和sql通过ctx拿到带有request_id、uid、route等字段的logger
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+//给ctx中的logger加上字段，返回新的ctx
+func With(ctx context.Context, fields ...zap.Field) context.Context {
+	return WithLogger(ctx, base(ctx).With(fields...))
+}
+
+func base(ctx context.Context) *zap.Logger {
+	if logger, found := ctx.Value(loggerKey{}).(*zap.Logger); found {
+		return logger
+	}
+	return zap.L()
+}
+
+//ctx中的logger，没有时使用全局logger；ctx中有span时加上trace_id和span_id
+func From(ctx context.Context) *zap.Logger {
+	logger := base(ctx)
+	fields := tracing.ZapFields(ctx)
+	if len(fields) == 0 {
+		return logger
+	}
+	return logger.With(fields...)
+}
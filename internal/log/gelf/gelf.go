@@ -2,24 +2,60 @@ package gelf
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/adler32"
+	"io"
 	"log"
-	"math"
 	"net"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 const (
-	defaultMaxChunkSize = 1420
+	defaultMaxChunkSize    = 1420
+	defaultQueueSize       = 4096
+	defaultResolveInterval = 5 * time.Minute
+	defaultBatchSize       = 1
+	defaultFlushTimeout    = 5 * time.Second
+	minReconnectBackoff    = 100 * time.Millisecond
+	maxReconnectBackoff    = 30 * time.Second
+	maxWriteRetries        = 8 //一条消息最多重试的次数，重试间隔从minReconnectBackoff开始翻倍
+)
+
+//发送方式
+const (
+	TransportUDP   = "udp"   //按Config.Compression压缩，超过MaxChunkSize时分块，默认
+	TransportTCP   = "tcp"   //不压缩，每条消息以\0结尾
+	TransportTLS   = "tls"   //同TCP，使用TLS加密
+	TransportHTTP  = "http"  //POST到/gelf，默认一次请求发送一条消息
+	TransportHTTPS = "https" //同HTTP，使用TLS加密
+)
+
+//udp消息的压缩方式
+const (
+	CompressionZlib = "zlib" //默认
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+//队列满时的处理方式
+const (
+	DropOldest = "oldest" //丢弃队列中最早的消息，默认
+	DropNewest = "newest" //丢弃新的消息
+	Block      = "block"  //阻塞调用者直到队列有空位
 )
 
 var (
+	errFlushTimeout = errors.New("gelf flush timeout")
+
 	hh = func() []byte {
 		id := make([]byte, adler32.Size)
 		hash := adler32.New()
@@ -35,13 +71,40 @@ var (
 )
 
 type Config struct {
-	GraylogAddr  string
-	MaxChunkSize int
+	GraylogAddr     string
+	Transport       string      //TransportUDP、TransportTCP、TransportTLS、TransportHTTP或者TransportHTTPS，默认TransportUDP
+	TLSConfig       *tls.Config //TransportTLS和TransportHTTPS使用，为nil时使用系统根证书校验graylog证书
+	Compression     string      //TransportUDP的压缩方式，CompressionZlib、CompressionGzip或者CompressionNone，默认CompressionZlib
+	BatchSize       int         //TransportHTTP和TransportHTTPS一次请求最多发送的消息数，以\n分隔，默认1；大于1时graylog input需要开启bulk receiving
+	MaxChunkSize    int
+	QueueSize       int           //待发送消息队列长度，默认4096
+	DropPolicy      string        //队列满时的处理方式，DropOldest、DropNewest或者Block，默认DropOldest
+	ResolveInterval time.Duration //重新解析GraylogAddr的间隔，默认5分钟
+	FlushTimeout    time.Duration //Flush和Close等待发送的最长时间，默认5秒
+}
+
+//发送统计，按消息计数，一条消息可能拆分为多个udp包；Errors为发送失败次数，tcp、http重连后重试成功的消息不计入Dropped
+type Stats struct {
+	Sent    uint64
+	Dropped uint64
+	Errors  uint64
+	Queued  int
 }
 
+//后台goroutine从队列中取出消息，通过复用的连接发送到graylog，Log不会阻塞在网络上(Block策略队列满时除外)
 type Gelf struct {
+	sent    uint64 //atomic计数放在最前面，保证32位平台上64位对齐
+	dropped uint64
+	errors  uint64
+
 	Config
-	addr atomic.Value
+	transport transport
+	downUntil time.Time //graylog不可用时在这个时间之前直接丢弃消息，只在发送goroutine中使用
+	queue     chan []byte
+	flushes   chan chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	once      sync.Once
 }
 
 func New(config Config) *Gelf {
@@ -52,65 +115,256 @@ func New(config Config) *Gelf {
 	if config.MaxChunkSize == 0 {
 		config.MaxChunkSize = defaultMaxChunkSize
 	}
-
-	addr, err := net.ResolveUDPAddr("udp", config.GraylogAddr)
-	if err != nil {
-		panic(err)
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
 	}
-
-	_, err = net.DialUDP("udp", nil, addr)
-	if err != nil {
-		panic(err)
+	if config.DropPolicy == "" {
+		config.DropPolicy = DropOldest
+	}
+	if config.ResolveInterval <= 0 {
+		config.ResolveInterval = defaultResolveInterval
+	}
+	if config.FlushTimeout <= 0 {
+		config.FlushTimeout = defaultFlushTimeout
+	}
+	if config.Transport == "" {
+		config.Transport = TransportUDP
+	}
+	if config.Compression == "" {
+		config.Compression = CompressionZlib
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
 	}
 
 	g := &Gelf{
-		Config: config,
+		Config:  config,
+		queue:   make(chan []byte, config.QueueSize),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	switch config.Compression {
+	case CompressionZlib, CompressionGzip, CompressionNone:
+	default:
+		panic("unknown graylog compression " + config.Compression)
+	}
+	switch config.Transport {
+	case TransportUDP:
+		g.transport = &udpTransport{g: g}
+	case TransportTCP:
+		g.transport = &tcpTransport{addr: config.GraylogAddr}
+	case TransportTLS:
+		tlsConfig := config.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		g.transport = &tcpTransport{addr: config.GraylogAddr, tlsConfig: tlsConfig}
+	case TransportHTTP, TransportHTTPS:
+		g.transport = newHTTPTransport(config)
+	default:
+		panic("unknown graylog transport " + config.Transport)
 	}
 
-	g.addr.Store(addr)
+	//解析失败时在发送时重试，graylog暂时不可用不影响启动
+	if err := g.transport.resolve(); err != nil {
+		log.Printf("gelf resolve %s failed: %v", config.GraylogAddr, err)
+	}
 
-	//go func() {
-	//	t := time.NewTicker(5 * time.Minute)
-	//	defer t.Stop()
-	//	for range t.C {
-	//		if addr, err := net.ResolveUDPAddr("udp", config.GraylogAddr); err == nil {
-	//			g.addr.Store(addr)
-	//		}
-	//	}
-	//}()
+	go g.run()
 
 	return g
 }
 
+//将消息放入发送队列，message会被复制
 func (g *Gelf) Log(message []byte) {
-
-	conn, err := net.DialUDP("udp", nil, g.addr.Load().(*net.UDPAddr))
-	if err != nil {
-		fmt.Printf("write udp failed: %v", err)
+	select {
+	case <-g.done:
+		atomic.AddUint64(&g.dropped, 1)
 		return
+	default:
 	}
+	m := make([]byte, len(message))
+	copy(m, message)
+
+	switch g.Config.DropPolicy {
+	case Block:
+		select {
+		case g.queue <- m:
+		case <-g.done:
+			atomic.AddUint64(&g.dropped, 1)
+		}
+	case DropNewest:
+		select {
+		case g.queue <- m:
+		default:
+			atomic.AddUint64(&g.dropped, 1)
+		}
+	default:
+		for {
+			select {
+			case g.queue <- m:
+				return
+			default:
+			}
+			select {
+			case <-g.queue:
+				atomic.AddUint64(&g.dropped, 1)
+			default:
+			}
+		}
+	}
+}
 
-	defer conn.Close()
+//发送goroutine，定时重新解析地址，地址变化后重新建立连接
+func (g *Gelf) run() {
+	defer close(g.stopped)
+	t := time.NewTicker(g.Config.ResolveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case m := <-g.queue:
+			g.write(g.batch(m))
+		case ack := <-g.flushes:
+			g.drain()
+			close(ack)
+		case <-t.C:
+			if err := g.transport.resolve(); err != nil {
+				log.Printf("gelf resolve %s failed: %v", g.Config.GraylogAddr, err)
+			}
+		case <-g.done:
+			g.drain()
+			g.transport.close()
+			return
+		}
+	}
+}
 
-	compressed := g.Compress(message)
-	chunksize := g.Config.MaxChunkSize
-	length := compressed.Len()
+//发送队列中当前所有的消息
+func (g *Gelf) drain() {
+	for {
+		select {
+		case m := <-g.queue:
+			g.write(g.batch(m))
+		default:
+			return
+		}
+	}
+}
 
-	if length > chunksize {
+//transport支持批量发送时，再从队列中取出已有的消息，不等待新的消息
+func (g *Gelf) batch(m []byte) [][]byte {
+	messages := [][]byte{m}
+	for len(messages) < g.transport.batchSize() {
+		select {
+		case m := <-g.queue:
+			messages = append(messages, m)
+		default:
+			return messages
+		}
+	}
+	return messages
+}
 
-		chunkCountInt := int(math.Ceil(float64(length) / float64(chunksize)))
+//发送一批消息；tcp、http连接失败时按指数退避重连，最多重试maxWriteRetries次，关闭过程中只立即重连一次，udp失败时丢弃。
+//重试用完后认为graylog不可用，之后maxReconnectBackoff内的消息直接丢弃，到时间后只尝试发送一次，成功后恢复，
+//队列不会因为graylog不可用而一直阻塞
+func (g *Gelf) write(messages [][]byte) {
+	//zap编码的每条消息以\n结尾，去掉后再拼接，避免批量请求中出现空行
+	message := bytes.TrimRight(messages[0], "\n")
+	if len(messages) > 1 {
+		lines := make([][]byte, len(messages))
+		for i, m := range messages {
+			lines[i] = bytes.TrimRight(m, "\n")
+		}
+		message = bytes.Join(lines, []byte{'\n'})
+	}
+	count := uint64(len(messages))
+	down := !g.downUntil.IsZero()
+	if down && time.Now().Before(g.downUntil) {
+		atomic.AddUint64(&g.dropped, count)
+		return
+	}
+	backoff := minReconnectBackoff
+	for retries := 0; ; retries++ {
+		err := g.transport.write(message)
+		if err == nil {
+			atomic.AddUint64(&g.sent, count)
+			g.downUntil = time.Time{}
+			return
+		}
+		atomic.AddUint64(&g.errors, 1)
+		if !g.transport.retryable(err) {
+			atomic.AddUint64(&g.dropped, count)
+			return
+		}
+		if down || retries >= maxWriteRetries {
+			log.Printf("gelf write to %s failed, drop messages for %v: %v", g.Config.GraylogAddr, maxReconnectBackoff, err)
+			atomic.AddUint64(&g.dropped, count)
+			g.downUntil = time.Now().Add(maxReconnectBackoff)
+			return
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-g.done:
+			timer.Stop()
+			//关闭过程中再立即重连一次，仍然失败时丢弃队列中剩余的消息
+			if retries > 0 {
+				atomic.AddUint64(&g.dropped, count)
+				g.downUntil = time.Now().Add(maxReconnectBackoff)
+				return
+			}
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
 
-		id := make([]byte, 8)
-		binary.BigEndian.PutUint64(id, uint64(time.Now().UnixNano()))
-		copy(id[:4], hh[:4])
+//等待调用Flush之前放入队列的消息发送完，最多等待FlushTimeout
+func (g *Gelf) Flush() error {
+	timer := time.NewTimer(g.Config.FlushTimeout)
+	defer timer.Stop()
+	ack := make(chan struct{})
+	select {
+	case g.flushes <- ack:
+	case <-g.done:
+		return nil
+	case <-timer.C:
+		return errFlushTimeout
+	}
+	select {
+	case <-ack:
+	case <-g.stopped:
+	case <-timer.C:
+		return errFlushTimeout
+	}
+	return nil
+}
 
-		for i, index := 0, 0; i < length; i, index = i+chunksize, index+1 {
-			packet := g.CreateChunkedMessage(index, chunkCountInt, id, compressed)
-			g.Send(conn, packet.Bytes())
-		}
+//发送队列中剩余的消息后停止发送goroutine，之后的消息都会被丢弃；最多等待FlushTimeout，超时后发送goroutine在后台结束
+func (g *Gelf) Close() error {
+	g.once.Do(func() {
+		close(g.done)
+	})
+	timer := time.NewTimer(g.Config.FlushTimeout)
+	defer timer.Stop()
+	select {
+	case <-g.stopped:
+	case <-timer.C:
+		return errFlushTimeout
+	}
+	return nil
+}
 
-	} else {
-		g.Send(conn, compressed.Bytes())
+func (g *Gelf) Stats() Stats {
+	return Stats{
+		Sent:    atomic.LoadUint64(&g.sent),
+		Dropped: atomic.LoadUint64(&g.dropped),
+		Errors:  atomic.LoadUint64(&g.errors),
+		Queued:  len(g.queue),
 	}
 }
 
@@ -145,10 +399,20 @@ func (g *Gelf) IntToBytes(i int) []byte {
 	return buf.Bytes()
 }
 
+//按Config.Compression压缩
 func (g *Gelf) Compress(b []byte) *bytes.Buffer {
 
 	buf := new(bytes.Buffer)
-	comp := zlib.NewWriter(buf)
+	var comp io.WriteCloser
+	switch g.Config.Compression {
+	case CompressionNone:
+		buf.Write(b)
+		return buf
+	case CompressionGzip:
+		comp = gzip.NewWriter(buf)
+	default:
+		comp = zlib.NewWriter(buf)
+	}
 
 	comp.Write(b)
 	comp.Close()
@@ -156,10 +420,11 @@ func (g *Gelf) Compress(b []byte) *bytes.Buffer {
 	return buf
 }
 
-func (g *Gelf) Send(conn net.Conn, b []byte) {
+func (g *Gelf) Send(conn net.Conn, b []byte) error {
 
 	_, err := conn.Write(b)
 	if err != nil {
 		fmt.Printf("write udp failed: %v", err)
 	}
+	return err
 }
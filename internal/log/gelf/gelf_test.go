@@ -0,0 +1,249 @@
+package gelf_test
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liqifyl/chat-go/internal/log/gelf"
+	"github.com/liqifyl/chat-go/internal/log/gelf/gelftest"
+)
+
+func newServer(t *testing.T, transport string) *gelftest.Server {
+	t.Helper()
+	var server *gelftest.Server
+	var err error
+	switch transport {
+	case gelf.TransportUDP:
+		server, err = gelftest.NewUDPServer()
+	case gelf.TransportTCP:
+		server, err = gelftest.NewTCPServer()
+	case gelf.TransportTLS:
+		server, err = gelftest.NewTLSServer()
+	case gelf.TransportHTTP:
+		server, err = gelftest.NewHTTPServer()
+	case gelf.TransportHTTPS:
+		server, err = gelftest.NewHTTPSServer()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return server
+}
+
+func message(shortMessage string) []byte {
+	return []byte(fmt.Sprintf(`{"version":"1.1","host":"test","short_message":%q}`, shortMessage))
+}
+
+//不可压缩的随机内容，压缩后仍然超过MaxChunkSize
+func randomString(t *testing.T, n int) string {
+	t.Helper()
+	b := make([]byte, n/2)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func waitMessages(t *testing.T, server *gelftest.Server, want []string) {
+	t.Helper()
+	messages, err := server.Wait(len(want), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, m := range messages {
+		got[fmt.Sprint(m["short_message"])] = true
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Errorf("message %.20s... is not received", w)
+		}
+	}
+}
+
+func TestTransports(t *testing.T) {
+	for _, transport := range []string{gelf.TransportUDP, gelf.TransportTCP, gelf.TransportTLS, gelf.TransportHTTP, gelf.TransportHTTPS} {
+		t.Run(transport, func(t *testing.T) {
+			server := newServer(t, transport)
+			g := gelf.New(gelf.Config{GraylogAddr: server.Addr, Transport: transport, TLSConfig: server.ClientTLSConfig()})
+			want := []string{"first", "second", randomString(t, 8000)}
+			for _, w := range want {
+				g.Log(message(w))
+			}
+			if err := g.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			waitMessages(t, server, want)
+			if err := g.Close(); err != nil {
+				t.Fatal(err)
+			}
+			stats := g.Stats()
+			if stats.Sent != uint64(len(want)) || stats.Dropped != 0 || stats.Queued != 0 {
+				t.Errorf("stats is %+v", stats)
+			}
+		})
+	}
+}
+
+func TestUDPCompression(t *testing.T) {
+	for _, compression := range []string{gelf.CompressionZlib, gelf.CompressionGzip, gelf.CompressionNone} {
+		t.Run(compression, func(t *testing.T) {
+			server := newServer(t, gelf.TransportUDP)
+			g := gelf.New(gelf.Config{GraylogAddr: server.Addr, Compression: compression})
+			defer g.Close()
+			want := []string{"small", randomString(t, 4000)}
+			for _, w := range want {
+				g.Log(message(w))
+			}
+			waitMessages(t, server, want)
+		})
+	}
+}
+
+//默认一次请求一条消息；BatchSize大于1时按批发送，zap编码的消息以\n结尾，拼接后不能有空行
+func TestHTTPBatch(t *testing.T) {
+	for _, batchSize := range []int{0, 10} {
+		t.Run(fmt.Sprint(batchSize), func(t *testing.T) {
+			server := newServer(t, gelf.TransportHTTP)
+			g := gelf.New(gelf.Config{GraylogAddr: server.Addr, Transport: gelf.TransportHTTP, BatchSize: batchSize, QueueSize: 100})
+			var want []string
+			for i := 0; i < 30; i++ {
+				w := fmt.Sprintf("m%d", i)
+				want = append(want, w)
+				g.Log(append(message(w), '\n'))
+			}
+			if err := g.Close(); err != nil {
+				t.Fatal(err)
+			}
+			waitMessages(t, server, want)
+			stats := g.Stats()
+			if stats.Sent != 30 || stats.Dropped != 0 {
+				t.Errorf("stats is %+v", stats)
+			}
+			requests := server.Requests()
+			if batchSize == 0 && requests != 30 {
+				t.Errorf("requests is %d, want 30", requests)
+			}
+			if batchSize > 1 && requests >= 30 {
+				t.Errorf("requests is %d, want batches", requests)
+			}
+		})
+	}
+}
+
+func TestHTTPClientErrorIsNotRetried(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	g := gelf.New(gelf.Config{GraylogAddr: server.Listener.Addr().String(), Transport: gelf.TransportHTTP})
+	g.Log(message("bad"))
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := g.Stats(); stats.Errors != 1 || stats.Dropped != 1 {
+		t.Errorf("stats is %+v", stats)
+	}
+}
+
+func TestUDPChunking(t *testing.T) {
+	server := newServer(t, gelf.TransportUDP)
+	g := gelf.New(gelf.Config{GraylogAddr: server.Addr, MaxChunkSize: 200})
+	defer g.Close()
+	large := randomString(t, 3000)
+	g.Log(message(large))
+	g.Log(message("small"))
+	waitMessages(t, server, []string{large, "small"})
+}
+
+//graylog重启后重新连接，断开前后的消息都能收到
+func TestReconnect(t *testing.T) {
+	for _, transport := range []string{gelf.TransportTCP, gelf.TransportTLS, gelf.TransportHTTP} {
+		t.Run(transport, func(t *testing.T) {
+			server := newServer(t, transport)
+			g := gelf.New(gelf.Config{GraylogAddr: server.Addr, Transport: transport, TLSConfig: server.ClientTLSConfig()})
+			defer g.Close()
+			g.Log(message("before"))
+			if err := g.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			waitMessages(t, server, []string{"before"})
+			server.CloseConns()
+			time.Sleep(50 * time.Millisecond)
+			want := []string{"before"}
+			for i := 0; i < 10; i++ {
+				w := fmt.Sprintf("after-%d", i)
+				want = append(want, w)
+				g.Log(message(w))
+			}
+			waitMessages(t, server, want)
+		})
+	}
+}
+
+//返回一个没有监听的地址
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+//graylog不可用时按退避重试，Flush超时返回，Close丢弃剩余的消息后返回
+func TestFlushAndCloseReturnWhenReceiverIsDown(t *testing.T) {
+	g := gelf.New(gelf.Config{GraylogAddr: closedAddr(t), Transport: gelf.TransportTCP, FlushTimeout: 500 * time.Millisecond})
+	for i := 0; i < 100; i++ {
+		g.Log(message(fmt.Sprintf("m%d", i)))
+	}
+	start := time.Now()
+	if err := g.Flush(); err == nil {
+		t.Error("flush should time out when receiver is down")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("flush took %v", elapsed)
+	}
+	if stats := g.Stats(); stats.Errors < 2 || stats.Sent != 0 {
+		t.Errorf("stats is %+v, want retries with backoff", stats)
+	}
+	start = time.Now()
+	if err := g.Close(); err != nil {
+		t.Error(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("close took %v", elapsed)
+	}
+	stats := g.Stats()
+	if stats.Sent != 0 || stats.Dropped != 100 || stats.Queued != 0 {
+		t.Errorf("stats is %+v", stats)
+	}
+	g.Log(message("after close"))
+	if stats := g.Stats(); stats.Dropped != 101 {
+		t.Errorf("stats is %+v", stats)
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	g := gelf.New(gelf.Config{GraylogAddr: closedAddr(t), Transport: gelf.TransportTCP, QueueSize: 2, DropPolicy: gelf.DropNewest, FlushTimeout: 100 * time.Millisecond})
+	for i := 0; i < 10; i++ {
+		g.Log(message(fmt.Sprintf("m%d", i)))
+	}
+	//第一条消息在发送goroutine中重试，队列中最多2条
+	if stats := g.Stats(); stats.Dropped < 7 {
+		t.Errorf("stats is %+v", stats)
+	}
+	_ = g.Close()
+	if stats := g.Stats(); stats.Dropped != 10 {
+		t.Errorf("stats is %+v", stats)
+	}
+}
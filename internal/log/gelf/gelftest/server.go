@@ -0,0 +1,397 @@
+package gelftest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	chunkMagic0    = 0x1e
+	chunkMagic1    = 0x0f
+	chunkHeaderLen = 12
+	maxPacketSize  = 65536
+)
+
+//收到的一条gelf消息
+type Message map[string]interface{}
+
+//进程内的gelf接收端，监听127.0.0.1的随机端口，用来验证发送到graylog的日志
+type Server struct {
+	URL  string //带有协议的地址，例如tcp://127.0.0.1:12201，可以直接作为log.graylog-address
+	Addr string //host:port
+
+	lock     sync.Mutex
+	messages []Message
+	requests int
+	notify   chan struct{}
+	chunks   map[string][][]byte
+	conns    map[net.Conn]bool
+	packet   net.PacketConn
+	listener net.Listener
+	http     *http.Server
+	certPool *x509.CertPool
+	wg       sync.WaitGroup
+}
+
+func newServer() *Server {
+	return &Server{notify: make(chan struct{}, 1), chunks: make(map[string][][]byte), conns: make(map[net.Conn]bool)}
+}
+
+//接收udp gelf，支持zlib、gzip压缩以及分块的消息
+func NewUDPServer() (*Server, error) {
+	s := newServer()
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.packet = packet
+	s.Addr = packet.LocalAddr().String()
+	s.URL = "udp://" + s.Addr
+	s.wg.Add(1)
+	go s.servePacket()
+	return s, nil
+}
+
+//接收tcp gelf，每条消息以\0结尾
+func NewTCPServer() (*Server, error) {
+	s := newServer()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.start(listener, "tcp")
+	return s, nil
+}
+
+//接收tls gelf，使用启动时生成的自签名证书，客户端通过ClientTLSConfig信任该证书
+func NewTLSServer() (*Server, error) {
+	s := newServer()
+	cert, err := s.generateCert()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	s.start(listener, "tls")
+	return s, nil
+}
+
+//接收http gelf，POST /gelf，支持以\n分隔的多条消息以及gzip、deflate Content-Encoding；
+//请求中间有空行时返回400，用来发现拼接错误的批量请求
+func NewHTTPServer() (*Server, error) {
+	s := newServer()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.startHTTP(listener, "http")
+	return s, nil
+}
+
+//接收https gelf，证书同NewTLSServer
+func NewHTTPSServer() (*Server, error) {
+	s := newServer()
+	cert, err := s.generateCert()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	s.startHTTP(listener, "https")
+	return s, nil
+}
+
+func (s *Server) startHTTP(listener net.Listener, scheme string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gelf", s.serveHTTP)
+	s.http = &http.Server{Handler: mux}
+	s.Addr = listener.Addr().String()
+	s.URL = scheme + "://" + s.Addr
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		_ = s.http.Serve(listener)
+	}()
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	//Content-Encoding为deflate时是zlib格式，和gzip一样由decompress按内容识别
+	content, err := decompress(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lines := bytes.Split(bytes.TrimSuffix(content, []byte{'\n'}), []byte{'\n'})
+	for _, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	s.lock.Lock()
+	s.requests++
+	s.lock.Unlock()
+	for _, line := range lines {
+		s.add(line)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) start(listener net.Listener, scheme string) {
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	s.URL = scheme + "://" + s.Addr
+	s.wg.Add(1)
+	go s.serveListener()
+}
+
+//生成127.0.0.1的自签名证书
+func (s *Server) generateCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gelftest"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	s.certPool = x509.NewCertPool()
+	s.certPool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+//信任NewTLSServer、NewHTTPSServer自签名证书的客户端配置，其他server返回nil
+func (s *Server) ClientTLSConfig() *tls.Config {
+	if s.certPool == nil {
+		return nil
+	}
+	return &tls.Config{RootCAs: s.certPool}
+}
+
+func (s *Server) servePacket() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.packet.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		s.handlePacket(packet)
+	}
+}
+
+func (s *Server) handlePacket(packet []byte) {
+	if len(packet) < 2 || packet[0] != chunkMagic0 || packet[1] != chunkMagic1 {
+		s.add(packet)
+		return
+	}
+	if len(packet) < chunkHeaderLen {
+		return
+	}
+	id := string(packet[2:10])
+	index, count := int(packet[10]), int(packet[11])
+	if count == 0 || index >= count {
+		return
+	}
+	s.lock.Lock()
+	chunks := s.chunks[id]
+	if chunks == nil {
+		chunks = make([][]byte, count)
+		s.chunks[id] = chunks
+	}
+	chunks[index] = packet[chunkHeaderLen:]
+	for _, chunk := range chunks {
+		if chunk == nil {
+			s.lock.Unlock()
+			return
+		}
+	}
+	delete(s.chunks, id)
+	s.lock.Unlock()
+	s.add(bytes.Join(chunks, nil))
+}
+
+func (s *Server) serveListener() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := reader.ReadBytes(0)
+		if len(frame) > 1 {
+			s.add(frame[:len(frame)-1])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//解压后解析json，无法解析的消息忽略
+func (s *Server) add(payload []byte) {
+	content, err := decompress(payload)
+	if err != nil {
+		return
+	}
+	message := Message{}
+	err = json.Unmarshal(content, &message)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.messages = append(s.messages, message)
+	s.lock.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func decompress(payload []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch {
+	case len(payload) > 1 && payload[0] == 0x1f && payload[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) > 0 && payload[0] == 0x78:
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+//已经收到的消息
+func (s *Server) Messages() []Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Message{}, s.messages...)
+}
+
+//http server收到的有效请求数
+func (s *Server) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+//等待收到至少n条消息，超时返回已经收到的消息和error
+func (s *Server) Wait(n int, timeout time.Duration) ([]Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		messages := s.Messages()
+		if len(messages) >= n {
+			return messages, nil
+		}
+		select {
+		case <-s.notify:
+		case <-timer.C:
+			return messages, fmt.Errorf("received %d messages, want %d", len(messages), n)
+		}
+	}
+}
+
+//断开所有已建立的连接，不关闭监听，用来模拟graylog重启；http server只关闭空闲连接
+func (s *Server) CloseConns() {
+	if s.http != nil {
+		s.http.SetKeepAlivesEnabled(false)
+		s.http.SetKeepAlivesEnabled(true)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) Close() error {
+	var err error
+	if s.packet != nil {
+		err = s.packet.Close()
+	}
+	if s.listener != nil {
+		err = s.listener.Close()
+		s.CloseConns()
+	}
+	if s.http != nil {
+		err = s.http.Close()
+	}
+	s.wg.Wait()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
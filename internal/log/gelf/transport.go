@@ -0,0 +1,255 @@
+package gelf
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	tcpDialTimeout  = 5 * time.Second
+	tcpWriteTimeout = 5 * time.Second
+	httpTimeout     = 10 * time.Second
+	httpPath        = "/gelf"
+)
+
+//发送消息的连接，只在发送goroutine中使用
+type transport interface {
+	write(message []byte) error //发送一条消息，失败后关闭连接，下次write时重新连接
+	resolve() error             //重新解析地址，地址变化后下次write时重新连接
+	retryable(err error) bool   //发送失败后是否需要重连重试
+	batchSize() int             //一次write最多包含的消息数，多条消息以\n分隔
+	close()
+}
+
+//按Config.Compression压缩，超过MaxChunkSize时按gelf chunk格式分块
+type udpTransport struct {
+	g    *Gelf
+	addr *net.UDPAddr
+	conn *net.UDPConn
+}
+
+func (u *udpTransport) resolve() error {
+	addr, err := net.ResolveUDPAddr("udp", u.g.Config.GraylogAddr)
+	if err != nil {
+		return err
+	}
+	u.addr = addr
+	return nil
+}
+
+func (u *udpTransport) dial() (*net.UDPConn, error) {
+	if u.addr == nil {
+		if err := u.resolve(); err != nil {
+			return nil, err
+		}
+	}
+	if u.conn != nil && u.conn.RemoteAddr().String() == u.addr.String() {
+		return u.conn, nil
+	}
+	u.close()
+	conn, err := net.DialUDP("udp", nil, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	u.conn = conn
+	return conn, nil
+}
+
+func (u *udpTransport) write(message []byte) error {
+	conn, err := u.dial()
+	if err != nil {
+		return err
+	}
+	g := u.g
+
+	compressed := g.Compress(message)
+	chunksize := g.Config.MaxChunkSize
+	length := compressed.Len()
+
+	if length > chunksize {
+
+		chunkCountInt := int(math.Ceil(float64(length) / float64(chunksize)))
+
+		id := make([]byte, 8)
+		binary.BigEndian.PutUint64(id, uint64(time.Now().UnixNano()))
+		copy(id[:4], hh[:4])
+
+		for i, index := 0, 0; i < length; i, index = i+chunksize, index+1 {
+			packet := g.CreateChunkedMessage(index, chunkCountInt, id, compressed)
+			err = g.Send(conn, packet.Bytes())
+			if err != nil {
+				break
+			}
+		}
+
+	} else {
+		err = g.Send(conn, compressed.Bytes())
+	}
+
+	if err != nil {
+		u.close()
+	}
+	return err
+}
+
+func (u *udpTransport) retryable(err error) bool { return false }
+
+func (u *udpTransport) batchSize() int { return 1 }
+
+func (u *udpTransport) close() {
+	if u.conn != nil {
+		_ = u.conn.Close()
+		u.conn = nil
+	}
+}
+
+//gelf tcp格式，消息不压缩，以\0结尾；tlsConfig不为nil时使用TLS
+type tcpTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+	conn      net.Conn
+	eof       chan struct{}
+}
+
+//地址变化时关闭连接，下次write时连接到新的地址
+func (t *tcpTransport) resolve() error {
+	addr, err := net.ResolveTCPAddr("tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	if t.conn != nil && t.conn.RemoteAddr().String() != addr.String() {
+		t.close()
+	}
+	return nil
+}
+
+func (t *tcpTransport) dial() (net.Conn, error) {
+	if t.conn != nil {
+		select {
+		case <-t.eof:
+			t.close()
+		default:
+			return t.conn, nil
+		}
+	}
+	dialer := &net.Dialer{Timeout: tcpDialTimeout}
+	var conn net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.addr, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", t.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	//graylog不会向客户端发送数据，读到EOF或者错误说明连接已经被对端关闭；
+	//否则第一次写入已关闭的连接通常会成功，这条消息会丢失
+	eof := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, conn)
+		close(eof)
+	}()
+	t.eof = eof
+	return conn, nil
+}
+
+func (t *tcpTransport) write(message []byte) error {
+	conn, err := t.dial()
+	if err != nil {
+		return err
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	_, err = conn.Write(append(message, 0))
+	if err != nil {
+		t.close()
+	}
+	return err
+}
+
+func (t *tcpTransport) retryable(err error) bool { return true }
+
+func (t *tcpTransport) batchSize() int { return 1 }
+
+func (t *tcpTransport) close() {
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+}
+
+//gelf http格式，POST到/gelf，消息不压缩，多条消息以\n分隔
+type httpTransport struct {
+	url    string
+	size   int
+	client *http.Client
+}
+
+//graylog返回的错误状态码
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("graylog responded %d %s", e.code, http.StatusText(e.code))
+}
+
+func newHTTPTransport(config Config) *httpTransport {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: tcpDialTimeout,
+		MaxIdleConnsPerHost: 1,
+		DialContext:         (&net.Dialer{Timeout: tcpDialTimeout}).DialContext,
+	}
+	if config.Transport == TransportHTTPS {
+		transport.TLSClientConfig = config.TLSConfig
+	}
+	return &httpTransport{
+		url:    (&url.URL{Scheme: config.Transport, Host: config.GraylogAddr, Path: httpPath}).String(),
+		size:   config.BatchSize,
+		client: &http.Client{Transport: transport, Timeout: httpTimeout},
+	}
+}
+
+//关闭空闲连接，下次请求时重新解析地址
+func (h *httpTransport) resolve() error {
+	h.close()
+	return nil
+}
+
+func (h *httpTransport) write(message []byte) error {
+	response, err := h.client.Post(h.url, "application/json", bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return &statusError{response.StatusCode}
+	}
+	return nil
+}
+
+//除了429以外的4xx重试也不会成功，直接丢弃
+func (h *httpTransport) retryable(err error) bool {
+	if e, isStatus := err.(*statusError); isStatus {
+		return e.code >= 500 || e.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func (h *httpTransport) batchSize() int { return h.size }
+
+func (h *httpTransport) close() {
+	h.client.CloseIdleConnections()
+}
@@ -0,0 +1,186 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"regexp"
+	"strings"
+)
+
+const (
+	Mask = "******"
+)
+
+//默认屏蔽的字段名：密码、token、Authorization请求头和手机号
+var DefaultFields = []string{"pwd", "password", "new_pwd", "old_pwd", "token", "access_token", "refresh_token", "authorization", "secret", "pnumber", "phone"}
+
+//默认屏蔽的内容：Bearer token、jwt以及11位手机号
+var DefaultPatterns = []string{
+	`(?i)bearer\s+[a-z0-9._~+/=-]+`,
+	`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`,
+	`\b1[3-9][0-9]{9}\b`,
+}
+
+//屏蔽日志中的敏感信息，字段名匹配时整个字段屏蔽，字符串和错误中匹配到的内容替换为Mask
+type Redactor struct {
+	fields map[string]bool
+	rules  []rule
+}
+
+type rule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+//fields和patterns追加在默认配置之后，pattern不合法时返回error
+func New(fields []string, patterns []string) (*Redactor, error) {
+	r := &Redactor{fields: make(map[string]bool)}
+	names := make([]string, 0, len(DefaultFields)+len(fields))
+	for _, field := range append(append([]string{}, DefaultFields...), fields...) {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" || r.fields[field] {
+			continue
+		}
+		r.fields[field] = true
+		names = append(names, regexp.QuoteMeta(field))
+	}
+	keys := strings.Join(names, "|")
+	//json中的"pwd":"..."以及query中的pwd=...
+	r.rules = append(r.rules,
+		rule{regexp.MustCompile(`(?i)("(?:` + keys + `)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"` + Mask + `"`},
+		rule{regexp.MustCompile(`(?i)\b((?:` + keys + `)=)[^&\s"]+`), "${1}" + Mask},
+	)
+	for _, pattern := range append(append([]string{}, DefaultPatterns...), patterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %s is invalid: %v", pattern, err)
+		}
+		r.rules = append(r.rules, rule{re, Mask})
+	}
+	return r, nil
+}
+
+//屏蔽字符串中匹配的内容
+func (r *Redactor) String(s string) string {
+	for _, rule := range r.rules {
+		s = rule.re.ReplaceAllString(s, rule.repl)
+	}
+	return s
+}
+
+//返回屏蔽后的字段，不修改传入的字段
+func (r *Redactor) Fields(fields []zapcore.Field) []zapcore.Field {
+	ret := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		ret[i] = r.field(f)
+	}
+	return ret
+}
+
+func (r *Redactor) field(f zapcore.Field) zapcore.Field {
+	if r.fields[strings.ToLower(f.Key)] {
+		return zap.String(f.Key, Mask)
+	}
+	switch f.Type {
+	case zapcore.StringType:
+		f.String = r.String(f.String)
+		return f
+	case zapcore.ByteStringType:
+		return zap.ByteString(f.Key, []byte(r.String(string(f.Interface.([]byte)))))
+	case zapcore.ErrorType:
+		err, isErr := f.Interface.(error)
+		if !isErr || err == nil {
+			return f
+		}
+		msg := err.Error()
+		redacted := r.String(msg)
+		if redacted == msg {
+			return f
+		}
+		return zap.String(f.Key, redacted)
+	case zapcore.StringerType:
+		stringer, isStringer := f.Interface.(fmt.Stringer)
+		if !isStringer {
+			return f
+		}
+		return zap.String(f.Key, r.String(stringer.String()))
+	case zapcore.ArrayMarshalerType, zapcore.ObjectMarshalerType:
+		//zap.Strings、zap.Object等编码为map和slice后屏蔽，保留原来的结构
+		enc := zapcore.NewMapObjectEncoder()
+		var err error
+		if f.Type == zapcore.ArrayMarshalerType {
+			err = enc.AddArray(f.Key, f.Interface.(zapcore.ArrayMarshaler))
+		} else {
+			err = enc.AddObject(f.Key, f.Interface.(zapcore.ObjectMarshaler))
+		}
+		if err != nil {
+			return zap.String(f.Key, Mask)
+		}
+		return zap.Any(f.Key, r.value(enc.Fields[f.Key]))
+	case zapcore.ReflectType:
+		//结构体、map等编码为json后屏蔽，包括其中和字段名相同的key
+		content, err := json.Marshal(f.Interface)
+		if err != nil {
+			return f
+		}
+		redacted := r.String(string(content))
+		if redacted == string(content) {
+			return f
+		}
+		return zap.String(f.Key, redacted)
+	}
+	return f
+}
+
+//屏蔽MapObjectEncoder编码后的值，map中和字段名相同的key整体屏蔽
+func (r *Redactor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.String(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			if r.fields[strings.ToLower(key)] {
+				v[key] = Mask
+			} else {
+				v[key] = r.value(item)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.value(item)
+		}
+		return v
+	}
+	return v
+}
+
+//屏蔽敏感信息的zapcore.Core，分别包在console core和graylog core外面；
+//不能包在Tee外面，Tee的Write不检查每个core的日志级别
+type core struct {
+	zapcore.Core
+	r *Redactor
+}
+
+func NewCore(c zapcore.Core, r *Redactor) zapcore.Core {
+	return &core{Core: c, r: r}
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	return &core{Core: c.Core.With(c.r.Fields(fields)), r: c.r}
+}
+
+func (c *core) Check(entry zapcore.Entry, checkedEntry *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checkedEntry.AddCore(entry, c)
+	}
+	return checkedEntry
+}
+
+func (c *core) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = c.r.String(entry.Message)
+	entry.Stack = c.r.String(entry.Stack)
+	return c.Core.Write(entry, c.r.Fields(fields))
+}
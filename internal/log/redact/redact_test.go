@@ -0,0 +1,155 @@
+package redact_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liqifyl/chat-go/internal/log/gelf"
+	"github.com/liqifyl/chat-go/internal/log/gelf/gelftest"
+	"github.com/liqifyl/chat-go/internal/log/redact"
+	"github.com/liqifyl/chat-go/internal/log/zapgray"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	secretPwd   = "pwd-Secret-1"
+	secretToken = "tok-Secret-2"
+	secretJwt   = "eyJhbGciOiJIUzI1NiJ9.eyJ1aWQiOjF9.c2lnbmF0dXJl"
+	secretPhone = "13800138000"
+)
+
+var secrets = []string{secretPwd, secretToken, secretJwt, secretPhone}
+
+type user struct {
+	nick  string
+	token string
+	phone string
+}
+
+func (u user) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("nick", u.nick)
+	enc.AddString("token", u.token)
+	enc.AddString("remark", "call "+u.phone)
+	return nil
+}
+
+type users []user
+
+func (us users) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, u := range us {
+		if err := enc.AppendObject(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//通过redact core和gelf core把日志发送到gelftest，返回收到的消息
+func sendToGelf(t *testing.T, log func(logger *zap.Logger, core zapcore.Core), count int) []gelftest.Message {
+	t.Helper()
+	server, err := gelftest.NewUDPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	r, err := redact.New(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := gelf.New(gelf.Config{GraylogAddr: server.Addr})
+	core := redact.NewCore(zapgray.NewGelfCore(g, zap.NewAtomicLevelAt(zapcore.DebugLevel)), r)
+	log(zap.New(core), core)
+	_ = g.Close()
+	messages, err := server.Wait(count, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func assertRedacted(t *testing.T, messages []gelftest.Message) {
+	t.Helper()
+	for _, message := range messages {
+		content, err := json.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(string(content), secret) {
+				t.Errorf("gelf payload contains %s: %s", secret, content)
+			}
+		}
+		if !strings.Contains(string(content), redact.Mask) {
+			t.Errorf("gelf payload is not masked: %s", content)
+		}
+	}
+}
+
+func TestMessageAndFieldsAreRedactedInGelfPayload(t *testing.T) {
+	messages := sendToGelf(t, func(logger *zap.Logger, core zapcore.Core) {
+		logger.Info("login pnumber="+secretPhone+"&pwd="+secretPwd,
+			zap.String("pwd", secretPwd),
+			zap.String("body", `{"nick":"n","token":"`+secretToken+`"}`),
+			zap.ByteString("raw", []byte("Authorization: Bearer "+secretToken)),
+			zap.Error(errors.New("verify "+secretJwt+" failed")),
+			zap.Stringer("remote", time.Duration(0)),
+			zap.Any("request", map[string]string{"password": secretPwd, "phone": secretPhone}),
+		)
+		logger.With(zap.String("token", secretToken), zap.Int64("uid", 1)).Warn("refresh " + secretJwt)
+	}, 2)
+	assertRedacted(t, messages)
+	if messages[0]["_udef-pwd"] != redact.Mask {
+		t.Errorf("pwd field is %v", messages[0]["_udef-pwd"])
+	}
+	if messages[1]["_udef-uid"] != float64(1) {
+		t.Errorf("uid field is %v", messages[1]["_udef-uid"])
+	}
+}
+
+func TestArrayAndObjectFieldsAreRedactedInGelfPayload(t *testing.T) {
+	messages := sendToGelf(t, func(logger *zap.Logger, core zapcore.Core) {
+		logger.Info("members",
+			zap.Strings("phones", []string{secretPhone, "10086"}),
+			zap.Object("user", user{nick: "n", token: secretToken, phone: secretPhone}),
+			zap.Array("users", users{{nick: "a", token: secretToken}, {nick: "b", phone: secretPhone}}),
+		)
+	}, 1)
+	assertRedacted(t, messages)
+	phones, _ := messages[0]["_udef-phones"].([]interface{})
+	if len(phones) != 2 || phones[0] != redact.Mask || phones[1] != "10086" {
+		t.Errorf("phones field is %v", messages[0]["_udef-phones"])
+	}
+	u, _ := messages[0]["_udef-user"].(map[string]interface{})
+	if u["nick"] != "n" || u["token"] != redact.Mask {
+		t.Errorf("user field is %v", messages[0]["_udef-user"])
+	}
+}
+
+func TestStacktraceIsRedactedInGelfPayload(t *testing.T) {
+	messages := sendToGelf(t, func(logger *zap.Logger, core zapcore.Core) {
+		entry := zapcore.Entry{
+			Level:   zapcore.ErrorLevel,
+			Time:    time.Now(),
+			Message: "panic",
+			Stack:   "main.login(phone " + secretPhone + ")\n\tAuthorization: Bearer " + secretToken,
+		}
+		if checked := core.Check(entry, nil); checked != nil {
+			checked.Write()
+		}
+	}, 1)
+	assertRedacted(t, messages)
+	if stack, _ := messages[0]["_stacktrace"].(string); !strings.Contains(stack, "main.login") {
+		t.Errorf("stacktrace is %v", messages[0]["_stacktrace"])
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	_, err := redact.New(nil, []string{"("})
+	if err == nil {
+		t.Error("invalid pattern should return error")
+	}
+}
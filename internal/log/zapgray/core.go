@@ -47,6 +47,7 @@ func (gc *GelfCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
 	}
 
 	gc.g.Log(buf.Bytes())
+	buf.Free()
 	return nil
 }
 
@@ -57,9 +58,9 @@ func (gc *GelfCore) With(fields []zapcore.Field) zapcore.Core {
 	return clone
 }
 
-// Sync is a no-op.
+// Sync flushes messages buffered by the gelf writer.
 func (gc *GelfCore) Sync() error {
-	return nil
+	return gc.g.Flush()
 }
 
 // Check determines whether the supplied entry should be logged.
@@ -79,6 +80,7 @@ func (gc *GelfCore) clone() *GelfCore {
 	return &GelfCore{
 		g:       gc.g,
 		encoder: gc.encoder.Clone(),
+		lv:      gc.lv,
 	}
 }
 
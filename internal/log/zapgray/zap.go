@@ -38,9 +38,8 @@ func NewGraylogEncoderConfig() zapcore.EncoderConfig {
 	}
 }
 
-func ZapGrayCore(addr string, lv zap.AtomicLevel) zapcore.Core {
-	return NewGelfCore(gelf.New(gelf.Config{
-		GraylogAddr: addr,
-	}), lv)
+func ZapGrayCore(config gelf.Config, lv zap.AtomicLevel) (zapcore.Core, *gelf.Gelf) {
+	g := gelf.New(config)
+	return NewGelfCore(g, lv), g
 }
 
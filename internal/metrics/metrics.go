@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"github.com/liqifyl/chat-go/internal/log/gelf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	metricsNamespace    = "chat"
+	metricsRouteUnknown = "unmatched" //没有匹配到路由的请求，避免把任意路径作为label
+	CacheResultHit      = "hit"
+	CacheResultMiss     = "miss"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Total number of HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latencies by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	redisCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "redis",
+		Name:      "command_duration_seconds",
+		Help:      "Redis command latencies by command and result.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command", "status"})
+	cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Cache lookups by cache name and result (hit or miss).",
+	}, []string{"cache", "result"})
+	ChatConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ws",
+		Name:      "connections",
+		Help:      "Number of connected chat websocket clients.",
+	})
+	ChatOnlineUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ws",
+		Name:      "online_users",
+		Help:      "Number of users with at least one connected chat client.",
+	})
+
+	dbStatsLock       = sync.Mutex{}
+	dbStatsCollectors = make(map[string]prometheus.Collector)
+	gelfLock          = sync.Mutex{}
+	gelfCollectors    []prometheus.Collector
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration, redisCommandDuration, cacheRequestsTotal, ChatConnections, ChatOnlineUsers)
+}
+
+//暴露/metrics的handler
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+//统计每个路由的请求数和耗时，route使用注册时的路由模板，例如/v1/user/image/:id
+func GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = metricsRouteUnknown
+		}
+		method := c.Request.Method
+		httpRequestsTotal.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+//记录一次缓存查询结果，result为CacheResultHit或者CacheResultMiss
+func ObserveCache(cache string, result string) {
+	cacheRequestsTotal.WithLabelValues(cache, result).Inc()
+}
+
+//注册数据库连接池状态，同一个name重复注册时替换旧的连接池
+func RegisterDBStats(name string, db *sql.DB) {
+	dbStatsLock.Lock()
+	defer dbStatsLock.Unlock()
+	if old := dbStatsCollectors[name]; old != nil {
+		prometheus.Unregister(old)
+	}
+	collector := collectors.NewDBStatsCollector(db, name)
+	dbStatsCollectors[name] = collector
+	prometheus.MustRegister(collector)
+}
+
+//连接池关闭后取消注册
+func UnregisterDBStats(name string) {
+	dbStatsLock.Lock()
+	defer dbStatsLock.Unlock()
+	if old := dbStatsCollectors[name]; old != nil {
+		prometheus.Unregister(old)
+		delete(dbStatsCollectors, name)
+	}
+}
+
+//注册graylog发送统计，重复注册时替换旧的
+func RegisterGelf(g *gelf.Gelf) {
+	gelfLock.Lock()
+	defer gelfLock.Unlock()
+	for _, collector := range gelfCollectors {
+		prometheus.Unregister(collector)
+	}
+	gelfCollectors = []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "gelf",
+			Name:      "messages_sent_total",
+			Help:      "Total number of log messages sent to graylog.",
+		}, func() float64 { return float64(g.Stats().Sent) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "gelf",
+			Name:      "messages_dropped_total",
+			Help:      "Total number of log messages dropped because the queue was full or sending failed.",
+		}, func() float64 { return float64(g.Stats().Dropped) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "gelf",
+			Name:      "send_errors_total",
+			Help:      "Total number of log messages that failed to be sent to graylog.",
+		}, func() float64 { return float64(g.Stats().Errors) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "gelf",
+			Name:      "queue_length",
+			Help:      "Number of log messages waiting to be sent to graylog.",
+		}, func() float64 { return float64(g.Stats().Queued) }),
+	}
+	for _, collector := range gelfCollectors {
+		prometheus.MustRegister(collector)
+	}
+}
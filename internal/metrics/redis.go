@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+const (
+	redisStatusOk    = "ok"
+	redisStatusNil   = "nil" //key不存在，对于缓存是正常结果
+	redisStatusError = "error"
+)
+
+type redisStartKey struct{}
+
+//记录redis命令耗时的hook，pipeline按照pipeline整体记录
+type RedisHook struct{}
+
+func (RedisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (RedisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observeRedis(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+func (RedisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (RedisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	observeRedis(ctx, "pipeline", err)
+	return nil
+}
+
+func observeRedis(ctx context.Context, command string, err error) {
+	start, found := ctx.Value(redisStartKey{}).(time.Time)
+	if !found {
+		return
+	}
+	status := redisStatusOk
+	if err == redis.Nil {
+		status = redisStatusNil
+	} else if err != nil {
+		status = redisStatusError
+	}
+	redisCommandDuration.WithLabelValues(command, status).Observe(time.Since(start).Seconds())
+}
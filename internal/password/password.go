@@ -0,0 +1,67 @@
+package password
+
+import (
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	//bcrypt只使用前72个字节，超过的部分会被忽略，所以直接拒绝
+	MaxLength = 72
+	hashCost  = bcrypt.DefaultCost
+)
+
+//bcrypt生成的hash的前缀，不是这些前缀的是旧版本保存的明文密码
+var bcryptPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+//校验密码长度
+func Verify(plain string) error {
+	if len(plain) == 0 {
+		return errors.New("password is empty")
+	}
+	if len(plain) > MaxLength {
+		return errors.New("password length must be in [1,72]")
+	}
+	return nil
+}
+
+//生成加盐的密码hash
+func Hash(plain string) (string, error) {
+	err := Verify(plain)
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(plain), hashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isHash(stored string) bool {
+	for _, prefix := range bcryptPrefixes {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//比较密码和数据库中保存的值；stored是旧版本保存的明文或者hash强度低于当前配置时needRehash为true，
+//调用者应该在密码正确时重新保存hash
+func Compare(stored string, plain string) (match bool, needRehash bool) {
+	if stored == "" || plain == "" {
+		return false, false
+	}
+	if !isHash(stored) {
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(plain)) == 1
+		return match, match
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(plain)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err == nil && cost < hashCost
+}
@@ -0,0 +1,117 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/liqifyl/chat-go/internal/util"
+)
+
+const (
+	sqlBlockBTimeLayout = "2006-01-02 15:04:05"
+)
+
+//对应im数据库中的user_block表，uid把bid加入了黑名单
+type Block struct {
+	Uid   int64  `json:"uid"`   //拉黑的用户；表中字段名为uid
+	Bid   int64  `json:"bid"`   //被拉黑的用户；表中字段名为bid
+	Btime string `json:"btime"` //拉黑时间；表中字段名为btime
+}
+
+//判断uid是否把bid加入了黑名单
+func isBlockedTx(ctx context.Context, tx *sql.Tx, uid int64, bid int64) (bool, error) {
+	var exist bool
+	err := tx.QueryRowContext(ctx, "select exists(select 1 from user_block where uid = ? and bid = ?)", uid, bid).Scan(&exist)
+	return exist, err
+}
+
+//uid把bid加入黑名单，重复拉黑会被忽略
+func BlockUser(ctx context.Context, uid int64, bid int64) error {
+	if uid < 1 {
+		return errors.New("uid is invalid")
+	}
+	if bid < 1 {
+		return errors.New("bid is invalid")
+	}
+	if uid == bid {
+		return errors.New("uid is equal bid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	btime := util.CurrentTimeStr(sqlBlockBTimeLayout)
+	_, err = tx.ExecContext(ctx, "insert ignore into user_block(uid, bid, btime) values(?,?,?)", uid, bid, btime)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	//被拉黑的用户发给uid的好友申请不再处理
+	_, err = tx.ExecContext(ctx, "update friend_request set status = ?, utime = ? where uid = ? and fid = ? and status = ?",
+		FriendRequestRejected, btime, bid, uid, FriendRequestPending)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//uid把bid移出黑名单
+func UnblockUser(ctx context.Context, uid int64, bid int64) error {
+	if uid < 1 {
+		return errors.New("uid is invalid")
+	}
+	if bid < 1 {
+		return errors.New("bid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, "delete from user_block where uid = ? and bid = ?", uid, bid)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("rows affected is 0")
+	}
+	return nil
+}
+
+//获取uid的黑名单，根据btime降序
+func GetBlocksByUid(ctx context.Context, uid int64) ([]*Block, error) {
+	if uid < 1 {
+		return nil, errors.New("uid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "select bid, btime from user_block where uid = ? order by btime desc", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*Block
+	for rows.Next() {
+		block := &Block{Uid: uid}
+		err = rows.Scan(&block.Bid, &block.Btime)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, block)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -1,14 +1,20 @@
 package sql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"github.com/XSAM/otelsql"
+	"github.com/liqifyl/chat-go/internal/metrics"
+	"strings"
 	"sync"
 )
 
 var (
 	imDbLock        = new(sync.Mutex)
 	imDbMap         = make(map[string]*sql.DB)
+	dbStatsNames    = make(map[string]string)
+	tracedDrivers   = make(map[string]string)
 	DefaultDbConfig = DbConfig{}
 )
 
@@ -22,6 +28,29 @@ func convertDbConfigToStr(config DbConfig) string {
 	return str
 }
 
+//连接池监控使用的名称，去掉数据源中的用户名和密码
+func dbStatsName(config DbConfig) string {
+	dsn := config.DataSourceName
+	if index := strings.LastIndex(dsn, "@"); index >= 0 {
+		dsn = dsn[index+1:]
+	}
+	return fmt.Sprintf("%s-%s", config.DriveName, dsn)
+}
+
+//注册带有tracing的driver，每条sql语句生成一个span；同一个driver只注册一次
+func tracedDriverName(driverName string) (string, error) {
+	name := tracedDrivers[driverName]
+	if name != "" {
+		return name, nil
+	}
+	name, err := otelsql.Register(driverName, driverName)
+	if err != nil {
+		return "", err
+	}
+	tracedDrivers[driverName] = name
+	return name, nil
+}
+
 func getImDb() (*sql.DB, error) {
 	return getImDbByConfig(DefaultDbConfig)
 }
@@ -32,13 +61,45 @@ func getImDbByConfig(config DbConfig) (*sql.DB, error) {
 	key := convertDbConfigToStr(config)
 	db := imDbMap[key]
 	if db == nil {
-		db, err := sql.Open(config.DriveName, config.DataSourceName)
+		driverName, err := tracedDriverName(config.DriveName)
+		if err != nil {
+			return nil, err
+		}
+		db, err = sql.Open(driverName, config.DataSourceName)
 		if err != nil {
 			return nil, err
 		}
 		//db.SetConnMaxLifetime(time.Minute * 3)
 		db.SetMaxOpenConns(10)
 		db.SetMaxIdleConns(10)
+		imDbMap[key] = db
+		dbStatsNames[key] = dbStatsName(config)
+		metrics.RegisterDBStats(dbStatsNames[key], db)
 	}
 	return db, nil
 }
+
+//关闭所有数据库连接池，进程退出前调用
+func CloseDbs() error {
+	imDbLock.Lock()
+	defer imDbLock.Unlock()
+	var lastErr error
+	for key, db := range imDbMap {
+		metrics.UnregisterDBStats(dbStatsNames[key])
+		err := db.Close()
+		if err != nil {
+			lastErr = err
+		}
+		delete(imDbMap, key)
+	}
+	return lastErr
+}
+
+//检查默认数据库是否可以访问
+func PingDb(ctx context.Context) error {
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
@@ -1,20 +1,12 @@
 package sql
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"github.com/liqifyl/chat-go/internal/util"
 )
 
-const (
-	sqlErrorFriendUidInvalid = iota + 100
-	sqlErrorFriendFidInvalid
-	sqlErrorFriendOpenDbFail
-	sqlErrorFriendQFnickInvalid
-	sqlErrorFriendCreatePrepareFail
-	sqlErrorFriendExecInsertFail
-	sqlErrorFriendGetLastInsertIdFail
-)
-
 const (
 	sqlFriendETimeLayout = "2006-01-02 15:04:05"
 )
@@ -27,90 +19,58 @@ type Friend struct {
 	Etime string `json:"etime"` //朋友建立时间;表中字段名为etime
 }
 
-//添加好友
-func AddFriend(friend *Friend) (int64, error) {
-	if friend.Uid < 1 {
-		return sqlErrorFriendUidInvalid, errors.New("uid is invalid")
-	}
-	if friend.Fid < 1 {
-		return sqlErrorFriendFidInvalid, errors.New("fid is invalid")
-	}
-	if friend.Fnick == "" {
-		return sqlErrorFriendQFnickInvalid, errors.New("fnick is invalid")
-	}
-	db, err := getImDb()
-	if err != nil {
-		return sqlErrorFriendOpenDbFail, err
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		if tx != nil {
-			_ = tx.Rollback()
-		}
-		return 0, err
-	}
+//在事务中建立uid和fid的双向好友关系，uidFnick为uid看到的fid昵称，fidFnick为fid看到的uid昵称；已经是好友时忽略
+func addFriendsTx(ctx context.Context, tx *sql.Tx, uid int64, fid int64, uidFnick string, fidFnick string) (string, error) {
 	etime := util.CurrentTimeStr(sqlFriendETimeLayout)
-	stmt, err := db.Prepare("insert into friend(uid, fid, fnick, etime) values(?,?,?,?)")
+	stmt, err := tx.PrepareContext(ctx, "insert ignore into friend(uid, fid, fnick, etime) values(?,?,?,?)")
 	if err != nil {
-		_ = tx.Rollback()
-		return sqlErrorFriendCreatePrepareFail, err
+		return "", err
 	}
 	defer stmt.Close()
-	r, err := stmt.Exec(friend.Uid, friend.Fid, friend.Fnick, etime)
+	_, err = stmt.ExecContext(ctx, uid, fid, uidFnick, etime)
 	if err != nil {
-		_ = tx.Rollback()
-		return sqlErrorFriendExecInsertFail, err
+		return "", err
 	}
-	id, err := r.LastInsertId()
+	_, err = stmt.ExecContext(ctx, fid, uid, fidFnick, etime)
 	if err != nil {
-		_ = tx.Rollback()
-		return sqlErrorFriendGetLastInsertIdFail, err
+		return "", err
 	}
-	err = tx.Commit()
-	if err != nil {
-		return 0, err
-	}
-	friend.Etime = etime
-	return id, err
+	return etime, nil
 }
 
-func DeleteFriendById(id int64) error {
+//判断fid是否已经是uid的好友
+func isFriendTx(ctx context.Context, tx *sql.Tx, uid int64, fid int64) (bool, error) {
+	var exist bool
+	err := tx.QueryRowContext(ctx, "select exists(select 1 from friend where uid = ? and fid = ?)", uid, fid).Scan(&exist)
+	return exist, err
+}
+
+//根据id删除uid的好友，双方的好友关系都会删除；返回被删除的好友关系
+func DeleteFriendById(ctx context.Context, id int64, uid int64) (*Friend, error) {
 	if id < 1 {
-		return errors.New("id is invalid")
+		return nil, errors.New("id is invalid")
 	}
 	db, err := getImDb()
 	if err != nil {
-		return err
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		if tx != nil {
-			_ = tx.Rollback()
-		}
-		return err
+		return nil, err
 	}
-	result, err := db.Exec("delete table friend where id = ?", id)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
+	friend := &Friend{Id: id, Uid: uid}
+	err = db.QueryRowContext(ctx, "select fid from friend where id = ? and uid = ?", id, uid).Scan(&friend.Fid)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("rows affected is 0")
 	}
-	affected, err := result.RowsAffected()
 	if err != nil {
-		_ = tx.Rollback()
-		return err
+		return nil, err
 	}
-	err = tx.Commit()
+	err = DeleteFriend(ctx, friend)
 	if err != nil {
-		return err
-	}
-	if affected == 0 {
-		return errors.New("rows affected is 0")
+		return nil, err
 	}
-	return nil
+	return friend, nil
 }
 
-//删除好友
-func DeleteFriend(friend *Friend) error {
+//删除好友，双方的好友关系都会删除
+func DeleteFriend(ctx context.Context, friend *Friend) error {
 	if friend.Uid < 1 {
 		return errors.New("uid is invalid")
 	}
@@ -121,14 +81,12 @@ func DeleteFriend(friend *Friend) error {
 	if err != nil {
 		return err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		if tx != nil {
-			_ = tx.Rollback()
-		}
 		return err
 	}
-	result, err := db.Exec("delete table friend where uid = ? and fid = ?", friend.Uid, friend.Fid)
+	result, err := tx.ExecContext(ctx, "delete from friend where (uid = ? and fid = ?) or (uid = ? and fid = ?)",
+		friend.Uid, friend.Fid, friend.Fid, friend.Uid)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -148,22 +106,23 @@ func DeleteFriend(friend *Friend) error {
 	return nil
 }
 
-func UpdateFriendNickBy(id int64, newNick string) error {
+//根据id更新uid的好友nick
+func UpdateFriendNickBy(ctx context.Context, id int64, uid int64, newNick string) error {
 	if id < 1 {
-		return  errors.New("id is invalid")
+		return errors.New("id is invalid")
 	}
 	db, err := getImDb()
 	if err != nil {
 		return err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		if tx != nil {
 			_ = tx.Rollback()
 		}
 		return err
 	}
-	result, err := db.Exec("update table friend set fnick = ? where id = ?", newNick, id)
+	result, err := tx.ExecContext(ctx, "update friend set fnick = ? where id = ? and uid = ?", newNick, id, uid)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -181,11 +140,10 @@ func UpdateFriendNickBy(id int64, newNick string) error {
 		return errors.New("rows affected is 0")
 	}
 	return nil
- 	return nil
 }
 
 //更新好友nick
-func UpdateFriendNick(friend *Friend) error {
+func UpdateFriendNick(ctx context.Context, friend *Friend) error {
 	if friend.Uid < 1 {
 		return errors.New("uid is invalid")
 	}
@@ -199,14 +157,14 @@ func UpdateFriendNick(friend *Friend) error {
 	if err != nil {
 		return err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		if tx != nil {
 			_ = tx.Rollback()
 		}
 		return err
 	}
-	result, err := db.Exec("update table friend set fnick = ? where uid = ? and fid = ?", friend.Fnick, friend.Uid, friend.Fid)
+	result, err := tx.ExecContext(ctx, "update friend set fnick = ? where uid = ? and fid = ?", friend.Fnick, friend.Uid, friend.Fid)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -227,7 +185,7 @@ func UpdateFriendNick(friend *Friend) error {
 }
 
 //根据用户id获取所有好友
-func GetFriendsByUid(uid int64) ([]*Friend, error) {
+func GetFriendsByUid(ctx context.Context, uid int64) ([]*Friend, error) {
 	if uid < 1 {
 		return nil, errors.New("uid is invalid")
 	}
@@ -235,7 +193,7 @@ func GetFriendsByUid(uid int64) ([]*Friend, error) {
 	if err != nil {
 		return nil, err
 	}
-	rows, err := db.Query("select id, fid, fnick, etime from friend where uid = ?", uid)
+	rows, err := db.QueryContext(ctx, "select id, fid, fnick, etime from friend where uid = ?", uid)
 	if err != nil {
 		return nil, err
 	}
@@ -250,8 +208,7 @@ func GetFriendsByUid(uid int64) ([]*Friend, error) {
 		if err != nil {
 			break
 		}
-		tmp := &Friend{Uid: uid, Fid: fid, Fnick: fnick}
-		tmp.Uid = uid
+		tmp := &Friend{Id: id, Uid: uid, Fid: fid, Fnick: fnick, Etime: etime}
 		results = append(results, tmp)
 	}
 	if err != nil {
@@ -1,24 +1,307 @@
 package sql
 
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/liqifyl/chat-go/internal/util"
+	"time"
+)
+
+const (
+	FriendCircleVisibleAllFriends = iota //所有好友可见
+	FriendCircleVisibleInclude           //只有VisibleUids中的好友可见
+	FriendCircleVisibleExclude           //除VisibleUids之外的好友可见
+	FriendCircleVisiblePrivate           //只有自己可见
+)
+
+const (
+	FriendCircleMaxLimit = 100 //一次最多查询的朋友圈条数
+)
+
+const (
+	sqlFriendCirclePTimeLayout = "2006-01-02 15:04:05"
+)
+
 //对应im数据库中的friend_circle表
 type FriendCircle struct {
 	Id    int64  `json:"id"`    //id；表中字段名称id
 	Uid   int64  `json:"uid"`   //用户id，user表中id;表中字段名称uid
 	Ptime string `json:"ptime"` //朋友圈发布时间;表中对应字段名称ptime
-	title string `json:"title"` //朋友圈对应标题；表中对应名称title
+	Title string `json:"title"` //朋友圈对应标题；表中对应名称title
+	Url   string `json:"url"`   //朋友圈对应链接；表中对应名称url
+
+	Visibility  uint8   `json:"visibility"`             //可见范围，参考FriendCircleVisible*；表中对应名称visibility
+	VisibleUids []int64 `json:"visible_uids,omitempty"` //可见或不可见的好友，保存在friend_circle_visible表中，只在发布时使用
+
+	Media []*FriendCircleMedia `json:"media,omitempty"` //图片和视频，保存在friend_circle_media表中
+
+	LikeCount    int  `json:"like_count"`    //查看者可以看到的点赞数
+	CommentCount int  `json:"comment_count"` //查看者可以看到的评论数
+	Liked        bool `json:"liked"`         //查看者是否已点赞
+}
+
+//评论和点赞只对共同好友可见：查看者能看到自己的、发布者是自己时能看到全部、否则只能看到自己好友的；
+//alias为评论或点赞表的别名，朋友圈表的别名必须为f，依次需要3个查看者uid参数
+func sqlFriendCircleInteractVisible(alias string) string {
+	return fmt.Sprintf("(%s.uid = ? or f.uid = ? or %s.uid in (select fid from friend where uid = ?))", alias, alias)
+}
+
+//朋友圈对查看者可见：自己发布的，或者好友发布的、发布者没有拉黑查看者并且可见范围包含查看者；
+//朋友圈表的别名必须为f，依次需要5个查看者uid参数
+const sqlFriendCircleVisible = "(f.uid = ? or (f.uid in (select fid from friend where uid = ?) and " +
+	"not exists(select 1 from user_block b where b.uid = f.uid and b.bid = ?) and (" +
+	"f.visibility = 0 or " +
+	"(f.visibility = 1 and exists(select 1 from friend_circle_visible v where v.fcid = f.id and v.uid = ?)) or " +
+	"(f.visibility = 2 and not exists(select 1 from friend_circle_visible v where v.fcid = f.id and v.uid = ?)))))"
+
+//查看者是否可以看到朋友圈；朋友圈不存在时返回error
+func CanViewFriendCircle(ctx context.Context, fcid int64, viewer int64) (*FriendCircle, bool, error) {
+	if fcid < 1 {
+		return nil, false, errors.New("fcid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, false, err
+	}
+	friendCircle := &FriendCircle{Id: fcid}
+	var visible bool
+	err = db.QueryRowContext(ctx, "select f.uid, f.visibility, "+sqlFriendCircleVisible+" from friend_circle f where f.id = ?",
+		viewer, viewer, viewer, viewer, viewer, fcid).Scan(&friendCircle.Uid, &friendCircle.Visibility, &visible)
+	if err == sql.ErrNoRows {
+		return nil, false, errors.New("friend circle is not exist")
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return friendCircle, visible, nil
 }
 
 //发布一条朋友圈
-func PublishFriendCircle(friendCircle *FriendCircle) (int64, error) {
-	return 0, nil
+func PublishFriendCircle(ctx context.Context, friendCircle *FriendCircle) (int64, error) {
+	if friendCircle.Uid < 1 {
+		return 0, errors.New("uid is invalid")
+	}
+	if friendCircle.Title == "" && friendCircle.Url == "" && len(friendCircle.Media) == 0 {
+		return 0, errors.New("title, url and media are empty")
+	}
+	if len(friendCircle.Title) > 200 {
+		return 0, errors.New("title length must be in [0,200]")
+	}
+	if len(friendCircle.Url) > 200 {
+		return 0, errors.New("url length must be in [0,200]")
+	}
+	err := verifyFriendCircleVisibility(friendCircle.Visibility, friendCircle.VisibleUids)
+	if err != nil {
+		return 0, err
+	}
+	err = verifyFriendCircleMedia(friendCircle.Media)
+	if err != nil {
+		return 0, err
+	}
+	db, err := getImDb()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	ptime := util.CurrentTimeStr(sqlFriendCirclePTimeLayout)
+	r, err := tx.ExecContext(ctx, "insert into friend_circle(uid, ptime, title, url, visibility) values(?,?,?,?,?)",
+		friendCircle.Uid, ptime, friendCircle.Title, friendCircle.Url, friendCircle.Visibility)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = insertFriendCircleVisibleUidsTx(ctx, tx, id, friendCircle.VisibleUids)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = insertFriendCircleMediaTx(ctx, tx, id, friendCircle.Uid, friendCircle.Media)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	friendCircle.Id = id
+	friendCircle.Ptime = ptime
+	return id, nil
+}
+
+func verifyFriendCircleVisibility(visibility uint8, visibleUids []int64) error {
+	switch visibility {
+	case FriendCircleVisibleAllFriends, FriendCircleVisiblePrivate:
+		if len(visibleUids) > 0 {
+			return errors.New("visible uids must be empty")
+		}
+	case FriendCircleVisibleInclude:
+		if len(visibleUids) == 0 {
+			return errors.New("visible uids is empty")
+		}
+	case FriendCircleVisibleExclude:
+	default:
+		return errors.New("visibility is invalid")
+	}
+	return nil
 }
 
-//根据唯一id删除一条朋友圈
-func RemoveFriendCircleById(id int64) error {
+func insertFriendCircleVisibleUidsTx(ctx context.Context, tx *sql.Tx, fcid int64, visibleUids []int64) error {
+	for _, uid := range visibleUids {
+		_, err := tx.ExecContext(ctx, "insert ignore into friend_circle_visible(fcid, uid) values(?,?)", fcid, uid)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-//根据用户id获取自己以及朋友最新朋友圈,根据ptime降序
-func GetFriendCircleByUid(uid int64, maxPublishTime string, limit int) ([]*FriendCircle, error) {
-	return nil, nil
+//修改朋友圈的可见范围，只能修改uid自己发布的
+func UpdateFriendCircleVisibility(ctx context.Context, id int64, uid int64, visibility uint8, visibleUids []int64) error {
+	if id < 1 {
+		return errors.New("id is invalid")
+	}
+	err := verifyFriendCircleVisibility(visibility, visibleUids)
+	if err != nil {
+		return err
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var owner int64
+	err = tx.QueryRowContext(ctx, "select uid from friend_circle where id = ? for update", id).Scan(&owner)
+	if err == sql.ErrNoRows || (err == nil && owner != uid) {
+		_ = tx.Rollback()
+		return errors.New("friend circle is not exist")
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "update friend_circle set visibility = ? where id = ?", visibility, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "delete from friend_circle_visible where fcid = ?", id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = insertFriendCircleVisibleUidsTx(ctx, tx, id, visibleUids)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//根据唯一id删除一条朋友圈，只能删除uid自己发布的；返回朋友圈的媒体，由调用者删除磁盘上的文件
+func RemoveFriendCircleById(ctx context.Context, id int64, uid int64) ([]*FriendCircleMedia, error) {
+	if id < 1 {
+		return nil, errors.New("id is invalid")
+	}
+	if uid < 1 {
+		return nil, errors.New("uid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	media, err := getFriendCircleMediaTx(ctx, tx, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	result, err := tx.ExecContext(ctx, "delete from friend_circle where id = ? and uid = ?", id, uid)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if affected == 0 {
+		_ = tx.Rollback()
+		return nil, errors.New("rows affected is 0")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+//根据用户id获取自己以及朋友最新朋友圈，只返回对uid可见的,根据ptime、id降序；maxPublishTime为空时从最新的开始，
+//否则只返回(ptime, id)小于(maxPublishTime, maxId)的，ptime只精确到秒，同一秒发布的朋友圈按id分页
+func GetFriendCircleByUid(ctx context.Context, uid int64, maxPublishTime string, maxId int64, limit int) ([]*FriendCircle, error) {
+	if uid < 1 {
+		return nil, errors.New("uid is invalid")
+	}
+	if maxPublishTime == "" {
+		maxPublishTime = time.Now().Add(time.Second).Format(sqlFriendCirclePTimeLayout)
+		maxId = 0
+	} else {
+		_, err := time.Parse(sqlFriendCirclePTimeLayout, maxPublishTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limit < 1 || limit > FriendCircleMaxLimit {
+		limit = FriendCircleMaxLimit
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "select f.id, f.uid, f.ptime, ifnull(f.title, ''), ifnull(f.url, ''), f.visibility, "+
+		"(select count(*) from friend_circle_like l where l.fcid = f.id and "+sqlFriendCircleInteractVisible("l")+"), "+
+		"(select count(*) from friend_circle_comment c where c.fcid = f.id and "+sqlFriendCircleInteractVisible("c")+"), "+
+		"exists(select 1 from friend_circle_like l where l.fcid = f.id and l.uid = ?) "+
+		"from friend_circle f where "+sqlFriendCircleVisible+" and (f.ptime < ? or (f.ptime = ? and f.id < ?)) order by f.ptime desc, f.id desc limit ?",
+		uid, uid, uid, uid, uid, uid, uid, uid, uid, uid, uid, uid, maxPublishTime, maxPublishTime, maxId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*FriendCircle
+	for rows.Next() {
+		friendCircle := &FriendCircle{}
+		err = rows.Scan(&friendCircle.Id, &friendCircle.Uid, &friendCircle.Ptime, &friendCircle.Title, &friendCircle.Url, &friendCircle.Visibility,
+			&friendCircle.LikeCount, &friendCircle.CommentCount, &friendCircle.Liked)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, friendCircle)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	err = loadFriendCircleMedia(ctx, db, results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
 }
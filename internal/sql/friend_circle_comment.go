@@ -0,0 +1,110 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/liqifyl/chat-go/internal/util"
+)
+
+//对应im数据库中的friend_circle_comment表
+type FriendCircleComment struct {
+	Id      int64  `json:"id"`      //评论id；表中字段名为id
+	Fcid    int64  `json:"fcid"`    //朋友圈id，参考friend_circle(id)的外键；表中字段名为fcid
+	Uid     int64  `json:"uid"`     //评论者uid；表中字段名为uid
+	Content string `json:"content"` //评论内容，长度[1,500]；表中字段名为content
+	Ctime   string `json:"ctime"`   //评论时间；表中字段名为ctime
+}
+
+//评论朋友圈
+func AddFriendCircleComment(ctx context.Context, comment *FriendCircleComment) (int64, error) {
+	if comment.Fcid < 1 {
+		return 0, errors.New("fcid is invalid")
+	}
+	if comment.Uid < 1 {
+		return 0, errors.New("uid is invalid")
+	}
+	if comment.Content == "" || len(comment.Content) > 500 {
+		return 0, errors.New("content length must be in [1,500]")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return 0, err
+	}
+	ctime := util.CurrentTimeStr(sqlFriendCirclePTimeLayout)
+	r, err := db.ExecContext(ctx, "insert into friend_circle_comment(fcid, uid, content, ctime) values(?,?,?,?)", comment.Fcid, comment.Uid, comment.Content, ctime)
+	if err != nil {
+		return 0, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	comment.Id = id
+	comment.Ctime = ctime
+	return id, nil
+}
+
+//删除评论，评论者和朋友圈发布者都可以删除；返回被删除评论所属的朋友圈
+func RemoveFriendCircleComment(ctx context.Context, id int64, uid int64) (*FriendCircle, error) {
+	if id < 1 {
+		return nil, errors.New("id is invalid")
+	}
+	if uid < 1 {
+		return nil, errors.New("uid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	friendCircle := &FriendCircle{}
+	var commenter int64
+	err = db.QueryRowContext(ctx, "select f.id, f.uid, c.uid from friend_circle_comment c join friend_circle f on c.fcid = f.id where c.id = ?", id).
+		Scan(&friendCircle.Id, &friendCircle.Uid, &commenter)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("comment is not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if commenter != uid && friendCircle.Uid != uid {
+		return nil, errors.New("permission denied")
+	}
+	_, err = db.ExecContext(ctx, "delete from friend_circle_comment where id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return friendCircle, nil
+}
+
+//获取viewer可以看到的评论，根据ctime升序
+func GetFriendCircleComments(ctx context.Context, fcid int64, viewer int64) ([]*FriendCircleComment, error) {
+	if fcid < 1 {
+		return nil, errors.New("fcid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "select c.id, c.uid, c.content, c.ctime from friend_circle_comment c join friend_circle f on c.fcid = f.id "+
+		"where c.fcid = ? and "+sqlFriendCircleInteractVisible("c")+" order by c.ctime asc, c.id asc",
+		fcid, viewer, viewer, viewer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*FriendCircleComment
+	for rows.Next() {
+		comment := &FriendCircleComment{Fcid: fcid}
+		err = rows.Scan(&comment.Id, &comment.Uid, &comment.Content, &comment.Ctime)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, comment)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
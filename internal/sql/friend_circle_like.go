@@ -0,0 +1,80 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"github.com/liqifyl/chat-go/internal/util"
+)
+
+//对应im数据库中的friend_circle_like表
+type FriendCircleLike struct {
+	Id    int64  `json:"id"`    //点赞id；表中字段名为id
+	Fcid  int64  `json:"fcid"`  //朋友圈id，参考friend_circle(id)的外键；表中字段名为fcid
+	Uid   int64  `json:"uid"`   //点赞者uid；表中字段名为uid
+	Ltime string `json:"ltime"` //点赞时间；表中字段名为ltime
+}
+
+//点赞朋友圈，重复点赞会被忽略
+func LikeFriendCircle(ctx context.Context, fcid int64, uid int64) error {
+	if fcid < 1 {
+		return errors.New("fcid is invalid")
+	}
+	if uid < 1 {
+		return errors.New("uid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	ltime := util.CurrentTimeStr(sqlFriendCirclePTimeLayout)
+	_, err = db.ExecContext(ctx, "insert ignore into friend_circle_like(fcid, uid, ltime) values(?,?,?)", fcid, uid, ltime)
+	return err
+}
+
+//取消点赞
+func UnlikeFriendCircle(ctx context.Context, fcid int64, uid int64) error {
+	if fcid < 1 {
+		return errors.New("fcid is invalid")
+	}
+	if uid < 1 {
+		return errors.New("uid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "delete from friend_circle_like where fcid = ? and uid = ?", fcid, uid)
+	return err
+}
+
+//获取viewer可以看到的点赞，根据ltime升序
+func GetFriendCircleLikes(ctx context.Context, fcid int64, viewer int64) ([]*FriendCircleLike, error) {
+	if fcid < 1 {
+		return nil, errors.New("fcid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "select l.id, l.uid, l.ltime from friend_circle_like l join friend_circle f on l.fcid = f.id "+
+		"where l.fcid = ? and "+sqlFriendCircleInteractVisible("l")+" order by l.ltime asc, l.id asc",
+		fcid, viewer, viewer, viewer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*FriendCircleLike
+	for rows.Next() {
+		like := &FriendCircleLike{Fcid: fcid}
+		err = rows.Scan(&like.Id, &like.Uid, &like.Ltime)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, like)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,154 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+const (
+	FriendCircleMediaImage = iota //图片
+	FriendCircleMediaVideo        //视频
+)
+
+const (
+	FriendCircleMaxImageCount = 9
+	FriendCircleMaxVideoCount = 1
+)
+
+//对应im数据库中的friend_circle_media表，文件保存在磁盘上，表中只保存文件名
+type FriendCircleMedia struct {
+	Id    int64  `json:"id"`    //媒体id；表中字段名为id
+	Fcid  int64  `json:"fcid"`  //朋友圈id，参考friend_circle(id)的外键；表中字段名为fcid
+	Uid   int64  `json:"-"`     //上传者uid，文件保存在上传者的目录下；表中字段名为uid
+	Mtype uint8  `json:"mtype"` //媒体类型，参考FriendCircleMedia*；表中字段名为mtype
+	Mime  string `json:"mime"`  //文件的content type；表中字段名为mime
+	Name  string `json:"-"`     //磁盘上的文件名；表中字段名为name
+	Thumb string `json:"-"`     //磁盘上的缩略图文件名，视频没有缩略图；表中字段名为thumb
+	Size  int64  `json:"size"`  //文件大小；表中字段名为size
+	Idx   uint8  `json:"idx"`   //在朋友圈中的顺序；表中字段名为idx
+
+	Url      string `json:"url"`                 //访问地址，由api层生成
+	ThumbUrl string `json:"thumb_url,omitempty"` //缩略图访问地址，由api层生成
+}
+
+func verifyFriendCircleMedia(media []*FriendCircleMedia) error {
+	imageCount := 0
+	videoCount := 0
+	for _, m := range media {
+		switch m.Mtype {
+		case FriendCircleMediaImage:
+			imageCount++
+		case FriendCircleMediaVideo:
+			videoCount++
+		default:
+			return errors.New("media type is invalid")
+		}
+		if m.Name == "" || len(m.Name) > 100 || len(m.Thumb) > 100 {
+			return errors.New("media name length must be in [1,100]")
+		}
+	}
+	if imageCount > FriendCircleMaxImageCount {
+		return errors.New("image count must be in [0,9]")
+	}
+	if videoCount > FriendCircleMaxVideoCount {
+		return errors.New("video count must be in [0,1]")
+	}
+	return nil
+}
+
+func insertFriendCircleMediaTx(ctx context.Context, tx *sql.Tx, fcid int64, uid int64, media []*FriendCircleMedia) error {
+	for i, m := range media {
+		r, err := tx.ExecContext(ctx, "insert into friend_circle_media(fcid, uid, mtype, mime, name, thumb, size, idx) values(?,?,?,?,?,?,?,?)",
+			fcid, uid, m.Mtype, m.Mime, m.Name, m.Thumb, m.Size, i)
+		if err != nil {
+			return err
+		}
+		id, err := r.LastInsertId()
+		if err != nil {
+			return err
+		}
+		m.Id = id
+		m.Fcid = fcid
+		m.Uid = uid
+		m.Idx = uint8(i)
+	}
+	return nil
+}
+
+func getFriendCircleMediaTx(ctx context.Context, tx *sql.Tx, fcid int64) ([]*FriendCircleMedia, error) {
+	rows, err := tx.QueryContext(ctx, "select id, fcid, uid, mtype, mime, name, thumb, size, idx from friend_circle_media where fcid = ? order by idx", fcid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanFriendCircleMedia(rows)
+}
+
+func scanFriendCircleMedia(rows *sql.Rows) ([]*FriendCircleMedia, error) {
+	var results []*FriendCircleMedia
+	for rows.Next() {
+		m := &FriendCircleMedia{}
+		err := rows.Scan(&m.Id, &m.Fcid, &m.Uid, &m.Mtype, &m.Mime, &m.Name, &m.Thumb, &m.Size, &m.Idx)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, m)
+	}
+	err := rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+//批量加载朋友圈的媒体，按idx升序放到每条朋友圈的Media中
+func loadFriendCircleMedia(ctx context.Context, db *sql.DB, friendCircles []*FriendCircle) error {
+	if len(friendCircles) == 0 {
+		return nil
+	}
+	byId := make(map[int64]*FriendCircle, len(friendCircles))
+	args := make([]interface{}, 0, len(friendCircles))
+	for _, friendCircle := range friendCircles {
+		byId[friendCircle.Id] = friendCircle
+		args = append(args, friendCircle.Id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+	rows, err := db.QueryContext(ctx, "select id, fcid, uid, mtype, mime, name, thumb, size, idx from friend_circle_media "+
+		"where fcid in ("+placeholders+") order by fcid, idx", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	media, err := scanFriendCircleMedia(rows)
+	if err != nil {
+		return err
+	}
+	for _, m := range media {
+		friendCircle := byId[m.Fcid]
+		friendCircle.Media = append(friendCircle.Media, m)
+	}
+	return nil
+}
+
+//根据id获取媒体
+func GetFriendCircleMediaById(ctx context.Context, id int64) (*FriendCircleMedia, error) {
+	if id < 1 {
+		return nil, errors.New("id is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	m := &FriendCircleMedia{}
+	err = db.QueryRowContext(ctx, "select id, fcid, uid, mtype, mime, name, thumb, size, idx from friend_circle_media where id = ?", id).
+		Scan(&m.Id, &m.Fcid, &m.Uid, &m.Mtype, &m.Mime, &m.Name, &m.Thumb, &m.Size, &m.Idx)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("media is not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,276 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/liqifyl/chat-go/internal/util"
+	"time"
+)
+
+const (
+	FriendRequestPending  = iota //等待对方处理
+	FriendRequestAccepted        //已同意
+	FriendRequestRejected        //已拒绝
+	FriendRequestExpired         //超过有效期未处理
+)
+
+const (
+	sqlFriendRequestTimeLayout = "2006-01-02 15:04:05"
+	sqlFriendRequestExpire     = time.Hour * 24 * 7
+	sqlFriendRequestMaxLimit   = 100
+)
+
+//对应im数据库中的friend_request表
+type FriendRequest struct {
+	Id       int64  `json:"id"`       //申请id；表中字段名为id
+	Uid      int64  `json:"uid"`      //申请人uid；表中字段名为uid
+	Fid      int64  `json:"fid"`      //被申请人uid；表中字段名为fid
+	Greeting string `json:"greeting"` //打招呼的消息；表中字段名为greeting
+	Status   uint8  `json:"status"`   //状态，参考FriendRequest*；表中字段名为status
+	Ctime    string `json:"ctime"`    //申请时间；表中字段名为ctime
+	Utime    string `json:"utime"`    //状态更新时间；表中字段名为utime
+}
+
+//等待处理的申请超过有效期后视为过期，只在读取时修改状态，处理申请时再保存过期状态
+func markFriendRequestExpired(request *FriendRequest) {
+	if request.Status != FriendRequestPending {
+		return
+	}
+	ctime, err := time.ParseInLocation(sqlFriendRequestTimeLayout, request.Ctime, time.Local)
+	if err == nil && time.Since(ctime) > sqlFriendRequestExpire {
+		request.Status = FriendRequestExpired
+	}
+}
+
+//发送好友申请；已经是好友时返回error，对同一个人重复申请时更新打招呼消息和申请时间
+func SendFriendRequest(ctx context.Context, request *FriendRequest) (int64, error) {
+	if request.Uid < 1 {
+		return 0, errors.New("uid is invalid")
+	}
+	if request.Fid < 1 {
+		return 0, errors.New("fid is invalid")
+	}
+	if request.Uid == request.Fid {
+		return 0, errors.New("uid is equal fid")
+	}
+	if len(request.Greeting) > 100 {
+		return 0, errors.New("greeting length must be in [0,100]")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	exist, err := isFriendTx(ctx, tx, request.Uid, request.Fid)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if exist {
+		_ = tx.Rollback()
+		return 0, errors.New("already friends")
+	}
+	//被对方加入黑名单后不能再发送好友申请
+	blocked, err := isBlockedTx(ctx, tx, request.Fid, request.Uid)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if blocked {
+		_ = tx.Rollback()
+		return 0, errors.New("blocked by the user")
+	}
+	ctime := util.CurrentTimeStr(sqlFriendRequestTimeLayout)
+	//(uid, fid, pending)唯一，已经有等待处理的申请时更新该申请，last_insert_id(id)使LastInsertId返回已有申请的id
+	r, err := tx.ExecContext(ctx, "insert into friend_request(uid, fid, greeting, status, ctime, utime) values(?,?,?,?,?,?) "+
+		"on duplicate key update greeting = values(greeting), ctime = values(ctime), utime = values(utime), id = last_insert_id(id)",
+		request.Uid, request.Fid, request.Greeting, FriendRequestPending, ctime, ctime)
+	var id int64
+	if err == nil {
+		id, err = r.LastInsertId()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	request.Id = id
+	request.Status = FriendRequestPending
+	request.Ctime = ctime
+	request.Utime = ctime
+	return id, nil
+}
+
+//根据id获取好友申请
+func GetFriendRequestById(ctx context.Context, id int64) (*FriendRequest, error) {
+	if id < 1 {
+		return nil, errors.New("id is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	request := &FriendRequest{}
+	err = db.QueryRowContext(ctx, "select id, uid, fid, greeting, status, ctime, utime from friend_request where id = ?", id).
+		Scan(&request.Id, &request.Uid, &request.Fid, &request.Greeting, &request.Status, &request.Ctime, &request.Utime)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("friend request is not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	markFriendRequestExpired(request)
+	return request, nil
+}
+
+//在事务中锁定fid收到的等待处理的申请并修改状态
+func updatePendingFriendRequestTx(ctx context.Context, tx *sql.Tx, id int64, fid int64, status uint8) (*FriendRequest, error) {
+	request := &FriendRequest{}
+	err := tx.QueryRowContext(ctx, "select id, uid, fid, greeting, status, ctime from friend_request where id = ? and fid = ? for update", id, fid).
+		Scan(&request.Id, &request.Uid, &request.Fid, &request.Greeting, &request.Status, &request.Ctime)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("friend request is not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != FriendRequestPending {
+		return nil, errors.New("friend request is not pending")
+	}
+	markFriendRequestExpired(request)
+	if request.Status == FriendRequestExpired {
+		status = FriendRequestExpired
+	}
+	utime := util.CurrentTimeStr(sqlFriendRequestTimeLayout)
+	_, err = tx.ExecContext(ctx, "update friend_request set status = ?, utime = ? where id = ?", status, utime, id)
+	if err != nil {
+		return nil, err
+	}
+	request.Status = status
+	request.Utime = utime
+	return request, nil
+}
+
+//fid同意好友申请，在同一个事务中建立双向好友关系；uidFnick为申请人看到的fid昵称，fidFnick为fid看到的申请人昵称
+func AcceptFriendRequest(ctx context.Context, id int64, fid int64, uidFnick string, fidFnick string) (*FriendRequest, error) {
+	if id < 1 {
+		return nil, errors.New("id is invalid")
+	}
+	if uidFnick == "" || fidFnick == "" {
+		return nil, errors.New("fnick is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	request, err := updatePendingFriendRequestTx(ctx, tx, id, fid, FriendRequestAccepted)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if request.Status == FriendRequestExpired {
+		//过期的状态需要保存下来
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("friend request is expired")
+	}
+	_, err = addFriendsTx(ctx, tx, request.Uid, request.Fid, uidFnick, fidFnick)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	//对方同时也发了申请时一起处理
+	_, err = tx.ExecContext(ctx, "update friend_request set status = ?, utime = ? where uid = ? and fid = ? and status = ?",
+		FriendRequestAccepted, request.Utime, request.Fid, request.Uid, FriendRequestPending)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+//fid拒绝好友申请
+func RejectFriendRequest(ctx context.Context, id int64, fid int64) (*FriendRequest, error) {
+	if id < 1 {
+		return nil, errors.New("id is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	request, err := updatePendingFriendRequestTx(ctx, tx, id, fid, FriendRequestRejected)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if request.Status == FriendRequestExpired {
+		return nil, errors.New("friend request is expired")
+	}
+	return request, nil
+}
+
+//获取uid收到的好友申请，根据ctime降序
+func GetIncomingFriendRequests(ctx context.Context, uid int64) ([]*FriendRequest, error) {
+	return getFriendRequests(ctx, "fid", uid)
+}
+
+//获取uid发出的好友申请，根据ctime降序
+func GetOutgoingFriendRequests(ctx context.Context, uid int64) ([]*FriendRequest, error) {
+	return getFriendRequests(ctx, "uid", uid)
+}
+
+func getFriendRequests(ctx context.Context, column string, uid int64) ([]*FriendRequest, error) {
+	if uid < 1 {
+		return nil, errors.New("uid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "select id, uid, fid, greeting, status, ctime, utime from friend_request where "+column+" = ? "+
+		"order by ctime desc, id desc limit ?", uid, sqlFriendRequestMaxLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*FriendRequest
+	for rows.Next() {
+		request := &FriendRequest{}
+		err = rows.Scan(&request.Id, &request.Uid, &request.Fid, &request.Greeting, &request.Status, &request.Ctime, &request.Utime)
+		if err != nil {
+			return nil, err
+		}
+		markFriendRequestExpired(request)
+		results = append(results, request)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
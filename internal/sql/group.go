@@ -0,0 +1,326 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/liqifyl/chat-go/internal/util"
+)
+
+const (
+	GroupRoleMember = iota //普通成员
+	GroupRoleAdmin         //管理员
+	GroupRoleOwner         //群主
+)
+
+const (
+	GroupDefaultMaxMember = 200 //创建群时没有指定成员上限时使用
+	GroupMaxMemberLimit   = 500 //群成员上限的最大值
+)
+
+const (
+	sqlGroupTimeLayout = "2006-01-02 15:04:05"
+)
+
+//对应im数据库中的chat_group表
+type Group struct {
+	Id        int64  `json:"id"`         //群id；表中字段名为id
+	Name      string `json:"name"`       //群名称，长度[1,100]；表中字段名为name
+	Avatar    string `json:"avatar"`     //群头像url，长度[0,200]；表中字段名为avatar
+	Owner     int64  `json:"owner"`      //群主uid；表中字段名为owner
+	MaxMember int    `json:"max_member"` //群成员上限；表中字段名为max_member
+	Ctime     string `json:"ctime"`      //群创建时间；表中字段名为ctime
+}
+
+//对应im数据库中的chat_group_member表
+type GroupMember struct {
+	Id    int64  `json:"id"`    //唯一id；表中字段名为id
+	Gid   int64  `json:"gid"`   //群id，参考chat_group(id)的外键；表中字段名为gid
+	Uid   int64  `json:"uid"`   //成员uid，参考user(id)的外键；表中字段名为uid
+	Role  uint8  `json:"role"`  //成员角色，参考GroupRole*；表中字段名为role
+	Jtime string `json:"jtime"` //加入时间；表中字段名为jtime
+}
+
+func verifyGroupInfo(name string, avatar string) error {
+	if name == "" || len(name) > 100 {
+		return errors.New("name length must be in [1,100]")
+	}
+	if len(avatar) > 200 {
+		return errors.New("avatar length must be in [0,200]")
+	}
+	return nil
+}
+
+//在事务中查询群成员上限和当前成员数，锁住群记录直到事务结束
+func queryGroupCapacityTx(ctx context.Context, tx *sql.Tx, gid int64) (int, int, error) {
+	var maxMember int
+	err := tx.QueryRowContext(ctx, "select max_member from chat_group where id = ? for update", gid).Scan(&maxMember)
+	if err == sql.ErrNoRows {
+		return 0, 0, errors.New("group is not exist")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var count int
+	err = tx.QueryRowContext(ctx, "select count(*) from chat_group_member where gid = ?", gid).Scan(&count)
+	if err != nil {
+		return 0, 0, err
+	}
+	return maxMember, count, nil
+}
+
+//创建群，owner成为群主，memberUids成为普通成员
+func CreateGroup(ctx context.Context, group *Group, memberUids []int64) (int64, error) {
+	if group.Owner < 1 {
+		return 0, errors.New("owner is invalid")
+	}
+	err := verifyGroupInfo(group.Name, group.Avatar)
+	if err != nil {
+		return 0, err
+	}
+	if group.MaxMember == 0 {
+		group.MaxMember = GroupDefaultMaxMember
+	}
+	if group.MaxMember < 1 || group.MaxMember > GroupMaxMemberLimit {
+		return 0, fmt.Errorf("max member must be in [1,%d]", GroupMaxMemberLimit)
+	}
+	if len(memberUids)+1 > group.MaxMember {
+		return 0, errors.New("member count exceeds max member")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	ctime := util.CurrentTimeStr(sqlGroupTimeLayout)
+	r, err := tx.ExecContext(ctx, "insert into chat_group(name, avatar, owner, max_member, ctime) values(?,?,?,?,?)",
+		group.Name, group.Avatar, group.Owner, group.MaxMember, ctime)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	gid, err := r.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "insert into chat_group_member(gid, uid, role, jtime) values(?,?,?,?)", gid, group.Owner, GroupRoleOwner, ctime)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	for _, uid := range memberUids {
+		if uid == group.Owner {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "insert ignore into chat_group_member(gid, uid, role, jtime) values(?,?,?,?)", gid, uid, GroupRoleMember, ctime)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	group.Id = gid
+	group.Ctime = ctime
+	return gid, nil
+}
+
+//添加群成员，已经是群成员的uid会被忽略
+func AddGroupMembers(ctx context.Context, gid int64, uids []int64) error {
+	if gid < 1 {
+		return errors.New("gid is invalid")
+	}
+	if len(uids) == 0 {
+		return errors.New("uids is empty")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	maxMember, count, err := queryGroupCapacityTx(ctx, tx, gid)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	jtime := util.CurrentTimeStr(sqlGroupTimeLayout)
+	for _, uid := range uids {
+		r, err := tx.ExecContext(ctx, "insert ignore into chat_group_member(gid, uid, role, jtime) values(?,?,?,?)", gid, uid, GroupRoleMember, jtime)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		affected, err := r.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		count += int(affected)
+	}
+	if count > maxMember {
+		_ = tx.Rollback()
+		return errors.New("member count exceeds max member")
+	}
+	return tx.Commit()
+}
+
+//移除群成员
+func RemoveGroupMember(ctx context.Context, gid int64, uid int64) error {
+	if gid < 1 {
+		return errors.New("gid is invalid")
+	}
+	if uid < 1 {
+		return errors.New("uid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, "delete from chat_group_member where gid = ? and uid = ?", gid, uid)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("rows affected is 0")
+	}
+	return nil
+}
+
+//更新群成员角色
+func UpdateGroupMemberRole(ctx context.Context, gid int64, uid int64, role uint8) error {
+	if gid < 1 {
+		return errors.New("gid is invalid")
+	}
+	if uid < 1 {
+		return errors.New("uid is invalid")
+	}
+	if role > GroupRoleOwner {
+		return errors.New("role is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, "update chat_group_member set role = ? where gid = ? and uid = ?", role, gid, uid)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("rows affected is 0")
+	}
+	return nil
+}
+
+//更新群名称和头像
+func UpdateGroupInfo(ctx context.Context, gid int64, name string, avatar string) error {
+	if gid < 1 {
+		return errors.New("gid is invalid")
+	}
+	err := verifyGroupInfo(name, avatar)
+	if err != nil {
+		return err
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "update chat_group set name = ?, avatar = ? where id = ?", name, avatar, gid)
+	return err
+}
+
+func queryGroups(ctx context.Context, query string, args ...interface{}) ([]*Group, error) {
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*Group
+	for rows.Next() {
+		group := &Group{}
+		err = rows.Scan(&group.Id, &group.Name, &group.Avatar, &group.Owner, &group.MaxMember, &group.Ctime)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, group)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+//根据群id获取群信息，群不存在时返回nil
+func GetGroupById(ctx context.Context, gid int64) (*Group, error) {
+	if gid < 1 {
+		return nil, errors.New("gid is invalid")
+	}
+	groups, err := queryGroups(ctx, "select id, name, avatar, owner, max_member, ctime from chat_group where id = ?", gid)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	return groups[0], nil
+}
+
+//获取用户加入的所有群
+func GetGroupsByUid(ctx context.Context, uid int64) ([]*Group, error) {
+	if uid < 1 {
+		return nil, errors.New("uid is invalid")
+	}
+	return queryGroups(ctx, "select g.id, g.name, g.avatar, g.owner, g.max_member, g.ctime from chat_group g join chat_group_member m on g.id = m.gid where m.uid = ?", uid)
+}
+
+//获取群的所有成员
+func GetGroupMembers(ctx context.Context, gid int64) ([]*GroupMember, error) {
+	if gid < 1 {
+		return nil, errors.New("gid is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "select id, uid, role, jtime from chat_group_member where gid = ?", gid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*GroupMember
+	for rows.Next() {
+		member := &GroupMember{Gid: gid}
+		err = rows.Scan(&member.Id, &member.Uid, &member.Role, &member.Jtime)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, member)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,210 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/liqifyl/chat-go/internal/util"
+)
+
+const (
+	MessageContentTypeText  = iota //文本
+	MessageContentTypeImage        //图片url
+	MessageContentTypeVoice        //语音url
+	MessageContentTypeVideo        //视频url
+)
+
+const (
+	MessageStatusSent      = iota //服务端已保存
+	MessageStatusDelivered        //接收者已收到
+	MessageStatusRead             //接收者已读
+)
+
+const (
+	sqlMessageSTimeLayout = "2006-01-02 15:04:05.000"
+	sqlMessageMaxLimit    = 500
+)
+
+//对应im数据库中的message表
+type Message struct {
+	Id           int64  `json:"id"`           //消息唯一id；表中字段名为id
+	Conversation string `json:"conversation"` //会话id；表中字段名为conversation
+	Seq          int64  `json:"seq"`          //会话内递增序列号，从1开始；表中字段名为seq
+	Sender       int64  `json:"sender"`       //发送者uid；表中字段名为sender
+	Receiver     int64  `json:"receiver"`     //接收者uid，群消息为0；表中字段名为receiver
+	Gid          int64  `json:"gid"`          //群id，单聊消息为0；表中字段名为gid
+	Ctype        uint8  `json:"ctype"`        //消息内容类型，参考MessageContentType*；表中字段名为ctype
+	Content      string `json:"content"`      //消息内容；表中字段名为content
+	Stime        string `json:"stime"`        //服务端收到消息的时间；表中字段名为stime
+	Status       uint8  `json:"status"`       //消息状态，参考MessageStatus*；表中字段名为status
+}
+
+//生成单聊会话id，两个用户无论谁发送都对应同一个会话
+func GenerateP2PConversation(uid int64, peer int64) string {
+	if uid > peer {
+		uid, peer = peer, uid
+	}
+	return fmt.Sprintf("p2p-%d-%d", uid, peer)
+}
+
+//生成群聊会话id
+func GenerateGroupConversation(gid int64) string {
+	return fmt.Sprintf("group-%d", gid)
+}
+
+//保存一条消息，在同一个事务中为消息分配会话内的seq
+func InsertMessage(ctx context.Context, message *Message) (int64, error) {
+	if message.Conversation == "" {
+		return 0, errors.New("conversation is empty")
+	}
+	if message.Sender < 1 {
+		return 0, errors.New("sender is invalid")
+	}
+	if message.Ctype > MessageContentTypeVideo {
+		return 0, errors.New("ctype is invalid")
+	}
+	if message.Content == "" {
+		return 0, errors.New("content is empty")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	//更新会话seq的行锁会保持到事务提交，同一会话的消息按顺序分配seq
+	_, err = tx.ExecContext(ctx, "insert into conversation_seq(conversation, seq) values(?, 1) on duplicate key update seq = seq + 1", message.Conversation)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	var seq int64
+	err = tx.QueryRowContext(ctx, "select seq from conversation_seq where conversation = ?", message.Conversation).Scan(&seq)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	stime := util.CurrentTimeStr(sqlMessageSTimeLayout)
+	r, err := tx.ExecContext(ctx, "insert into message(conversation, seq, sender, receiver, gid, ctype, content, stime) values(?,?,?,?,?,?,?,?)",
+		message.Conversation, seq, message.Sender, message.Receiver, message.Gid, message.Ctype, message.Content, stime)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	message.Id = id
+	message.Seq = seq
+	message.Stime = stime
+	message.Status = MessageStatusSent
+	return id, nil
+}
+
+func queryMessages(ctx context.Context, query string, args ...interface{}) ([]*Message, error) {
+	db, err := getImDb()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*Message
+	for rows.Next() {
+		message := &Message{}
+		err = rows.Scan(&message.Id, &message.Conversation, &message.Seq, &message.Sender, &message.Receiver, &message.Gid, &message.Ctype, &message.Content, &message.Stime, &message.Status)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, message)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+//获取会话中seq大于指定seq的消息，根据seq升序
+func GetMessagesAfterSeq(ctx context.Context, conversation string, seq int64, limit int) ([]*Message, error) {
+	if conversation == "" {
+		return nil, errors.New("conversation is empty")
+	}
+	if limit < 1 || limit > sqlMessageMaxLimit {
+		limit = sqlMessageMaxLimit
+	}
+	return queryMessages(ctx, "select id, conversation, seq, sender, receiver, gid, ctype, content, stime, status from message where conversation = ? and seq > ? order by seq asc limit ?",
+		conversation, seq, limit)
+}
+
+//获取会话中最新的limit条消息，根据seq升序
+func GetLatestMessages(ctx context.Context, conversation string, limit int) ([]*Message, error) {
+	if conversation == "" {
+		return nil, errors.New("conversation is empty")
+	}
+	if limit < 1 || limit > sqlMessageMaxLimit {
+		limit = sqlMessageMaxLimit
+	}
+	messages, err := queryMessages(ctx, "select id, conversation, seq, sender, receiver, gid, ctype, content, stime, status from message where conversation = ? order by seq desc limit ?",
+		conversation, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+//根据会话id和seq获取一条消息，消息不存在时返回nil
+func GetMessageBySeq(ctx context.Context, conversation string, seq int64) (*Message, error) {
+	if conversation == "" {
+		return nil, errors.New("conversation is empty")
+	}
+	messages, err := queryMessages(ctx, "select id, conversation, seq, sender, receiver, gid, ctype, content, stime, status from message where conversation = ? and seq = ?",
+		conversation, seq)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	return messages[0], nil
+}
+
+//接收者确认消息状态，状态只能前进，返回是否有更新
+func UpdateMessageStatus(ctx context.Context, conversation string, seq int64, receiver int64, status uint8) (bool, error) {
+	if conversation == "" {
+		return false, errors.New("conversation is empty")
+	}
+	if receiver < 1 {
+		return false, errors.New("receiver is invalid")
+	}
+	if status <= MessageStatusSent || status > MessageStatusRead {
+		return false, errors.New("status is invalid")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return false, err
+	}
+	result, err := db.ExecContext(ctx, "update message set status = ? where conversation = ? and seq = ? and receiver = ? and status < ?",
+		status, conversation, seq, receiver, status)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
@@ -1,10 +1,14 @@
 package sql
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/liqifyl/chat-go/internal/log/ctxlog"
+	"github.com/liqifyl/chat-go/internal/password"
 	"github.com/liqifyl/chat-go/internal/util"
-	"log"
+	"go.uber.org/zap"
 	"time"
 )
 
@@ -13,18 +17,18 @@ var (
 )
 
 type ChatUser struct {
-	Id          int64  `json:"id"`       //用户id，这个是数据库生成的；表的中字段名为id
-	Nick        string `json:"nick"`     //用户名, 长度[0,200]；表的中字段名为nick
-	Password    string `json:"pwd"`      //密码，长度[0,30]，表中的字段名为password
-	Age         uint8  `json:"age"`      //年龄，[0,255]；表中的字段名为age
-	Birthday    string `json:"birthday"` //生日，datetime，YYYY-mm-dd HH::MM::SS；表中字段名为birthday
-	Sign        string `json:"sign"`     //个性签名，[0,100];表中字段名为sign
-	Country     string `json:"country"`  //国家，[0,20];表中字段名为country
-	Sex         uint8  `json:"sex"`      //0男，1女;表中字段名为sex
-	PhoneNumber string `json:"pnumber"`  //长度11，必须全部是数字；表中字段名为pnumber
+	Id          int64  `json:"id"`            //用户id，这个是数据库生成的；表的中字段名为id
+	Nick        string `json:"nick"`          //用户名, 长度[0,200]；表的中字段名为nick
+	Password    string `json:"pwd,omitempty"` //注册时为明文密码，长度[1,72]，保存到数据库的是bcrypt hash；表中的字段名为password
+	Age         uint8  `json:"age"`           //年龄，[0,255]；表中的字段名为age
+	Birthday    string `json:"birthday"`      //生日，datetime，YYYY-mm-dd HH::MM::SS；表中字段名为birthday
+	Sign        string `json:"sign"`          //个性签名，[0,100];表中字段名为sign
+	Country     string `json:"country"`       //国家，[0,20];表中字段名为country
+	Sex         uint8  `json:"sex"`           //0男，1女;表中字段名为sex
+	PhoneNumber string `json:"pnumber"`       //长度11，必须全部是数字；表中字段名为pnumber
 }
 
-func QueryUserById(id int64) ([]*ChatUser, error) {
+func QueryUserById(ctx context.Context, id int64) ([]*ChatUser, error) {
 	if id < 1 {
 		return nil, errors.New("id must be greater than 0")
 	}
@@ -32,7 +36,7 @@ func QueryUserById(id int64) ([]*ChatUser, error) {
 	if err != nil {
 		return nil, err
 	}
-	rows, err := db.Query("select nick,password,age,birthday,sign,country,sex,pnumber from user where id=?", id)
+	rows, err := db.QueryContext(ctx, "select nick,age,birthday,sign,country,sex,pnumber from user where id=?", id)
 	if err != nil {
 		return nil, err
 	}
@@ -40,18 +44,17 @@ func QueryUserById(id int64) ([]*ChatUser, error) {
 	var results []*ChatUser
 	for rows.Next() {
 		var nick string
-		var password string
 		var age uint8
 		var birthday string
 		var sign string
 		var country string
 		var sex uint8
 		var phoneNumber string
-		err = rows.Scan(&nick, &password, &age, &birthday, &sign, &country, &sex, &phoneNumber)
+		err = rows.Scan(&nick, &age, &birthday, &sign, &country, &sex, &phoneNumber)
 		if err != nil {
 			break
 		}
-		user := ChatUser{Id: id, Nick: nick, Password: password, Age: age, Birthday: birthday, Sign: sign, Country: country, Sex: sex, PhoneNumber: phoneNumber}
+		user := ChatUser{Id: id, Nick: nick, Age: age, Birthday: birthday, Sign: sign, Country: country, Sex: sex, PhoneNumber: phoneNumber}
 		results = append(results, &user)
 	}
 	if err != nil {
@@ -64,7 +67,7 @@ func verifyPhoneNumber(phoneNumber string) error {
 	if len(phoneNumber) != 11 {
 		return errors.New("phone number length must equal 11")
 	}
-	var err  error = nil
+	var err error = nil
 	for index, num := range phoneNumber {
 		if index == 0 {
 			if num <= '0' {
@@ -82,12 +85,13 @@ func verifyPhoneNumber(phoneNumber string) error {
 }
 
 //添加用户
-func InsertUser(user *ChatUser) (int64, error) {
+func InsertUser(ctx context.Context, user *ChatUser) (int64, error) {
 	if len(user.Nick) == 0 {
 		return 0, errors.New("name is empty")
 	}
-	if len(user.Password) == 0 {
-		return 0, errors.New("password is empty")
+	passwordHash, err := password.Hash(user.Password)
+	if err != nil {
+		return 0, err
 	}
 	//if len(user.Sign) == 0 {
 	//	return 0, errors.New("self sign is empty")
@@ -100,7 +104,7 @@ func InsertUser(user *ChatUser) (int64, error) {
 	} else {
 		user.Sex = 0
 	}
-	err := verifyPhoneNumber(user.PhoneNumber)
+	err = verifyPhoneNumber(user.PhoneNumber)
 	if err != nil {
 		return 0, err
 	}
@@ -114,20 +118,20 @@ func InsertUser(user *ChatUser) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		if tx != nil {
 			_ = tx.Rollback()
 		}
 		return 0, err
 	}
-	stmt, err := db.Prepare("insert into user(nick, password, age, birthday, sign, country, sex, pnumber, rtime) values(?,?,?,?,?,?,?,?,?)")
+	stmt, err := db.PrepareContext(ctx, "insert into user(nick, password, age, birthday, sign, country, sex, pnumber, rtime) values(?,?,?,?,?,?,?,?,?)")
 	if err != nil {
 		_ = tx.Rollback()
 		return 0, err
 	}
 	defer stmt.Close()
-	r, err := stmt.Exec(user.Nick, user.Password, user.Age, user.Birthday, user.Sign, user.Country, user.Sex, user.PhoneNumber, rtime)
+	r, err := stmt.ExecContext(ctx, user.Nick, passwordHash, user.Age, user.Birthday, user.Sign, user.Country, user.Sex, user.PhoneNumber, rtime)
 	if err != nil {
 		_ = tx.Rollback()
 		return 0, err
@@ -145,37 +149,38 @@ func InsertUser(user *ChatUser) (int64, error) {
 }
 
 //更新用户密码
-func UpdateUserPwd(user *ChatUser, newPwd string) error {
+func UpdateUserPwd(ctx context.Context, user *ChatUser, newPwd string) error {
 	if user == nil {
 		return errors.New("user is nil")
 	}
 	if user.Id <= 0 {
 		return errors.New("user is invalid")
 	}
-	if len(newPwd) == 0 {
-		return errors.New("new password is empty")
+	passwordHash, err := password.Hash(newPwd)
+	if err != nil {
+		return err
 	}
 	db, err := getImDb()
 	if err != nil {
 		return err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		if tx != nil {
 			_ = tx.Rollback()
 		}
 		return err
 	}
-	stmt, err := db.Prepare("UPDATE user SET password = ? WHERE id = ?")
+	stmt, err := db.PrepareContext(ctx, "UPDATE user SET password = ? WHERE id = ?")
 	if err != nil {
 		_ = tx.Rollback()
 		return err
 	}
 	defer stmt.Close()
-	r, err := stmt.Exec(newPwd, user.Id)
+	r, err := stmt.ExecContext(ctx, passwordHash, user.Id)
 	if err != nil {
 		_ = tx.Rollback()
-		log.Printf("exe update user pwd error %v", err)
+		ctxlog.From(ctx).Error("exe update user pwd error", zap.Error(err))
 		return err
 	}
 	rows, err := r.RowsAffected()
@@ -194,7 +199,7 @@ func UpdateUserPwd(user *ChatUser, newPwd string) error {
 }
 
 //更新用户Nick
-func UpdateUserNick(user *ChatUser, newNick string) error {
+func UpdateUserNick(ctx context.Context, user *ChatUser, newNick string) error {
 	if user == nil {
 		return errors.New("user is nil")
 	}
@@ -208,20 +213,20 @@ func UpdateUserNick(user *ChatUser, newNick string) error {
 	if err != nil {
 		return err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		if tx != nil {
 			_ = tx.Rollback()
 		}
 		return err
 	}
-	stmt, err := db.Prepare("UPDATE user SET nick = ? WHERE id = ?")
+	stmt, err := db.PrepareContext(ctx, "UPDATE user SET nick = ? WHERE id = ?")
 	if err != nil {
 		_ = tx.Rollback()
 		return err
 	}
 	defer stmt.Close()
-	r, err := stmt.Exec(newNick, user.Id)
+	r, err := stmt.ExecContext(ctx, newNick, user.Id)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -242,7 +247,7 @@ func UpdateUserNick(user *ChatUser, newNick string) error {
 }
 
 //更新用户签名
-func UpdateUserSign(user *ChatUser, newSign string) error {
+func UpdateUserSign(ctx context.Context, user *ChatUser, newSign string) error {
 	if user == nil {
 		return errors.New("user is nil")
 	}
@@ -256,19 +261,19 @@ func UpdateUserSign(user *ChatUser, newSign string) error {
 	if err != nil {
 		return err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		if tx != nil {
 			_ = tx.Rollback()
 		}
 		return err
 	}
-	stmt, err := db.Prepare("UPDATE user SET sign = ? WHERE id = ?")
+	stmt, err := db.PrepareContext(ctx, "UPDATE user SET sign = ? WHERE id = ?")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	r, err := stmt.Exec(newSign, user.Id)
+	r, err := stmt.ExecContext(ctx, newSign, user.Id)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -289,7 +294,7 @@ func UpdateUserSign(user *ChatUser, newSign string) error {
 }
 
 //更新用户生日
-func UpdateUserBirthday(user *ChatUser, newBirthday string) error {
+func UpdateUserBirthday(ctx context.Context, user *ChatUser, newBirthday string) error {
 	if user == nil {
 		return errors.New("user is nil")
 	}
@@ -307,19 +312,19 @@ func UpdateUserBirthday(user *ChatUser, newBirthday string) error {
 	if err != nil {
 		return err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		if tx != nil {
 			_ = tx.Rollback()
 		}
 		return err
 	}
-	stmt, err := db.Prepare("UPDATE user SET birthday = ? WHERE id = ?")
+	stmt, err := db.PrepareContext(ctx, "UPDATE user SET birthday = ? WHERE id = ?")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	r, err := stmt.Exec(newBirthday, user.Id)
+	r, err := stmt.ExecContext(ctx, newBirthday, user.Id)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -340,12 +345,12 @@ func UpdateUserBirthday(user *ChatUser, newBirthday string) error {
 }
 
 //查看用户签名
-func GetUserSignById(id int64) (string, error) {
+func GetUserSignById(ctx context.Context, id int64) (string, error) {
 	db, err := getImDb()
 	if err != nil {
 		return "", err
 	}
-	rows, err := db.Query("select sign from user where id=?", id)
+	rows, err := db.QueryContext(ctx, "select sign from user where id=?", id)
 	if err != nil {
 		return "", err
 	}
@@ -362,12 +367,12 @@ func GetUserSignById(id int64) (string, error) {
 }
 
 //获得用户nick
-func GetUserNick(id int64) (string, error) {
+func GetUserNick(ctx context.Context, id int64) (string, error) {
 	db, err := getImDb()
 	if err != nil {
 		return "", err
 	}
-	rows, err := db.Query("select nick from user where id=?", id)
+	rows, err := db.QueryContext(ctx, "select nick from user where id=?", id)
 	if err != nil {
 		return "", err
 	}
@@ -382,3 +387,37 @@ func GetUserNick(id int64) (string, error) {
 	}
 	return nick, nil
 }
+
+//获取用户保存在数据库中的密码hash，旧版本注册的用户是明文
+func GetUserPasswordById(ctx context.Context, id int64) (string, error) {
+	if id < 1 {
+		return "", errors.New("id must be greater than 0")
+	}
+	db, err := getImDb()
+	if err != nil {
+		return "", err
+	}
+	var stored string
+	err = db.QueryRowContext(ctx, "select password from user where id=?", id).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return "", errors.New("user is not exist")
+	}
+	if err != nil {
+		return "", err
+	}
+	return stored, nil
+}
+
+//用新的hash替换旧的密码，只有数据库中仍然是old时才替换，避免覆盖并发修改的密码
+func RehashUserPwd(ctx context.Context, id int64, old string, plain string) error {
+	passwordHash, err := password.Hash(plain)
+	if err != nil {
+		return err
+	}
+	db, err := getImDb()
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE user SET password = ? WHERE id = ? and password = ?", passwordHash, id, old)
+	return err
+}
@@ -0,0 +1,264 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/liqifyl/chat-go/internal/config"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"math/big"
+	"sync"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+
+	tokenMinSecretLen = 32
+)
+
+var (
+	keySetLock    sync.RWMutex
+	defaultKeySet *KeySet
+)
+
+//一个签名密钥，只配置了公钥时signKey为nil，只能用于校验
+type key struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+//同时有效的一组密钥，新token使用signing签发，校验时根据token头中的kid选择密钥
+type KeySet struct {
+	signing *key
+	keys    map[string]*key
+	order   []*key
+}
+
+//JWKS中的一个公钥，参考RFC 7517
+type JsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JsonWebKeySet struct {
+	Keys []JsonWebKey `json:"keys"`
+}
+
+func loadKey(keyConfig config.TokenKeyConfig) (*key, error) {
+	if keyConfig.Kid == "" {
+		return nil, errors.New("kid is empty")
+	}
+	k := &key{kid: keyConfig.Kid}
+	switch keyConfig.Alg {
+	case AlgHS256:
+		if len(keyConfig.Secret) < tokenMinSecretLen {
+			return nil, fmt.Errorf("secret length must be at least %d", tokenMinSecretLen)
+		}
+		k.method = jwt.SigningMethodHS256
+		k.signKey = []byte(keyConfig.Secret)
+		k.verifyKey = k.signKey
+		return k, nil
+	case AlgRS256:
+		k.method = jwt.SigningMethodRS256
+	case AlgEdDSA:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("alg %q is not supported", keyConfig.Alg)
+	}
+	if keyConfig.PrivateKeyFile != "" {
+		pem, err := ioutil.ReadFile(keyConfig.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if k.method == jwt.SigningMethodRS256 {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			k.signKey = privateKey
+			k.verifyKey = &privateKey.PublicKey
+		} else {
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			edKey, isEd := privateKey.(ed25519.PrivateKey)
+			if !isEd {
+				return nil, errors.New("private key is not ed25519")
+			}
+			k.signKey = edKey
+			k.verifyKey = edKey.Public()
+		}
+		return k, nil
+	}
+	if keyConfig.PublicKeyFile == "" {
+		return nil, errors.New("private_key_file and public_key_file are empty")
+	}
+	pem, err := ioutil.ReadFile(keyConfig.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if k.method == jwt.SigningMethodRS256 {
+		k.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+	} else {
+		k.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(pem)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+//根据配置加载密钥，signingKid为空时使用第一个可以签名的密钥
+func NewKeySet(keyConfigs []config.TokenKeyConfig, signingKid string) (*KeySet, error) {
+	keySet := &KeySet{keys: make(map[string]*key)}
+	for i, keyConfig := range keyConfigs {
+		k, err := loadKey(keyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("token key %d(%s): %v", i, keyConfig.Kid, err)
+		}
+		if keySet.keys[k.kid] != nil {
+			return nil, fmt.Errorf("token key %d(%s): kid is duplicated", i, keyConfig.Kid)
+		}
+		keySet.keys[k.kid] = k
+		keySet.order = append(keySet.order, k)
+		if keySet.signing == nil && k.signKey != nil && (signingKid == "" || signingKid == k.kid) {
+			keySet.signing = k
+		}
+	}
+	if keySet.signing == nil {
+		if signingKid != "" {
+			return nil, fmt.Errorf("signing kid %s is not configured or has no private key", signingKid)
+		}
+		return nil, errors.New("no token key can sign")
+	}
+	return keySet, nil
+}
+
+//生成只在当前进程内有效的HS256密钥，重启后或者多实例之间token都不能通用
+func newEphemeralKeySet() (*KeySet, error) {
+	secret, err := randomBytes(tokenMinSecretLen)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	keyConfig := config.TokenKeyConfig{Kid: "ephemeral-" + hex.EncodeToString(kid), Alg: AlgHS256, Secret: string(secret)}
+	return NewKeySet([]config.TokenKeyConfig{keyConfig}, "")
+}
+
+//加载默认密钥，没有配置密钥时使用随机生成的临时密钥
+func InitKeys(keyConfigs []config.TokenKeyConfig, signingKid string) error {
+	var keySet *KeySet
+	var err error
+	if len(keyConfigs) == 0 {
+		zap.L().Warn("token keys are not configured, use an ephemeral HS256 key; tokens will be invalid after restart and can not be shared between instances")
+		keySet, err = newEphemeralKeySet()
+	} else {
+		keySet, err = NewKeySet(keyConfigs, signingKid)
+	}
+	if err != nil {
+		return err
+	}
+	keySetLock.Lock()
+	defaultKeySet = keySet
+	keySetLock.Unlock()
+	return nil
+}
+
+func getKeySet() (*KeySet, error) {
+	keySetLock.RLock()
+	keySet := defaultKeySet
+	keySetLock.RUnlock()
+	if keySet != nil {
+		return keySet, nil
+	}
+	//没有调用InitKeys时使用临时密钥
+	keySetLock.Lock()
+	defer keySetLock.Unlock()
+	if defaultKeySet == nil {
+		keySet, err := newEphemeralKeySet()
+		if err != nil {
+			return nil, err
+		}
+		zap.L().Warn("token keys are not initialized, use an ephemeral HS256 key")
+		defaultKeySet = keySet
+	}
+	return defaultKeySet, nil
+}
+
+func (self *KeySet) sign(claims jwt.Claims) (string, error) {
+	tokenClaims := jwt.NewWithClaims(self.signing.method, claims)
+	tokenClaims.Header["kid"] = self.signing.kid
+	return tokenClaims.SignedString(self.signing.signKey)
+}
+
+//根据token头中的kid以及alg选择校验的公钥
+func (self *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("kid is empty")
+	}
+	k := self.keys[kid]
+	if k == nil {
+		return nil, fmt.Errorf("kid %s is unknown", kid)
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, errors.New("signing method is invalid")
+	}
+	return k.verifyKey, nil
+}
+
+//所有非对称密钥的公钥，HS256密钥不会公开
+func (self *KeySet) JWKS() *JsonWebKeySet {
+	keySet := &JsonWebKeySet{Keys: []JsonWebKey{}}
+	for _, k := range self.order {
+		switch verifyKey := k.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keySet.Keys = append(keySet.Keys, JsonWebKey{
+				Kty: "RSA",
+				Kid: k.kid,
+				Use: "sig",
+				Alg: AlgRS256,
+				N:   base64.RawURLEncoding.EncodeToString(verifyKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(verifyKey.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keySet.Keys = append(keySet.Keys, JsonWebKey{
+				Kty: "OKP",
+				Kid: k.kid,
+				Use: "sig",
+				Alg: AlgEdDSA,
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(verifyKey),
+			})
+		}
+	}
+	return keySet
+}
+
+//默认密钥的JWKS
+func JWKS() (*JsonWebKeySet, error) {
+	keySet, err := getKeySet()
+	if err != nil {
+		return nil, err
+	}
+	return keySet.JWKS(), nil
+}
@@ -1,57 +1,97 @@
 package token
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/golang-jwt/jwt/v4"
 	"time"
 )
 
 const (
-	tokenJwtSecret     = "LqlH101211132414"
-	tokenValidDuration = 10 //token有效时间，单位小时
-	TokenIssuer        = "lq-chat"
+	AccessTokenValidDuration  = 15 * time.Minute    //access token有效时间，过期后使用refresh token换取新的
+	RefreshTokenValidDuration = 30 * 24 * time.Hour //refresh token有效时间，每次使用后都会轮换
+	TokenIssuer               = "lq-chat"
+	tokenIdBytes              = 16
+	sessionIdBytes            = 16
+	refreshTokenBytes         = 32
 )
 
+//access token中的claims，StandardClaims.Id为jti，用于注销时加入黑名单
 type Claims struct {
-	Uid int64 `json:"uid"`
+	Uid      int64  `json:"uid"`
+	Sid      string `json:"sid"` //登录会话id，会话被删除后token立即失效
+	DeviceId string `json:"did"` //登录设备id
+	Platform string `json:"plt"` //登录设备平台
 	jwt.StandardClaims
 }
 
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
 
-func GenerateForeverToken(uid int64) (string,error){
-	nowTime := time.Now()
-	expireTime := nowTime.Add(20 * 365 * 24 * time.Hour)
-	claims := Claims{
-		uid,
-		jwt.StandardClaims{
-			ExpiresAt: expireTime.Unix(),
-			Issuer:    TokenIssuer,
-		},
+//生成登录会话id
+func GenerateSessionId() (string, error) {
+	b, err := randomBytes(sessionIdBytes)
+	if err != nil {
+		return "", err
 	}
-	tokenClaims := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token, err := tokenClaims.SignedString([]byte(tokenJwtSecret))
-	return token, err
+	return hex.EncodeToString(b), nil
 }
 
-func GenerateToken(uid int64) (string, error) {
+//为设备上的登录会话生成短期有效的access token
+func GenerateToken(uid int64, sid string, deviceId string, platform string) (string, *Claims, error) {
+	jti, err := randomBytes(tokenIdBytes)
+	if err != nil {
+		return "", nil, err
+	}
 	nowTime := time.Now()
-	expireTime := nowTime.Add(tokenValidDuration * time.Hour)
-	claims := Claims{
+	expireTime := nowTime.Add(AccessTokenValidDuration)
+	claims := &Claims{
 		uid,
+		sid,
+		deviceId,
+		platform,
 		jwt.StandardClaims{
+			Id:        hex.EncodeToString(jti),
+			IssuedAt:  nowTime.Unix(),
 			ExpiresAt: expireTime.Unix(),
 			Issuer:    TokenIssuer,
 		},
 	}
-	tokenClaims := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token, err := tokenClaims.SignedString([]byte(tokenJwtSecret))
-	return token, err
+	keySet, err := getKeySet()
+	if err != nil {
+		return "", nil, err
+	}
+	token, err := keySet.sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+//生成不透明的refresh token，服务端只保存它的状态
+func GenerateRefreshToken() (string, error) {
+	b, err := randomBytes(refreshTokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+//校验并解析access token，根据kid选择密钥
 func ParseToken(token string) (*Claims, error) {
-	tokenClaims, err := jwt.ParseWithClaims(token, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(tokenJwtSecret), nil
-	})
+	keySet, err := getKeySet()
+	if err != nil {
+		return nil, err
+	}
+	tokenClaims, err := jwt.ParseWithClaims(token, &Claims{}, keySet.keyFunc)
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +99,9 @@ func ParseToken(token string) (*Claims, error) {
 		return nil, errors.New("tokenClaims is nil")
 	}
 	if claims, ok := tokenClaims.Claims.(*Claims); ok && tokenClaims.Valid {
+		if claims.Id == "" || claims.Sid == "" {
+			return nil, errors.New("token id or session id is empty")
+		}
 		return claims, nil
 	}
 	return nil, errors.New("parse to *Claims fail or tokenClaims is invalid")
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	ServiceName = "chat-server"
+	tracerName  = "github.com/liqifyl/chat-go"
+)
+
+type Config struct {
+	ServiceVersion string
+	OtlpEndpoint   string  //otlp http接收地址host:port，例如本地collector的127.0.0.1:4318；为空时不导出span
+	OtlpInsecure   bool    //使用http而不是https连接collector
+	SampleRatio    float64 //没有上游traceparent时的采样比例，[0,1]
+}
+
+//初始化全局TracerProvider和W3C traceparent传播；返回的函数在退出前调用，用来导出剩余的span
+func Init(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.OtlpEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.OtlpEndpoint)}
+	if config.OtlpInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(ServiceName),
+		semconv.ServiceVersionKey.String(config.ServiceVersion),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+//每个路由一个server span，接受请求中的traceparent，并在响应头中返回traceparent
+func GinMiddleware() []gin.HandlerFunc {
+	return []gin.HandlerFunc{otelgin.Middleware(ServiceName), injectResponse}
+}
+
+func injectResponse(c *gin.Context) {
+	otel.GetTextMapPropagator().Inject(c.Request.Context(), propagation.HeaderCarrier(c.Writer.Header()))
+	c.Next()
+}
+
+//开始一个内部span
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+//开始一个新的trace，和ctx中的span建立link；用于长连接上的每一帧这类不应该挂在连接span下的操作
+func StartLinked(ctx context.Context, name string) (context.Context, trace.Span) {
+	return Start(ctx, name, trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(ctx)))
+}
+
+//ctx中有span时返回trace_id和span_id日志字段
+func ZapFields(ctx context.Context) []zap.Field {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return nil
+	}
+	return []zap.Field{
+		zap.String("trace_id", spanContext.TraceID().String()),
+		zap.String("span_id", spanContext.SpanID().String()),
+	}
+}
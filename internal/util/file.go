@@ -0,0 +1,76 @@
+package util
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"mime/multipart"
+	"os"
+)
+
+//把上传的文件保存到saveDir/fileName，先写入临时文件再重命名，保证不会出现写了一半的文件
+func SaveMultipartFile(httpFile *multipart.FileHeader, saveDir string, fileName string) error {
+	saveDirInfo, err := os.Stat(saveDir)
+	if err != nil {
+		//不存在
+		err := os.MkdirAll(saveDir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	} else {
+		//存在
+		if !saveDirInfo.IsDir() {
+			return errors.New("save path is not directory")
+		}
+	}
+	//创建文件
+	saveFilePath := saveDir + "/" + fileName
+	saveFileTmpPath := saveFilePath + ".tmp"
+	err = writeMultipartFile(httpFile, saveFileTmpPath)
+	if err == nil {
+		err = os.Rename(saveFileTmpPath, saveFilePath)
+	}
+	if err != nil {
+		removeErr := os.Remove(saveFileTmpPath)
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			zap.L().Error("remove error", zap.String("path", saveFileTmpPath), zap.Error(removeErr))
+		}
+		return err
+	}
+	return nil
+}
+
+func writeMultipartFile(httpFile *multipart.FileHeader, path string) error {
+	reader, err := httpFile.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(file, reader)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if n == 0 {
+		return errors.New("upload file size is zero")
+	}
+	zap.L().Debug("write file", zap.String("path", path), zap.Int64("size", n))
+	return nil
+}
+
+//删除文件，文件不存在时忽略
+func RemoveFiles(paths ...string) {
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			zap.L().Error("remove error", zap.String("path", path), zap.Error(err))
+		}
+	}
+}
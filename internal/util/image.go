@@ -0,0 +1,106 @@
+package util
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+)
+
+const (
+	thumbnailJpegQuality = 80
+	thumbnailMaxPixels   = 40 << 20 //原图最多的像素数，解码后每个像素至少占4字节，避免很小的压缩文件解码后耗尽内存
+)
+
+//生成图片的缩略图，最长边不超过maxSize，保存为jpeg格式；原图比maxSize小时不放大，原图像素数超过thumbnailMaxPixels时返回error
+func GenerateThumbnail(srcPath string, dstPath string, maxSize int) error {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	//先只解析图片头中的宽高
+	config, _, err := image.DecodeConfig(srcFile)
+	if err != nil {
+		return err
+	}
+	if config.Width < 1 || config.Height < 1 || int64(config.Width)*int64(config.Height) > thumbnailMaxPixels {
+		return fmt.Errorf("image size %dx%d is invalid", config.Width, config.Height)
+	}
+	_, err = srcFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(srcFile)
+	if err != nil {
+		return err
+	}
+	dst := resizeImage(src, maxSize)
+	dstTmpPath := dstPath + ".tmp"
+	dstFile, err := os.Create(dstTmpPath)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(dstFile, dst, &jpeg.Options{Quality: thumbnailJpegQuality})
+	closeErr := dstFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(dstTmpPath, dstPath)
+	}
+	if err != nil {
+		RemoveFiles(dstTmpPath)
+		return err
+	}
+	return nil
+}
+
+//按比例缩小图片，目标图片每个像素取原图对应区域的平均值
+func resizeImage(src image.Image, maxSize int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := srcW, srcH
+	if srcW >= srcH && srcW > maxSize {
+		dstW, dstH = maxSize, srcH*maxSize/srcW
+	} else if srcH > srcW && srcH > maxSize {
+		dstW, dstH = srcW*maxSize/srcH, maxSize
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := bounds.Min.Y + (y+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := bounds.Min.X + (x+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}